@@ -0,0 +1,450 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+
+	"tripwire/pkg/config"
+	"tripwire/pkg/detector"
+	"tripwire/pkg/logger"
+	"tripwire/pkg/metrics"
+)
+
+var errInterrupted = errors.New("Interrupted")
+
+// batch runs the batch command, reanalyzing archives of capture files
+func batch(args []string) {
+	flags := flag.NewFlagSet("batch", flag.ExitOnError)
+	configFile := flags.String("config", "", "Config file to use. Defaults are applied for any unspecified options.")
+	bpfFilter := flags.String("bpf", "", "BPF to filter input packets.")
+	out := flags.String("out", "", "File the merged output of every sensor is written to.")
+	checkpoint := flags.String("checkpoint", "", "File recording the sensors analyzed so far, from which an interrupted batch resumes. Defaults to the output file with a .checkpoint suffix.")
+	jobs := flags.Int("jobs", runtime.NumCPU(), "Number of sensors analyzed in parallel.")
+	match := flags.String("match", "*.pcap*", "Pattern matching the names of capture files.")
+	sensor := flags.String("sensor", "", "Regular expression whose first group, matched against the path of a capture file relative to its archive, names its sensor. Defaults to the directory of the file.")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: tripwire batch [flags] archive...\n\n"+
+			"Analyzes the capture files found under each archive directory, the files of each sensor\n"+
+			"in lexical order as one continuous capture, and merges the output of every sensor.\n\n")
+		flags.PrintDefaults()
+	}
+	_ = flags.Parse(args)
+
+	var cfg *config.Config
+	if *configFile != "" {
+		cfg = readConfig(*configFile)
+	} else {
+		cfg = config.DefaultConfig()
+	}
+	if *bpfFilter != "" {
+		cfg.Parser.Filter.BPF = *bpfFilter
+	}
+	if !cfg.Logger.Debug {
+		logger.Debug.SetOutput(ioutil.Discard)
+	}
+
+	b, err := newBatchJob(cfg, flags.Args(), *match, *sensor, *out, *checkpoint, *jobs)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	server := serveMetrics(cfg)
+	quitChan := make(chan os.Signal, 1)
+	signal.Notify(quitChan, syscall.SIGINT, syscall.SIGTERM)
+	err = b.run(quitChan)
+	metrics.Print(b.labels)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err = server.Close(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// batchJob analyzes archives of capture files, sorted by sensor. The files of a
+// sensor are read in lexical order as a single capture, so that streams spanning
+// files are reassembled, while sensors are analyzed in parallel. The output of
+// each sensor is written to its own file until every sensor is done and their
+// output is merged. Sensors done are recorded in a checkpoint file, from which
+// an interrupted job resumes.
+type batchJob struct {
+	cfg        *config.Config
+	sensors    []*sensor
+	out        string
+	checkpoint string
+	parts      string // directory of the output of each sensor
+	jobs       int
+	labels     []string // labels of the detectors
+
+	// Closed once the job is interrupted, after interrupted is set atomically
+	stop        chan struct{}
+	interrupted int32
+	// Serializes writes to the checkpoint
+	mutex sync.Mutex
+}
+
+// sensor is a series of capture files taken by the same sensor
+type sensor struct {
+	name  string
+	files []string
+	// Digest of the configuration and files, telling whether a sensor in the
+	// checkpoint was analyzed with the same configuration and files
+	fingerprint string
+}
+
+// checkpointEntry records a sensor done in the checkpoint file
+type checkpointEntry struct {
+	Sensor      string `json:"sensor"`
+	Fingerprint string `json:"fingerprint"`
+}
+
+// newBatchJob returns a job analyzing the capture files under the archives
+func newBatchJob(cfg *config.Config, archives []string, match, sensorPattern, out, checkpoint string, jobs int) (*batchJob, error) {
+	if len(archives) == 0 {
+		return nil, errors.New("[Config] Please specify the archives to analyze")
+	}
+	if out == "" || out == "-" {
+		return nil, errors.New("[Config] Please specify the output file with -out")
+	}
+	if checkpoint == "" {
+		checkpoint = out + ".checkpoint"
+	}
+	if jobs < 1 {
+		return nil, fmt.Errorf("[Config] Invalid number of jobs %d", jobs)
+	}
+	if _, err := filepath.Match(match, ""); err != nil {
+		return nil, fmt.Errorf("[Config] Invalid capture file pattern %q: %v", match, err)
+	}
+	var pattern *regexp.Regexp
+	if sensorPattern != "" {
+		var err error
+		if pattern, err = regexp.Compile(sensorPattern); err != nil {
+			return nil, fmt.Errorf("[Config] Invalid sensor pattern %q: %v", sensorPattern, err)
+		}
+		if pattern.NumSubexp() < 1 {
+			return nil, fmt.Errorf("[Config] Sensor pattern %q has no group naming the sensor", sensorPattern)
+		}
+	}
+
+	// Detectors are checked before any sensor is analyzed
+	b := &batchJob{cfg: cfg, out: out, checkpoint: checkpoint, parts: out + ".parts", jobs: jobs, stop: make(chan struct{})}
+	for _, dc := range cfg.Detectors {
+		df, err := detector.NewDetectorFactory(dc)
+		if err != nil {
+			return nil, err
+		}
+		b.labels = append(b.labels, df.Label())
+	}
+
+	var digest bytes.Buffer
+	if err := cfg.Write(&digest); err != nil {
+		return nil, err
+	}
+	sensors, err := findSensors(archives, match, pattern, digest.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	if len(sensors) == 0 {
+		return nil, fmt.Errorf("[Config] No capture file matches %q", match)
+	}
+	b.sensors = sensors
+	return b, nil
+}
+
+// findSensors returns the sensors of the capture files under the archives,
+// sorted by name, with their files in lexical order. Hidden files and
+// directories are skipped.
+func findSensors(archives []string, match string, pattern *regexp.Regexp, cfg []byte) ([]*sensor, error) {
+	type file struct {
+		path string
+		info os.FileInfo
+	}
+	files := make(map[string][]file)
+	for _, archive := range archives {
+		err := filepath.Walk(archive, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			hidden := path != archive && strings.HasPrefix(info.Name(), ".")
+			if info.IsDir() {
+				if hidden {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			// Links to capture files are followed, but not links to directories
+			if info.Mode()&os.ModeSymlink != 0 {
+				if info, err = os.Stat(path); err != nil {
+					return err
+				}
+			}
+			if hidden || !info.Mode().IsRegular() {
+				return nil
+			}
+			if ok, _ := filepath.Match(match, info.Name()); !ok {
+				return nil
+			}
+			name := filepath.Dir(path)
+			if pattern != nil {
+				rel, err := filepath.Rel(archive, path)
+				if err != nil {
+					return err
+				}
+				m := pattern.FindStringSubmatch(filepath.ToSlash(rel))
+				if m == nil {
+					logger.Debug.Printf("Skipping %q matching no sensor", path)
+					return nil
+				}
+				name = m[1]
+			}
+			files[name] = append(files[name], file{path, info})
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var sensors []*sensor
+	for name, fs := range files {
+		sort.Slice(fs, func(i, j int) bool { return fs[i].path < fs[j].path })
+		h := sha256.New()
+		h.Write(cfg)
+		s := &sensor{name: name}
+		for _, f := range fs {
+			fmt.Fprintf(h, "%s\x00%d\x00%d\n", f.path, f.info.Size(), f.info.ModTime().UnixNano())
+			s.files = append(s.files, f.path)
+		}
+		s.fingerprint = hex.EncodeToString(h.Sum(nil))
+		sensors = append(sensors, s)
+	}
+	sort.Slice(sensors, func(i, j int) bool { return sensors[i].name < sensors[j].name })
+	return sensors, nil
+}
+
+// run analyzes the sensors not done yet, then merges the output of every sensor
+// once they are all done
+func (b *batchJob) run(quitChan chan os.Signal) error {
+	if err := os.MkdirAll(b.parts, 0755); err != nil {
+		return err
+	}
+	done, err := b.readCheckpoint()
+	if err != nil {
+		return err
+	}
+
+	// Analyses running when the job is interrupted are stopped, and sensors not
+	// started yet are left for the next run
+	finished := make(chan struct{})
+	defer close(finished)
+	go func() {
+		select {
+		case <-quitChan:
+			atomic.StoreInt32(&b.interrupted, 1)
+			close(b.stop)
+		case <-finished:
+		}
+	}()
+	sensors := make(chan *sensor)
+	go func() {
+		defer close(sensors)
+		for _, s := range b.sensors {
+			if done[s.name] == s.fingerprint {
+				if _, err := os.Stat(b.part(s)); err == nil {
+					logger.Info.Printf("Skipping sensor %q done in checkpoint", s.name)
+					continue
+				}
+			}
+			select {
+			case sensors <- s:
+			case <-b.stop:
+				return
+			}
+		}
+	}()
+
+	var failed int32
+	var wg sync.WaitGroup
+	for i := 0; i < b.jobs; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for s := range sensors {
+				if err := b.analyze(s); err != nil {
+					if err != errInterrupted {
+						logger.Info.Printf("Unable to analyze sensor %q: %v", s.name, err)
+					}
+					atomic.AddInt32(&failed, 1)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if atomic.LoadInt32(&b.interrupted) != 0 {
+		return fmt.Errorf("Batch interrupted, run it again to resume from %q", b.checkpoint)
+	}
+	if failed > 0 {
+		return fmt.Errorf("Unable to analyze %d sensors, run the batch again to retry them", failed)
+	}
+	return b.merge()
+}
+
+// analyze analyzes the files of a sensor, and records it in the checkpoint once
+// done
+func (b *batchJob) analyze(s *sensor) error {
+	logger.Info.Printf("Analyzing sensor %q: %d files", s.name, len(s.files))
+	cfg := *b.cfg
+	cfg.Parser.Input.PcapFile, cfg.Parser.Input.PcapFiles = "", s.files
+	cfg.Parser.Input.Interface, cfg.Parser.Input.Interfaces = "", nil
+
+	f, err := os.Create(b.part(s))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+	a, err := newAnalysis(&cfg, w)
+	if err != nil {
+		return err
+	}
+
+	quitChan := make(chan os.Signal, 1)
+	finished := make(chan struct{})
+	go func() {
+		select {
+		case <-b.stop:
+			quitChan <- syscall.SIGINT
+		case <-finished:
+		}
+	}()
+	err = a.run(quitChan)
+	close(finished)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		return err
+	}
+	// A sensor whose analysis was cut short is analyzed again on resume. The
+	// parser only stops early once the job is interrupted.
+	if atomic.LoadInt32(&b.interrupted) != 0 {
+		return errInterrupted
+	}
+	logger.Info.Printf("Finished sensor %q", s.name)
+	return b.record(s)
+}
+
+// part returns the file the output of a sensor is written to
+func (b *batchJob) part(s *sensor) string {
+	return filepath.Join(b.parts, strings.NewReplacer("%", "%25", "/", "%2F", "\\", "%5C").Replace(s.name)+".out")
+}
+
+// readCheckpoint returns the fingerprints of the sensors done, by name
+func (b *batchJob) readCheckpoint() (map[string]string, error) {
+	done := make(map[string]string)
+	f, err := os.Open(b.checkpoint)
+	if os.IsNotExist(err) {
+		return done, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var entry checkpointEntry
+		// A line cut short by a crash is ignored
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err == nil {
+			done[entry.Sensor] = entry.Fingerprint
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(done) > 0 {
+		logger.Info.Printf("Resuming from checkpoint %q", b.checkpoint)
+	}
+	return done, nil
+}
+
+// record appends a sensor done to the checkpoint
+func (b *batchJob) record(s *sensor) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	line, err := json.Marshal(checkpointEntry{Sensor: s.name, Fingerprint: s.fingerprint})
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(b.checkpoint, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(append(line, '\n')); err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// merge writes the output of every sensor, by name, to the output file, then
+// removes the output of each sensor and the checkpoint
+func (b *batchJob) merge() error {
+	tmp := b.out + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	for _, s := range b.sensors {
+		part, err := os.Open(b.part(s))
+		if err != nil {
+			f.Close()
+			return err
+		}
+		_, err = io.Copy(f, part)
+		part.Close()
+		if err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err = f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp, b.out); err != nil {
+		return err
+	}
+	logger.Info.Printf("Merged the output of %d sensors into %q", len(b.sensors), b.out)
+	if err = os.RemoveAll(b.parts); err != nil {
+		return err
+	}
+	return os.Remove(b.checkpoint)
+}
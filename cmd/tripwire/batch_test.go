@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"tripwire/pkg/config"
+	"tripwire/pkg/logger"
+
+	"github.com/Kkevsterrr/gopacket"
+	"github.com/Kkevsterrr/gopacket/pcapgo"
+)
+
+// splitPcap writes the packets of a pcap file to n files in dir, named in the
+// order of their packets
+func splitPcap(t *testing.T, path, dir string, n int) {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	r, err := pcapgo.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var packets [][]byte
+	var infos []gopacket.CaptureInfo
+	for {
+		data, ci, err := r.ReadPacketData()
+		if err != nil {
+			break
+		}
+		packets, infos = append(packets, data), append(infos, ci)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	per := (len(packets) + n - 1) / n
+	for i := 0; i < n; i++ {
+		var buf bytes.Buffer
+		w := pcapgo.NewWriter(&buf)
+		if err := w.WriteFileHeader(r.Snaplen(), r.LinkType()); err != nil {
+			t.Fatal(err)
+		}
+		for j := i * per; j < (i+1)*per && j < len(packets); j++ {
+			if err := w.WritePacket(infos[j], packets[j]); err != nil {
+				t.Fatal(err)
+			}
+		}
+		name := filepath.Join(dir, fmt.Sprintf("capture-%02d.pcap", i))
+		if err := ioutil.WriteFile(name, buf.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// analyze returns the sorted output of a single run over a pcap file
+func analyze(t *testing.T, cfg config.Config, pcap string) []string {
+	cfg.Parser.Input.PcapFile = pcap
+	var out bytes.Buffer
+	a, err := newAnalysis(&cfg, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = a.run(nil); err != nil {
+		t.Fatal(err)
+	}
+	return sortedLines(out.String())
+}
+
+func sortedLines(s string) []string {
+	lines := strings.SplitAfter(s, "\n")
+	sort.Strings(lines)
+	return lines
+}
+
+func TestIntegrationBatch(t *testing.T) {
+	logger.Info.SetOutput(ioutil.Discard)
+	logger.Debug.SetOutput(ioutil.Discard)
+	defer logger.Info.SetOutput(os.Stderr)
+	defer logger.Debug.SetOutput(os.Stderr)
+
+	dir, err := ioutil.TempDir("", "tripwire")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// One sensor has a capture split into several files, the other a compressed one
+	archive := filepath.Join(dir, "archive")
+	splitPcap(t, "../../testdata/tripwire-1597963966.pcap", filepath.Join(archive, "sensor-a"), 3)
+	data, err := ioutil.ReadFile("../../testdata/full_http_request.pcap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var gz bytes.Buffer
+	w := gzip.NewWriter(&gz)
+	_, _ = w.Write(data)
+	w.Close()
+	if err = os.MkdirAll(filepath.Join(archive, "sensor-b"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(archive, "sensor-b", "capture.pcap.gz"), gz.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := readConfig("../../testdata/test3/config.yml")
+	cfg.Detectors = append(cfg.Detectors, config.DetectorConfig{Signature: "ANY", Protocol: "HTTP", Port: 8081})
+	cfg.Parser.Input.PcapFile = ""
+	expected := append(analyze(t, *cfg, "../../testdata/tripwire-1597963966.pcap"),
+		analyze(t, *cfg, "../../testdata/full_http_request.pcap")...)
+	sort.Strings(expected)
+
+	// Streams spanning files are reassembled as if the capture was not split
+	out := filepath.Join(dir, "out.json")
+	b, err := newBatchJob(cfg, []string{archive}, "*.pcap*", "", out, "", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b.sensors) != 2 || len(b.sensors[0].files) != 3 {
+		t.Fatalf("Expected %v sensors but got %v", 2, len(b.sensors))
+	}
+	if err = b.run(nil); err != nil {
+		t.Fatal(err)
+	}
+	actual, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := sortedLines(string(actual)); strings.Join(lines, "") != strings.Join(expected, "") {
+		t.Fatalf("Expected %v records but got %v", len(expected), len(lines))
+	}
+	if _, err = os.Stat(b.checkpoint); !os.IsNotExist(err) {
+		t.Fatalf("Expected checkpoint to be removed but got %v", err)
+	}
+
+	// Sensors done in the checkpoint are skipped, unless their files changed
+	b, err = newBatchJob(cfg, []string{archive}, "*.pcap*", "", out, "", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.MkdirAll(b.parts, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(b.part(b.sensors[0]), []byte("resumed\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = b.record(b.sensors[0]); err != nil {
+		t.Fatal(err)
+	}
+	stale := *b.sensors[1]
+	stale.fingerprint = "stale"
+	if err = b.record(&stale); err != nil {
+		t.Fatal(err)
+	}
+	if err = b.run(nil); err != nil {
+		t.Fatal(err)
+	}
+	actual, err = ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = append([]string{"resumed\n"}, analyze(t, *cfg, "../../testdata/full_http_request.pcap")...)
+	sort.Strings(expected)
+	if lines := sortedLines(string(actual)); strings.Join(lines, "") != strings.Join(expected, "") {
+		t.Fatalf("Expected %v but got %v", expected, lines)
+	}
+}
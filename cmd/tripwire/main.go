@@ -4,20 +4,26 @@ import (
 	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
+	"time"
 
 	"tripwire/pkg/collector"
 	"tripwire/pkg/config"
 	"tripwire/pkg/detector"
+	"tripwire/pkg/discovery"
+	"tripwire/pkg/features"
 	"tripwire/pkg/logger"
 	"tripwire/pkg/metrics"
 	"tripwire/pkg/parser"
+	"tripwire/pkg/sampler"
 	"tripwire/pkg/tcpstream"
 
 	"github.com/pkg/errors"
@@ -27,15 +33,20 @@ var (
 	printVersion = flag.Bool("version", false, "Print version and exit.")
 	dumpConfig   = flag.Bool("dump-config", false, "Print current configuration and exit.")
 	configFile   = flag.String("config", "", "Config file to use. Defaults are applied for any unspecified options.")
-	pcapFile     = flag.String("pcap", "", "Read packets from pcap file. Standard input is used if set to ``-''.")
+	pcapFile     = flag.String("pcap", "", "Read packets from pcap or pcapng file, optionally gzip, zstd or xz compressed, glob pattern or directory. Standard input is used if set to ``-''.")
 	iface        = flag.String("iface", "", "Interface on which to listen.")
 	bpfFilter    = flag.String("bpf", "", "BPF to filter input packets.")
+	replay       = flag.Float64("replay", 0, "Replay pcap files in real time as a live capture, at the given multiple of their speed.")
 
 	// Set at compile time with -ldflags
 	version = "dev"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "batch" {
+		batch(os.Args[2:])
+		return
+	}
 	flag.Parse()
 
 	if *printVersion {
@@ -80,49 +91,176 @@ func readConfig(filename string) *config.Config {
 }
 
 func overrideArgs(cfg *config.Config) {
+	// An input given on the command line replaces those of the configuration
 	if *pcapFile != "" {
-		cfg.Parser.Input.PcapFile = *pcapFile
+		cfg.Parser.Input.PcapFile, cfg.Parser.Input.PcapFiles = *pcapFile, nil
+		cfg.Parser.Input.Interface, cfg.Parser.Input.Interfaces = "", nil
 	}
 	if *iface != "" {
-		cfg.Parser.Input.Interface = *iface
+		cfg.Parser.Input.Interface, cfg.Parser.Input.Interfaces = *iface, nil
+		cfg.Parser.Input.PcapFile, cfg.Parser.Input.PcapFiles = "", nil
 	}
 	if *bpfFilter != "" {
 		cfg.Parser.Filter.BPF = *bpfFilter
 	}
+	if *replay != 0 {
+		cfg.Parser.Input.Replay = *replay
+	}
 }
 
 func run(cfg *config.Config) {
 
-	// Set up stream writer
-	streamWriterFunc := func([]detector.Detector, collector.Collector) {}
+	// Configure debug logging
+	if !cfg.Logger.Debug {
+		logger.Debug.SetOutput(ioutil.Discard)
+	}
+
+	a, err := newAnalysis(cfg, logger.StreamWriter)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Set up metrics
+	server := serveMetrics(cfg)
+
+	// Print metrics upon receiving a SIGUSR1
+	infoChan := make(chan os.Signal, 1)
+	signal.Notify(infoChan, syscall.SIGUSR1)
+	go func() {
+		for {
+			<-infoChan
+			metrics.Print(a.labels)
+		}
+	}()
+
+	// Run parser and clean up and exit upon receiving a SIGINT/SIGTERM
+	quitChan := make(chan os.Signal, 1)
+	signal.Notify(quitChan, syscall.SIGINT, syscall.SIGTERM)
+	if err = a.run(quitChan); err != nil {
+		log.Fatal(err)
+	}
+
+	// Print metrics
+	metrics.Print(a.labels)
+
+	// Clean up
+	logger.Info.Printf("Stopping metrics server")
+	err = server.Close()
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// analysis is the pipeline analyzing the packets of one input, from the parser
+// to the records written for its streams
+type analysis struct {
+	cfg    *config.Config
+	w      io.Writer
+	parser interface{ Run(chan os.Signal) error }
+	smp    *sampler.Sampler
+	da     *discovery.Aggregator
+	labels []string // labels of the detectors
+
+	streamWriterFunc tcpstream.StreamWriter
+}
+
+// newAnalysis sets up the pipeline analyzing the input of the configuration,
+// writing records to w
+func newAnalysis(cfg *config.Config, w io.Writer) (*analysis, error) {
+	a := &analysis{cfg: cfg, w: w}
+
+	// Under flow sampling, records carry the number of flows each stands for
+	var sampleRate int
+	if rate := cfg.Parser.TCP.Sampling.Rate(); rate > 1 {
+		sampleRate = rate
+	}
+
+	// Set up stream writer. Streams are written concurrently by parser workers.
+	var writeMutex sync.Mutex
+	streamWriterFunc := func([]detector.Detector, collector.Collector, bool, detector.Outcome) {}
 	switch cfg.Logger.Outform {
 	case "json":
-		streamWriterFunc = func(d []detector.Detector, c collector.Collector) {
+		streamWriterFunc = func(d []detector.Detector, c collector.Collector, disrupted bool, outcome detector.Outcome) {
 			bytes, err := json.Marshal(struct {
-				Version   string              `json:"version"`
-				Detectors []detector.Detector `json:"detectors"`
-				Collector collector.Collector `json:"collector"`
+				Version    string              `json:"version"`
+				Disrupted  bool                `json:"disrupted"`
+				Outcome    detector.Outcome    `json:"outcome"`
+				SampleRate int                 `json:"sample_rate,omitempty"`
+				Detectors  []detector.Detector `json:"detectors"`
+				Collector  collector.Collector `json:"collector"`
 			}{
-				Version:   version,
-				Detectors: d,
-				Collector: c,
+				Version:    version,
+				Disrupted:  disrupted,
+				Outcome:    outcome,
+				SampleRate: sampleRate,
+				Detectors:  d,
+				Collector:  c,
 			})
 			err = errors.Wrapf(err, "Unable to marshal JSON")
 			if err != nil {
 				log.Fatal(err)
 			} else {
-				fmt.Fprintln(logger.StreamWriter, string(bytes))
+				writeMutex.Lock()
+				fmt.Fprintln(w, string(bytes))
+				writeMutex.Unlock()
 			}
 		}
 	case "txt":
-		streamWriterFunc = func(d []detector.Detector, c collector.Collector) {
-			fmt.Fprintf(logger.StreamWriter, "Version: %s\nDetectors: %s\nCollectors:\n%s\n", version, d, c)
+		streamWriterFunc = func(d []detector.Detector, c collector.Collector, disrupted bool, outcome detector.Outcome) {
+			writeMutex.Lock()
+			defer writeMutex.Unlock()
+			fmt.Fprintf(w, "Version: %s\nDisrupted: %t\nOutcome: %s\n", version, disrupted, outcome)
+			if sampleRate > 0 {
+				fmt.Fprintf(w, "Sample rate: %d\n", sampleRate)
+			}
+			fmt.Fprintf(w, "Detectors: %s\nCollectors:\n%s\n", d, c)
 		}
 	}
+	a.streamWriterFunc = streamWriterFunc
 
-	// Configure debug logging
-	if !cfg.Logger.Debug {
-		logger.Debug.SetOutput(ioutil.Discard)
+	// Set up feature writer, exporting every stream instead of disrupted ones only
+	var featureWriterFunc tcpstream.FeatureWriter
+	if cfg.Logger.Outform == "features" {
+		type label struct {
+			Detector  string `json:"detector"`
+			Protocol  bool   `json:"protocol"`
+			Valid     bool   `json:"valid"` // whether or not the verdict holds given the stream outcome
+			Disrupted bool   `json:"disrupted"`
+		}
+		featureWriterFunc = func(d []detector.Detector, c collector.Collector, f *features.Features, outcome detector.Outcome) {
+			labels := make([]label, 0, len(d))
+			for _, det := range d {
+				labels = append(labels, label{
+					Detector:  det.Label(),
+					Protocol:  det.ProtocolDetected(),
+					Valid:     det.ValidOutcome(outcome),
+					Disrupted: det.ProtocolDetected() && det.SignatureDetected(),
+				})
+			}
+			bytes, err := json.Marshal(struct {
+				Version    string              `json:"version"`
+				Outcome    detector.Outcome    `json:"outcome"`
+				SampleRate int                 `json:"sample_rate,omitempty"`
+				Labels     []label             `json:"labels"`
+				Features   *features.Features  `json:"features"`
+				Collector  collector.Collector `json:"collector"`
+			}{
+				Version:    version,
+				Outcome:    outcome,
+				SampleRate: sampleRate,
+				Labels:     labels,
+				Features:   f,
+				Collector:  c,
+			})
+			err = errors.Wrapf(err, "Unable to marshal JSON")
+			if err != nil {
+				log.Fatal(err)
+			} else {
+				writeMutex.Lock()
+				fmt.Fprintln(w, string(bytes))
+				writeMutex.Unlock()
+			}
+		}
 	}
 
 	// Set up detector factories
@@ -130,29 +268,92 @@ func run(cfg *config.Config) {
 	for _, dc := range cfg.Detectors {
 		df, err := detector.NewDetectorFactory(dc)
 		if err != nil {
-			log.Fatal(err)
+			return nil, err
 		}
 		dfs = append(dfs, df)
+		a.labels = append(a.labels, df.Label())
 	}
 	logger.Info.Printf("Initialized detectors")
 
 	// Set up collector factory
 	cf, err := collector.NewCollectorFactory(cfg.Collector)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 	logger.Info.Printf("Initialized collectors")
 
-	// Set up stream factory
-	sf := tcpstream.NewTCPStreamFactory(cfg.Parser.TCP, cf, dfs, streamWriterFunc)
+	// Set up baseline sampling of non-disrupted streams
+	if a.smp, err = sampler.NewSampler(cfg.Detectors); err != nil {
+		return nil, err
+	}
+
+	// Set up teardown sequence discovery
+	if cfg.Discovery != nil {
+		if a.da, err = discovery.NewAggregator(*cfg.Discovery); err != nil {
+			return nil, err
+		}
+		logger.Info.Printf("Initialized discovery")
+	}
 
-	// Set up parser
-	p, err := parser.NewParser(cfg.Parser, sf)
+	// Set up parser, with a stream factory for each of its workers
+	tcpConfig := cfg.Parser.TCP
+	tcpConfig.Limits = tcpConfig.Limits.PerWorker(cfg.Parser.Workers)
+	p, err := parser.NewParser(cfg.Parser, func() parser.StreamFactory {
+		return tcpstream.NewTCPStreamFactory(tcpConfig, cf, dfs, streamWriterFunc, a.smp, a.da, featureWriterFunc)
+	})
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 
-	// Set up metrics
+	// Write baseline reservoirs and report teardown sequences periodically, as
+	// long-running captures would otherwise only write them at exit
+	if a.smp != nil || a.da != nil {
+		p.OnFlush(func(now time.Time) {
+			if a.smp != nil {
+				a.smp.Expire(now, func(d []detector.Detector, c collector.Collector, outcome detector.Outcome) {
+					streamWriterFunc(d, c, false, outcome)
+				})
+			}
+			if a.da != nil {
+				writeMutex.Lock()
+				defer writeMutex.Unlock()
+				if err := a.da.Report(now, w, cfg.Logger.Outform); err != nil {
+					logger.Info.Printf("Unable to report discovery patterns: %v", err)
+				}
+			}
+		})
+	}
+	a.parser = p
+	return a, nil
+}
+
+// run runs the parser until the end of its input or a signal, then writes the
+// records held until the end
+func (a *analysis) run(quitChan chan os.Signal) error {
+	logger.Info.Printf("Running parser")
+	if err := a.parser.Run(quitChan); err != nil {
+		return err
+	}
+
+	// Write baseline streams retained by sampling reservoirs
+	if a.smp != nil {
+		a.smp.Flush(func(d []detector.Detector, c collector.Collector, outcome detector.Outcome) {
+			a.streamWriterFunc(d, c, false, outcome)
+		})
+	}
+
+	// Report unusual teardown sequences
+	if a.da != nil {
+		if err := a.da.Write(a.w, a.cfg.Logger.Outform); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// serveMetrics starts the metrics server if configured, returning the server to
+// close once done
+func serveMetrics(cfg *config.Config) *http.Server {
 	server := &http.Server{}
 	if cfg.Metrics != nil {
 		netw, addr := cfg.Metrics.Network(), cfg.Metrics.String()
@@ -164,37 +365,5 @@ func run(cfg *config.Config) {
 		logger.Info.Printf("Starting metrics server")
 		go metrics.Start(server, metricsListener)
 	}
-	var labels []string
-	for _, df := range dfs {
-		labels = append(labels, df.Label())
-	}
-
-	// Print metrics upon receiving a SIGUSR1
-	infoChan := make(chan os.Signal, 1)
-	signal.Notify(infoChan, syscall.SIGUSR1)
-	go func() {
-		for {
-			<-infoChan
-			metrics.Print(labels)
-		}
-	}()
-
-	// Run parser and clean up and exit upon receiving a SIGINT/SIGTERM
-	logger.Info.Printf("Running parser")
-	quitChan := make(chan os.Signal, 1)
-	signal.Notify(quitChan, syscall.SIGINT, syscall.SIGTERM)
-	err = p.Run(quitChan)
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	// Print metrics
-	metrics.Print(labels)
-
-	// Clean up
-	logger.Info.Printf("Stopping metrics server")
-	err = server.Close()
-	if err != nil {
-		log.Fatal(err)
-	}
+	return server
 }
@@ -10,7 +10,11 @@ import (
 	"testing"
 	"tripwire/pkg/logger"
 	"tripwire/pkg/parser"
+	"tripwire/pkg/sampler"
 	"tripwire/pkg/tcpstream"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
 )
 
 var update = flag.Bool("update", false, "update expected output ('golden') files")
@@ -31,6 +35,8 @@ func TestIntegrationMain(t *testing.T) {
 		stderr string
 		stdout string
 		sort   bool
+
+		sampledOut float64 // packets skipped by flow sampling
 	}{
 		{name: "test1", config: "testdata/test1/config.yml", stderr: "testdata/test1/stderr.log", stdout: "testdata/test1/stdout.log", sort: false},
 		{name: "test2", config: "testdata/test2/config.yml", stderr: "testdata/test2/stderr.log", stdout: "testdata/test2/stdout.log", sort: false},
@@ -39,13 +45,29 @@ func TestIntegrationMain(t *testing.T) {
 		{name: "test5", config: "testdata/test5/config.yml", stderr: "testdata/test5/stderr.log", stdout: "testdata/test5/stdout.log", sort: true},
 		{name: "test6", config: "testdata/test6/config.yml", stderr: "testdata/test6/stderr.log", stdout: "testdata/test6/stdout.log", sort: true},
 		{name: "test7", config: "testdata/test7/config.yml", stderr: "testdata/test7/stderr.log", stdout: "testdata/test7/stdout.log", sort: true},
+		{name: "test8", config: "testdata/test8/config.yml", stderr: "testdata/test8/stderr.log", stdout: "testdata/test8/stdout.log", sort: true},
+		{name: "test9", config: "testdata/test9/config.yml", stderr: "testdata/test9/stderr.log", stdout: "testdata/test9/stdout.log", sort: true},
+		{name: "test10", config: "testdata/test10/config.yml", stderr: "testdata/test10/stderr.log", stdout: "testdata/test10/stdout.log", sort: true},
+		{name: "test11", config: "testdata/test11/config.yml", stderr: "testdata/test11/stderr.log", stdout: "testdata/test11/stdout.log", sort: true, sampledOut: 692},
+		{name: "test12", config: "testdata/test12/config.yml", stderr: "testdata/test12/stderr.log", stdout: "testdata/test12/stdout.log", sort: true},
+		{name: "test13", config: "testdata/test13/config.yml", stderr: "testdata/test13/stderr.log", stdout: "testdata/test13/stdout.log", sort: true},
+		{name: "test14", config: "testdata/test14/config.yml", stderr: "testdata/test14/stderr.log", stdout: "testdata/test14/stdout.log", sort: true},
+		{name: "test15", config: "testdata/test15/config.yml", stderr: "testdata/test15/stderr.log", stdout: "testdata/test15/stdout.log", sort: true},
+		{name: "test16", config: "testdata/test16/config.yml", stderr: "testdata/test16/stderr.log", stdout: "testdata/test16/stdout.log", sort: true},
+		{name: "test17", config: "testdata/test17/config.yml", stderr: "testdata/test17/stderr.log", stdout: "testdata/test17/stdout.log", sort: true},
+		{name: "test18", config: "testdata/test18/config.yml", stderr: "testdata/test18/stderr.log", stdout: "testdata/test18/stdout.log", sort: true},
+		{name: "test19", config: "testdata/test19/config.yml", stderr: "testdata/test19/stderr.log", stdout: "testdata/test19/stdout.log", sort: true},
+		{name: "test20", config: "testdata/test20/config.yml", stderr: "testdata/test20/stderr.log", stdout: "testdata/test20/stdout.log", sort: true},
+		{name: "test21", config: "testdata/test21/config.yml", stderr: "testdata/test21/stderr.log", stdout: "testdata/test21/stdout.log", sort: true},
+		{name: "test22", config: "testdata/test22/config.yml", stderr: "testdata/test22/stderr.log", stdout: "testdata/test22/stdout.log", sort: true},
+		{name: "test23", config: "testdata/test23/config.yml", stderr: "testdata/test23/stderr.log", stdout: "testdata/test23/stdout.log", sort: true},
+		{name: "test24", config: "testdata/test24/config.yml", stderr: "testdata/test24/stderr.log", stdout: "testdata/test24/stdout.log", sort: true},
 	}
 
 	for _, test := range tests {
 
 		// Reset metrics counters between tests
-		parser.PacketsCount.Reset()
-		tcpstream.StreamsCount.Reset()
+		resetMetrics()
 
 		// Read config
 		cfg := readConfig(test.config)
@@ -59,7 +81,9 @@ func TestIntegrationMain(t *testing.T) {
 		logger.StreamWriter = &stdoutBuffer
 
 		// Run Application
+		sampledOut := counterValue(t, parser.SampledOutPacketsCount)
 		run(cfg)
+		sampledOut = counterValue(t, parser.SampledOutPacketsCount) - sampledOut
 
 		actualStderr := stderrBuffer.Bytes()
 		actualStdout := stdoutBuffer.Bytes()
@@ -98,6 +122,9 @@ func TestIntegrationMain(t *testing.T) {
 		if !bytes.Equal(expectedStdout, actualStdout) {
 			t.Fatalf("stdout does not match for %v", test.name)
 		}
+		if sampledOut != test.sampledOut {
+			t.Fatalf("%v: Expected %v but got %v", test.name, test.sampledOut, sampledOut)
+		}
 	}
 
 	// Reset working directory
@@ -106,7 +133,49 @@ func TestIntegrationMain(t *testing.T) {
 	}
 }
 
+// counterValue returns the value of a counter. Counters outside of vectors
+// cannot be reset, so tests compare how much they grew instead.
+func counterValue(t *testing.T, counter prometheus.Counter) float64 {
+	var m dto.Metric
+	if err := counter.Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	return m.Counter.GetValue()
+}
+
+// resetMetrics clears the global metrics, so that the summary printed by each
+// test only counts its own packets and streams
+func resetMetrics() {
+	parser.PacketsCount.Reset()
+	parser.FragmentsCount.Reset()
+	parser.DefragDatagramsCount.Reset()
+	parser.WorkerPacketsCount.Reset()
+	parser.WorkerDroppedCount.Reset()
+	parser.WorkerQueueLength.Reset()
+	parser.WorkerPagesUsed.Reset()
+	parser.WorkerPagesAllocated.Reset()
+	parser.CapturePacketsCount.Reset()
+	parser.CaptureDroppedCount.Reset()
+	parser.CaptureIfDroppedCount.Reset()
+	parser.CaptureQueueFreezesCount.Reset()
+	tcpstream.StreamsCount.Reset()
+	tcpstream.StreamOutcomesCount.Reset()
+	tcpstream.StreamEvictionsCount.Reset()
+	tcpstream.StreamsActive.Set(0)
+	tcpstream.ReassemblyPacketsCount.Reset()
+	tcpstream.MissingBytesCount.Reset()
+	sampler.SampledStreamsCount.Reset()
+}
+
 func BenchmarkTripwire(b *testing.B) {
+	benchmarkTripwire(b, 1)
+}
+
+func BenchmarkTripwireWorkers(b *testing.B) {
+	benchmarkTripwire(b, 4)
+}
+
+func benchmarkTripwire(b *testing.B, workers int) {
 	// Change working directory
 	if err := os.Chdir("../../"); err != nil {
 		b.Fatal(err)
@@ -114,12 +183,17 @@ func BenchmarkTripwire(b *testing.B) {
 
 	// Read config
 	cfg := readConfig("testdata/bench1/config.yml")
+	cfg.Parser.Workers = workers
 
 	// Discard output
 	logger.Info.SetOutput(ioutil.Discard)
+	logger.StreamWriter = ioutil.Discard
+	b.ReportAllocs()
+	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
 		run(cfg)
 	}
+	b.StopTimer()
 
 	// Reset working directory
 	if err := os.Chdir("cmd/tripwire"); err != nil {
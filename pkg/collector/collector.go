@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"strings"
 	"tripwire/pkg/config"
+	"tripwire/pkg/decode"
 
 	"github.com/Kkevsterrr/gopacket"
 	"github.com/Kkevsterrr/gopacket/layers"
@@ -21,7 +22,7 @@ type Collector interface {
 	json.Marshaler
 
 	ProcessReassembled(sg reassembly.ScatterGather, ac reassembly.AssemblerContext, dir reassembly.TCPFlowDirection)
-	ProcessPacket(packet gopacket.Packet, tcp *layers.TCP, ci gopacket.CaptureInfo, dir reassembly.TCPFlowDirection)
+	ProcessPacket(packet *decode.Packet, tcp *layers.TCP, ci gopacket.CaptureInfo, dir reassembly.TCPFlowDirection)
 }
 
 type FieldType int
@@ -40,22 +41,48 @@ const (
 	FieldHost
 	FieldURI
 	FieldTLSExtensions
+	FieldSource
+	FieldTunnel
+	FieldFlowLabel
+	FieldInterface
+	FieldTCPOptions
+	FieldWindow
+	FieldLength
+	FieldTOS
+	FieldDF
+	FieldTiming
+	FieldClientHello
+	FieldECH
+	FieldRequest
 )
 
 var fieldMap = map[string]FieldType{
-	"ip":         FieldIP,
-	"ports":      FieldPorts,
-	"direction":  FieldDirection,
-	"timestamp":  FieldTimestamp,
-	"ipid":       FieldIPID,
-	"ttl":        FieldTTL,
-	"flags":      FieldFlags,
-	"payload":    FieldPayload,
-	"seqnum":     FieldSeqNum,
-	"sni":        FieldSNI,
-	"host":       FieldHost,
-	"uri":        FieldURI,
-	"extensions": FieldTLSExtensions,
+	"ip":          FieldIP,
+	"ports":       FieldPorts,
+	"direction":   FieldDirection,
+	"timestamp":   FieldTimestamp,
+	"ipid":        FieldIPID,
+	"ttl":         FieldTTL,
+	"flags":       FieldFlags,
+	"payload":     FieldPayload,
+	"seqnum":      FieldSeqNum,
+	"sni":         FieldSNI,
+	"host":        FieldHost,
+	"uri":         FieldURI,
+	"extensions":  FieldTLSExtensions,
+	"source":      FieldSource,
+	"tunnel":      FieldTunnel,
+	"flowlabel":   FieldFlowLabel,
+	"interface":   FieldInterface,
+	"tcpoptions":  FieldTCPOptions,
+	"window":      FieldWindow,
+	"length":      FieldLength,
+	"tos":         FieldTOS,
+	"df":          FieldDF,
+	"timing":      FieldTiming,
+	"clienthello": FieldClientHello,
+	"ech":         FieldECH,
+	"request":     FieldRequest,
 }
 
 type collectorFactory struct {
@@ -65,6 +92,9 @@ type collectorFactory struct {
 	relativeTimestamps     bool
 	maxClientPayloadLength int
 	maxServerPayloadLength int
+	echPublicNames         []string
+	httpHeaders            []string
+	httpRedactedHeaders    []string
 }
 
 type collector struct {
@@ -82,6 +112,19 @@ type collector struct {
 	host          *hostCollector
 	uri           *uriCollector
 	tlsExtensions *tlsExtensionsCollector
+	source        *sourceCollector
+	tunnel        *tunnelCollector
+	flowLabel     *flowLabelCollector
+	iface         *interfaceCollector
+	tcpOptions    *tcpOptionsCollector
+	window        *windowCollector
+	length        *lengthCollector
+	tos           *tosCollector
+	df            *dfCollector
+	timing        *timingCollector
+	clientHello   *clientHelloCollector
+	ech           *echCollector
+	request       *requestCollector
 }
 
 func NewCollectorFactory(cfg config.CollectorConfig) (CollectorFactory, error) {
@@ -97,6 +140,9 @@ func NewCollectorFactory(cfg config.CollectorConfig) (CollectorFactory, error) {
 	f.relativeTimestamps = cfg.RelativeTimestamps
 	f.maxClientPayloadLength = cfg.MaxClientPayloadLength
 	f.maxServerPayloadLength = cfg.MaxServerPayloadLength
+	f.echPublicNames = cfg.ECHPublicNames
+	f.httpHeaders = cfg.HTTPHeaders
+	f.httpRedactedHeaders = cfg.HTTPRedactedHeaders
 
 	return &f, nil
 }
@@ -122,7 +168,7 @@ func (f *collectorFactory) NewCollector(net, transport gopacket.Flow, tcp *layer
 		case FieldSeqNum:
 			c.seqnum = newSeqNumCollector()
 		case FieldPayload:
-			c.payload = newPayloadCollector(f.maxClientPayloadLength, f.maxServerPayloadLength)
+			c.payload = newPayloadCollector(f.maxClientPayloadLength, f.maxServerPayloadLength, f.httpRedactedHeaders)
 		case FieldSNI:
 			c.sni = newSNICollector()
 		case FieldHost:
@@ -131,12 +177,38 @@ func (f *collectorFactory) NewCollector(net, transport gopacket.Flow, tcp *layer
 			c.uri = newURICollector()
 		case FieldTLSExtensions:
 			c.tlsExtensions = newTLSExtensionsCollector()
+		case FieldSource:
+			c.source = newSourceCollector()
+		case FieldTunnel:
+			c.tunnel = newTunnelCollector()
+		case FieldFlowLabel:
+			c.flowLabel = newFlowLabelCollector()
+		case FieldInterface:
+			c.iface = newInterfaceCollector()
+		case FieldTCPOptions:
+			c.tcpOptions = newTCPOptionsCollector()
+		case FieldWindow:
+			c.window = newWindowCollector()
+		case FieldLength:
+			c.length = newLengthCollector()
+		case FieldTOS:
+			c.tos = newTOSCollector()
+		case FieldDF:
+			c.df = newDFCollector()
+		case FieldTiming:
+			c.timing = newTimingCollector()
+		case FieldClientHello:
+			c.clientHello = newClientHelloCollector()
+		case FieldECH:
+			c.ech = newECHCollector(f.echPublicNames)
+		case FieldRequest:
+			c.request = newRequestCollector(f.httpHeaders, f.httpRedactedHeaders)
 		}
 	}
 	return &c
 }
 
-func (c *collector) ProcessPacket(packet gopacket.Packet, tcp *layers.TCP,
+func (c *collector) ProcessPacket(packet *decode.Packet, tcp *layers.TCP,
 	ci gopacket.CaptureInfo, dir reassembly.TCPFlowDirection) {
 	if c.direction != nil {
 		c.direction.processPacket(dir)
@@ -144,6 +216,9 @@ func (c *collector) ProcessPacket(packet gopacket.Packet, tcp *layers.TCP,
 	if c.timestamp != nil {
 		c.timestamp.processPacket(ci)
 	}
+	if c.timing != nil {
+		c.timing.processPacket(tcp, ci, dir)
+	}
 	if c.ipid != nil {
 		c.ipid.processPacket(packet)
 	}
@@ -156,18 +231,48 @@ func (c *collector) ProcessPacket(packet gopacket.Packet, tcp *layers.TCP,
 	if c.seqnum != nil {
 		c.seqnum.processPacket(tcp)
 	}
+	if c.tcpOptions != nil {
+		c.tcpOptions.processPacket(packet)
+	}
+	if c.window != nil {
+		c.window.processPacket(packet, tcp, dir)
+	}
+	if c.length != nil {
+		c.length.processPacket(packet, tcp)
+	}
+	if c.tos != nil {
+		c.tos.processPacket(packet)
+	}
+	if c.df != nil {
+		c.df.processPacket(packet)
+	}
 	if c.host != nil {
 		c.host.processPacket(packet)
 	}
 	if c.uri != nil {
 		c.uri.processPacket(packet)
 	}
+	if c.request != nil {
+		c.request.processPacket(packet, tcp, dir)
+	}
 	if c.sni != nil {
 		c.sni.processPacket(packet)
 	}
 	if c.tlsExtensions != nil {
 		c.tlsExtensions.processPacket(packet)
 	}
+	if c.source != nil {
+		c.source.processPacket(packet)
+	}
+	if c.tunnel != nil {
+		c.tunnel.processPacket(packet)
+	}
+	if c.flowLabel != nil {
+		c.flowLabel.processPacket(packet)
+	}
+	if c.iface != nil {
+		c.iface.processPacket(packet)
+	}
 }
 
 func (c *collector) ProcessReassembled(sg reassembly.ScatterGather,
@@ -179,37 +284,70 @@ func (c *collector) ProcessReassembled(sg reassembly.ScatterGather,
 	if c.payload != nil {
 		c.payload.processReassembled(dir, length, payload)
 	}
+	_, _, _, skip := sg.Info()
+	if c.clientHello != nil {
+		c.clientHello.processReassembled(dir, skip, payload)
+	}
+	if c.ech != nil {
+		c.ech.processReassembled(dir, skip, payload)
+	}
 }
 
 func (c *collector) MarshalJSON() ([]byte, error) {
 	return json.Marshal(struct {
-		IP         *ipCollector            `json:"ip,omitempty"`
-		Ports      *portCollector          `json:"ports,omitempty"`
-		Direction  *directionCollector     `json:"direction,omitempty"`
-		Timestamp  *timestampCollector     `json:"timestamp,omitempty"`
-		IPID       *ipidCollector          `json:"ipid,omitempty"`
-		TTL        *ttlCollector           `json:"ttl,omitempty"`
-		Flags      *flagCollector          `json:"flags,omitempty"`
-		SeqNum     *seqnumCollector        `json:"seqnum,omitempty"`
-		Payload    *payloadCollector       `json:"payload,omitempty"`
-		SNI        *sniCollector           `json:"sni,omitempty"`
-		Host       *hostCollector          `json:"host,omitempty"`
-		URI        *uriCollector           `json:"uri,omitempty"`
-		Extensions *tlsExtensionsCollector `json:"extensions,omitempty"`
+		IP          *ipCollector            `json:"ip,omitempty"`
+		Ports       *portCollector          `json:"ports,omitempty"`
+		Direction   *directionCollector     `json:"direction,omitempty"`
+		Timestamp   *timestampCollector     `json:"timestamp,omitempty"`
+		Timing      *timingCollector        `json:"timing,omitempty"`
+		IPID        *ipidCollector          `json:"ipid,omitempty"`
+		TTL         *ttlCollector           `json:"ttl,omitempty"`
+		Flags       *flagCollector          `json:"flags,omitempty"`
+		SeqNum      *seqnumCollector        `json:"seqnum,omitempty"`
+		TCPOptions  *tcpOptionsCollector    `json:"tcpoptions,omitempty"`
+		Window      *windowCollector        `json:"window,omitempty"`
+		Length      *lengthCollector        `json:"length,omitempty"`
+		TOS         *tosCollector           `json:"tos,omitempty"`
+		DF          *dfCollector            `json:"df,omitempty"`
+		Payload     *payloadCollector       `json:"payload,omitempty"`
+		SNI         *sniCollector           `json:"sni,omitempty"`
+		Host        *hostCollector          `json:"host,omitempty"`
+		URI         *uriCollector           `json:"uri,omitempty"`
+		Request     *requestCollector       `json:"request,omitempty"`
+		Extensions  *tlsExtensionsCollector `json:"extensions,omitempty"`
+		ClientHello *clientHelloCollector   `json:"clienthello,omitempty"`
+		ECH         *echCollector           `json:"ech,omitempty"`
+		Source      *sourceCollector        `json:"source,omitempty"`
+		Tunnel      *tunnelCollector        `json:"tunnel,omitempty"`
+		FlowLabel   *flowLabelCollector     `json:"flowlabel,omitempty"`
+		Interface   *interfaceCollector     `json:"interface,omitempty"`
 	}{
-		IP:         c.ip,
-		Ports:      c.ports,
-		Direction:  c.direction,
-		Timestamp:  c.timestamp,
-		IPID:       c.ipid,
-		TTL:        c.ttl,
-		Flags:      c.flags,
-		SeqNum:     c.seqnum,
-		Payload:    c.payload,
-		SNI:        c.sni,
-		Host:       c.host,
-		URI:        c.uri,
-		Extensions: c.tlsExtensions,
+		IP:          c.ip,
+		Ports:       c.ports,
+		Direction:   c.direction,
+		Timestamp:   c.timestamp,
+		Timing:      c.timing,
+		IPID:        c.ipid,
+		TTL:         c.ttl,
+		Flags:       c.flags,
+		SeqNum:      c.seqnum,
+		TCPOptions:  c.tcpOptions,
+		Window:      c.window,
+		Length:      c.length,
+		TOS:         c.tos,
+		DF:          c.df,
+		Payload:     c.payload,
+		SNI:         c.sni,
+		Host:        c.host,
+		URI:         c.uri,
+		Request:     c.request,
+		Extensions:  c.tlsExtensions,
+		ClientHello: c.clientHello,
+		ECH:         c.ech,
+		Source:      c.source,
+		Tunnel:      c.tunnel,
+		FlowLabel:   c.flowLabel,
+		Interface:   c.iface,
 	})
 }
 
@@ -227,6 +365,9 @@ func (c *collector) String() string {
 	if c.timestamp != nil {
 		b.WriteString(fmt.Sprintf("  Timestamp: %s\n", c.timestamp))
 	}
+	if c.timing != nil {
+		b.WriteString(fmt.Sprintf("  Timing: %s\n", c.timing))
+	}
 	if c.ipid != nil {
 		b.WriteString(fmt.Sprintf("  IPID: %s\n", c.ipid))
 	}
@@ -239,6 +380,21 @@ func (c *collector) String() string {
 	if c.seqnum != nil {
 		b.WriteString(fmt.Sprintf("  SeqNum: %s\n", c.seqnum))
 	}
+	if c.tcpOptions != nil {
+		b.WriteString(fmt.Sprintf("  TCPOptions: %s\n", c.tcpOptions))
+	}
+	if c.window != nil {
+		b.WriteString(fmt.Sprintf("  Window: %s\n", c.window))
+	}
+	if c.length != nil {
+		b.WriteString(fmt.Sprintf("  Length: %s\n", c.length))
+	}
+	if c.tos != nil {
+		b.WriteString(fmt.Sprintf("  TOS: %s\n", c.tos))
+	}
+	if c.df != nil {
+		b.WriteString(fmt.Sprintf("  DF: %s\n", c.df))
+	}
 	if c.payload != nil {
 		b.WriteString(fmt.Sprintf("  Payload: %s\n", c.payload))
 	}
@@ -251,8 +407,29 @@ func (c *collector) String() string {
 	if c.uri != nil {
 		b.WriteString(fmt.Sprintf("  URI: %s\n", c.uri))
 	}
+	if c.request != nil {
+		b.WriteString(fmt.Sprintf("  Request: %s\n", c.request))
+	}
 	if c.tlsExtensions != nil {
 		b.WriteString(fmt.Sprintf("  Extensions: %s\n", c.tlsExtensions))
 	}
+	if c.clientHello != nil {
+		b.WriteString(fmt.Sprintf("  ClientHello: %s\n", c.clientHello))
+	}
+	if c.ech != nil {
+		b.WriteString(fmt.Sprintf("  ECH: %s\n", c.ech))
+	}
+	if c.source != nil {
+		b.WriteString(fmt.Sprintf("  Source: %s\n", c.source))
+	}
+	if c.tunnel != nil {
+		b.WriteString(fmt.Sprintf("  Tunnel: %s\n", c.tunnel))
+	}
+	if c.flowLabel != nil {
+		b.WriteString(fmt.Sprintf("  FlowLabel: %s\n", c.flowLabel))
+	}
+	if c.iface != nil {
+		b.WriteString(fmt.Sprintf("  Interface: %s\n", c.iface))
+	}
 	return b.String()
 }
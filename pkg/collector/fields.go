@@ -7,6 +7,8 @@ import (
 	"fmt"
 	"net/http"
 	"strings"
+	"time"
+	"tripwire/pkg/decode"
 	"tripwire/pkg/logger"
 
 	"github.com/Kkevsterrr/gopacket"
@@ -70,23 +72,18 @@ func newIPIDCollector() *ipidCollector {
 	return new(ipidCollector)
 }
 
-func (p *ipidCollector) processPacket(packet gopacket.Packet) {
+func (p *ipidCollector) processPacket(packet *decode.Packet) {
 	var ipid uint32
 
-	switch packet.NetworkLayer().LayerType() {
-	case layers.LayerTypeIPv4:
-		ipv4Layer := packet.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
-		ipid = uint32(ipv4Layer.Id)
-	case layers.LayerTypeIPv6:
+	switch {
+	case packet.IPv4 != nil:
+		ipid = uint32(packet.IPv4.Id)
+	case packet.IPv6 != nil && packet.Fragments > 0:
+		ipid = packet.FragmentID
+	case packet.IPv6 != nil:
 		ipid = 1001 // Default value
-		for _, layer := range packet.Layers() {
-			if layer.LayerType() == layers.LayerTypeIPv6Fragment {
-				ipv6FragmentLayer := packet.Layer(layers.LayerTypeIPv6).(*layers.IPv6Fragment)
-				ipid = ipv6FragmentLayer.Identification
-			}
-		}
 	default:
-		logger.Debug.Printf("Unknown Network Layer: %s", packet.NetworkLayer().LayerType().String())
+		logger.Debug.Printf("Unknown Network Layer")
 	}
 
 	*p = append(*p, ipid)
@@ -153,6 +150,104 @@ func (p *timestampCollector) String() string {
 	return strings.Join(strings.Fields(fmt.Sprintf("%d", p.timestampUs)), ",")
 }
 
+// timingCollector collects timings derived from packet timestamps, in
+// microseconds: the handshake RTT from the SYN-ACK to the client's ACK, the
+// time from the client's first PSH to the first RST after it, and the gaps
+// between consecutive packets of each direction
+type timingCollector struct {
+	handshake decode.HandshakeRTT
+	psh       time.Time
+	pshToRST  *int64
+	last      [2]time.Time // last packet of the client and of the server
+	gaps      [2][]int64
+}
+
+func newTimingCollector() *timingCollector {
+	return &timingCollector{}
+}
+
+func (p *timingCollector) processPacket(tcp *layers.TCP, ci gopacket.CaptureInfo, dir reassembly.TCPFlowDirection) {
+	side := 1
+	if dir == reassembly.TCPDirClientToServer {
+		side = 0
+	}
+	if !p.last[side].IsZero() {
+		p.gaps[side] = append(p.gaps[side], ci.Timestamp.Sub(p.last[side]).Microseconds())
+	}
+	p.last[side] = ci.Timestamp
+	p.handshake.ProcessPacket(tcp, ci, side == 0)
+
+	switch {
+	case tcp.RST:
+		if !p.psh.IsZero() && p.pshToRST == nil {
+			us := ci.Timestamp.Sub(p.psh).Microseconds()
+			p.pshToRST = &us
+		}
+	case side == 0 && tcp.PSH && p.psh.IsZero():
+		p.psh = ci.Timestamp
+	}
+}
+
+// rtt returns the handshake RTT in microseconds, nil if it was not measured
+func (p *timingCollector) rtt() *int64 {
+	rtt, ok := p.handshake.RTT()
+	if !ok {
+		return nil
+	}
+	us := rtt.Microseconds()
+	return &us
+}
+
+func (p *timingCollector) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		RTT        *int64  `json:"rtt,omitempty"`
+		PSHToRST   *int64  `json:"psh_to_rst,omitempty"`
+		ClientGaps []int64 `json:"client_gaps"`
+		ServerGaps []int64 `json:"server_gaps"`
+	}{
+		RTT:        p.rtt(),
+		PSHToRST:   p.pshToRST,
+		ClientGaps: p.gaps[0],
+		ServerGaps: p.gaps[1],
+	})
+}
+
+func (p *timingCollector) String() string {
+	duration := func(us *int64) string {
+		if us == nil {
+			return "-"
+		}
+		return fmt.Sprintf("%d", *us)
+	}
+	clientStr := strings.Join(strings.Fields(fmt.Sprintf("%d", p.gaps[0])), ",")
+	serverStr := strings.Join(strings.Fields(fmt.Sprintf("%d", p.gaps[1])), ",")
+	return fmt.Sprintf("rtt: %s; psh_to_rst: %s; client: %s; server: %s",
+		duration(p.rtt()), duration(p.pshToRST), clientStr, serverStr)
+}
+
+// flowLabelCollector collects packet IPv6 flow labels, 0 for IPv4
+type flowLabelCollector []uint32
+
+func newFlowLabelCollector() *flowLabelCollector {
+	return new(flowLabelCollector)
+}
+
+func (p *flowLabelCollector) processPacket(packet *decode.Packet) {
+	var label uint32
+	if packet.IPv6 != nil {
+		label = packet.IPv6.FlowLabel
+	}
+	*p = append(*p, label)
+}
+
+func (p *flowLabelCollector) MarshalJSON() ([]byte, error) {
+	return json.Marshal(*p)
+}
+
+func (p *flowLabelCollector) String() string {
+	return strings.Join(strings.Fields(fmt.Sprintf("%d", *p)), ",")
+}
+
 // ttlCollector collects packet IP TTLs
 type ttlCollector []uint8
 
@@ -160,18 +255,16 @@ func newTTLCollector() *ttlCollector {
 	return new(ttlCollector)
 }
 
-func (p *ttlCollector) processPacket(packet gopacket.Packet) {
+func (p *ttlCollector) processPacket(packet *decode.Packet) {
 	var ttl uint8
 
-	switch packet.NetworkLayer().LayerType() {
-	case layers.LayerTypeIPv4:
-		ipv4Layer := packet.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
-		ttl = ipv4Layer.TTL
-	case layers.LayerTypeIPv6:
-		ipv6Layer := packet.Layer(layers.LayerTypeIPv6).(*layers.IPv6)
-		ttl = ipv6Layer.HopLimit
+	switch {
+	case packet.IPv4 != nil:
+		ttl = packet.IPv4.TTL
+	case packet.IPv6 != nil:
+		ttl = packet.IPv6.HopLimit
 	default:
-		logger.Debug.Printf("Unknown Network Layer: %s", packet.NetworkLayer().LayerType().String())
+		logger.Debug.Printf("Unknown Network Layer")
 	}
 
 	*p = append(*p, ttl)
@@ -194,6 +287,11 @@ func newFlagCollector() *flagCollector {
 }
 
 func (p *flagCollector) processPacket(tcp *layers.TCP) {
+	*p = append(*p, FlagString(tcp))
+}
+
+// FlagString encodes the TCP flags set on a packet, e.g. "RA" for RST+ACK
+func FlagString(tcp *layers.TCP) string {
 	var flags string
 
 	if tcp.FIN {
@@ -223,8 +321,7 @@ func (p *flagCollector) processPacket(tcp *layers.TCP) {
 	if tcp.NS {
 		flags += "N"
 	}
-
-	*p = append(*p, flags)
+	return flags
 }
 
 func (p *flagCollector) MarshalJSON() ([]byte, error) {
@@ -235,6 +332,53 @@ func (p *flagCollector) String() string {
 	return strings.Join(strings.Fields(fmt.Sprintf("%q", *p)), ",")
 }
 
+// tcpOptionsCollector collects packet TCP options
+type tcpOptionsCollector []decode.TCPOptions
+
+// tcpOptionsJSON is the JSON encoding of the TCP options of a packet
+type tcpOptionsJSON struct {
+	MSS           uint16      `json:"mss,omitempty"`
+	WindowScale   *int        `json:"wscale,omitempty"`
+	SACKPermitted bool        `json:"sack_permitted,omitempty"`
+	SACK          [][2]uint32 `json:"sack,omitempty"`
+	Timestamps    *[2]uint32  `json:"ts,omitempty"`    // TSval and TSecr
+	Other         []int       `json:"other,omitempty"` // kinds, as []uint8 would be encoded as base64
+}
+
+func newTCPOptionsCollector() *tcpOptionsCollector {
+	return new(tcpOptionsCollector)
+}
+
+func (p *tcpOptionsCollector) processPacket(packet *decode.Packet) {
+	*p = append(*p, packet.TCPOptions().Clone())
+}
+
+func (p *tcpOptionsCollector) MarshalJSON() ([]byte, error) {
+	options := make([]tcpOptionsJSON, len(*p))
+	for i := range *p {
+		o := &(*p)[i]
+		options[i] = tcpOptionsJSON{MSS: o.MSS, SACKPermitted: o.SACKPermitted, SACK: o.SACK}
+		if o.WindowScale >= 0 {
+			options[i].WindowScale = &o.WindowScale
+		}
+		if o.Timestamps {
+			options[i].Timestamps = &[2]uint32{o.TSval, o.TSecr}
+		}
+		for _, kind := range o.Other {
+			options[i].Other = append(options[i].Other, int(kind))
+		}
+	}
+	return json.Marshal(options)
+}
+
+func (p *tcpOptionsCollector) String() string {
+	options := make([]string, len(*p))
+	for i := range *p {
+		options[i] = fmt.Sprintf("%q", (*p)[i].String())
+	}
+	return "[" + strings.Join(options, ",") + "]"
+}
+
 // portCollector collects packet src and dst TCP ports
 type portCollector gopacket.Flow
 
@@ -291,16 +435,179 @@ func (p *seqnumCollector) String() string {
 	return fmt.Sprintf("seq: %s; ack: %s", seqStr, ackStr)
 }
 
-// payloadCollector collects reassembled application-layer payloads
+// Largest window scale shift (RFC 7323, section 2.3)
+const maxWindowScale = 14
+
+// windowCollector collects packet TCP windows, as sent and scaled by the shift
+// counts of the SYNs. Windows are only scaled once both SYNs were seen, with
+// the window scale option.
+type windowCollector struct {
+	raw    []uint16
+	scaled []uint32
+	shift  [2]int // shift count of the client and of the server, -1 if unknown
+}
+
+func newWindowCollector() *windowCollector {
+	return &windowCollector{shift: [2]int{-1, -1}}
+}
+
+func (p *windowCollector) processPacket(packet *decode.Packet, tcp *layers.TCP, dir reassembly.TCPFlowDirection) {
+	side := 1
+	if dir == reassembly.TCPDirClientToServer {
+		side = 0
+	}
+	scaled := uint32(tcp.Window)
+	if tcp.SYN {
+		// Windows of SYNs are never scaled
+		p.shift[side] = packet.TCPOptions().WindowScale
+		if p.shift[side] > maxWindowScale {
+			p.shift[side] = maxWindowScale
+		}
+	} else if p.shift[0] >= 0 && p.shift[1] >= 0 {
+		scaled <<= uint(p.shift[side])
+	}
+	p.raw = append(p.raw, tcp.Window)
+	p.scaled = append(p.scaled, scaled)
+}
+
+func (p *windowCollector) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Raw    []uint16 `json:"raw"`
+		Scaled []uint32 `json:"scaled"`
+	}{
+		Raw:    p.raw,
+		Scaled: p.scaled,
+	})
+}
+
+func (p *windowCollector) String() string {
+	rawStr := strings.Join(strings.Fields(fmt.Sprintf("%d", p.raw)), ",")
+	scaledStr := strings.Join(strings.Fields(fmt.Sprintf("%d", p.scaled)), ",")
+	return fmt.Sprintf("raw: %s; scaled: %s", rawStr, scaledStr)
+}
+
+// lengthCollector collects packet IP total lengths and TCP payload lengths
+type lengthCollector struct {
+	ip      []int
+	payload []int
+}
+
+func newLengthCollector() *lengthCollector {
+	return &lengthCollector{}
+}
+
+func (p *lengthCollector) processPacket(packet *decode.Packet, tcp *layers.TCP) {
+	var length int
+
+	switch {
+	case packet.IPv4 != nil:
+		length = int(packet.IPv4.Length)
+	case packet.IPv6 != nil:
+		length = 40 + int(packet.IPv6.Length)
+	default:
+		logger.Debug.Printf("Unknown Network Layer")
+	}
+
+	p.ip = append(p.ip, length)
+	p.payload = append(p.payload, len(tcp.Payload))
+}
+
+func (p *lengthCollector) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		IP      []int `json:"ip"`
+		Payload []int `json:"payload"`
+	}{
+		IP:      p.ip,
+		Payload: p.payload,
+	})
+}
+
+func (p *lengthCollector) String() string {
+	ipStr := strings.Join(strings.Fields(fmt.Sprintf("%d", p.ip)), ",")
+	payloadStr := strings.Join(strings.Fields(fmt.Sprintf("%d", p.payload)), ",")
+	return fmt.Sprintf("ip: %s; payload: %s", ipStr, payloadStr)
+}
+
+// tosCollector collects packet DSCP and ECN codepoints, of the IPv4 type of
+// service or the IPv6 traffic class
+type tosCollector struct {
+	dscp []int
+	ecn  []int
+}
+
+func newTOSCollector() *tosCollector {
+	return &tosCollector{}
+}
+
+func (p *tosCollector) processPacket(packet *decode.Packet) {
+	var tos uint8
+
+	switch {
+	case packet.IPv4 != nil:
+		tos = packet.IPv4.TOS
+	case packet.IPv6 != nil:
+		tos = packet.IPv6.TrafficClass
+	default:
+		logger.Debug.Printf("Unknown Network Layer")
+	}
+
+	p.dscp = append(p.dscp, int(tos>>2))
+	p.ecn = append(p.ecn, int(tos&0x03))
+}
+
+func (p *tosCollector) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		DSCP []int `json:"dscp"`
+		ECN  []int `json:"ecn"`
+	}{
+		DSCP: p.dscp,
+		ECN:  p.ecn,
+	})
+}
+
+func (p *tosCollector) String() string {
+	dscpStr := strings.Join(strings.Fields(fmt.Sprintf("%d", p.dscp)), ",")
+	ecnStr := strings.Join(strings.Fields(fmt.Sprintf("%d", p.ecn)), ",")
+	return fmt.Sprintf("dscp: %s; ecn: %s", dscpStr, ecnStr)
+}
+
+// dfCollector collects whether packets have the IPv4 Don't Fragment bit set,
+// false for IPv6
+type dfCollector []bool
+
+func newDFCollector() *dfCollector {
+	return new(dfCollector)
+}
+
+func (p *dfCollector) processPacket(packet *decode.Packet) {
+	*p = append(*p, packet.IPv4 != nil && packet.IPv4.Flags&layers.IPv4DontFragment != 0)
+}
+
+func (p *dfCollector) MarshalJSON() ([]byte, error) {
+	return json.Marshal(*p)
+}
+
+func (p *dfCollector) String() string {
+	return strings.Join(strings.Fields(fmt.Sprintf("%t", *p)), ",")
+}
+
+// payloadCollector collects reassembled application-layer payloads. Values of
+// redacted HTTP headers are replaced on output, so that headers split across
+// segments are redacted as well.
 type payloadCollector struct {
 	clientMaxLength int
 	serverMaxLength int
+	redacted        map[string]bool // canonical header names
 	client          bytes.Buffer
 	server          bytes.Buffer
 }
 
-func newPayloadCollector(cliLen, srvLen int) *payloadCollector {
-	return &payloadCollector{clientMaxLength: cliLen, serverMaxLength: srvLen}
+func newPayloadCollector(cliLen, srvLen int, redactedHeaders []string) *payloadCollector {
+	p := &payloadCollector{clientMaxLength: cliLen, serverMaxLength: srvLen, redacted: make(map[string]bool)}
+	for _, name := range redactedHeaders {
+		p.redacted[http.CanonicalHeaderKey(name)] = true
+	}
+	return p
 }
 
 func (p *payloadCollector) processReassembled(dir reassembly.TCPFlowDirection, length int, payload []byte) {
@@ -324,13 +631,51 @@ func (p *payloadCollector) MarshalJSON() ([]byte, error) {
 		Client []byte `json:"cli"`
 		Server []byte `json:"srv"`
 	}{
-		Client: p.client.Bytes(),
-		Server: p.server.Bytes(),
+		Client: p.redact(p.client.Bytes()),
+		Server: p.redact(p.server.Bytes()),
 	})
 }
 
 func (p *payloadCollector) String() string {
-	return fmt.Sprintf("client: %x; server: %x", p.client.Bytes(), p.server.Bytes())
+	return fmt.Sprintf("client: %x; server: %x", p.redact(p.client.Bytes()), p.redact(p.server.Bytes()))
+}
+
+// redact returns the payload with the values of the redacted HTTP headers
+// replaced, on any line of it holding one along with their continuation lines
+func (p *payloadCollector) redact(payload []byte) []byte {
+	if len(p.redacted) == 0 {
+		return payload
+	}
+	var b bytes.Buffer
+	continued := false // whether the previous line was a redacted header
+	for len(payload) > 0 {
+		end := bytes.IndexByte(payload, '\n') + 1
+		if end == 0 {
+			end = len(payload)
+		}
+		line := payload[:end]
+		payload = payload[end:]
+
+		if continued && (line[0] == ' ' || line[0] == '\t') {
+			continue
+		}
+		continued = false
+		colon := bytes.IndexByte(line, ':')
+		if colon <= 0 || !p.redacted[http.CanonicalHeaderKey(string(line[:colon]))] {
+			b.Write(line)
+			continue
+		}
+		continued = true
+		b.Write(line[:colon+1])
+		b.WriteString(" " + redacted)
+		switch {
+		case bytes.HasSuffix(line, []byte("\r\n")):
+			b.WriteString("\r\n")
+		case bytes.HasSuffix(line, []byte("\n")):
+			b.WriteString("\n")
+		}
+	}
+	return b.Bytes()
 }
 
 // hostCollector collects HTTP Host headers
@@ -348,14 +693,9 @@ func (p *hostCollector) MarshalJSON() ([]byte, error) {
 	return json.Marshal(*p)
 }
 
-func (p *hostCollector) processPacket(packet gopacket.Packet) {
-	app := packet.ApplicationLayer()
-	if app == nil {
-		return
-	}
-	buf := bufio.NewReader(bytes.NewReader(app.Payload()))
-	req, err := http.ReadRequest(buf)
-	if err != nil {
+func (p *hostCollector) processPacket(packet *decode.Packet) {
+	req := packet.HTTPRequest()
+	if req == nil {
 		return
 	}
 
@@ -376,18 +716,190 @@ func (p *uriCollector) MarshalJSON() ([]byte, error) {
 	return json.Marshal(*p)
 }
 
-func (p *uriCollector) processPacket(packet gopacket.Packet) {
-	app := packet.ApplicationLayer()
-	if app == nil {
+func (p *uriCollector) processPacket(packet *decode.Packet) {
+	req := packet.HTTPRequest()
+	if req == nil {
 		return
 	}
-	buf := bufio.NewReader(bytes.NewReader(app.Payload()))
-	req, err := http.ReadRequest(buf)
-	if err != nil {
+
+	*p = uriCollector(req.RequestURI)
+}
+
+// Value recorded in place of those of redacted headers
+const redacted = "[redacted]"
+
+// requestCollector collects details of the first HTTP request of the client:
+// its method and version, the names of its headers in the order and case they
+// were sent, the values of the selected headers and the size of the request,
+// that is of its header and of the body it declares. Values of redacted headers
+// are never recorded. Requests spanning several segments are gathered from the
+// client's segments, in sequence.
+type requestCollector struct {
+	selected map[string]bool // canonical header names
+	redacted map[string]bool
+
+	done    bool   // whether or not the request was recorded or given up on
+	data    []byte // start of a request whose header did not fit in a segment
+	nextSeq uint32 // sequence number of the segment continuing data
+
+	method  string
+	version string
+	order   []string
+	headers map[string]string
+	size    int64
+}
+
+// Longest request header gathered from several segments
+const maxRequestLength = 1 << 16
+
+func newRequestCollector(selected, redactedHeaders []string) *requestCollector {
+	p := &requestCollector{selected: make(map[string]bool), redacted: make(map[string]bool)}
+	for _, name := range selected {
+		p.selected[http.CanonicalHeaderKey(name)] = true
+	}
+	for _, name := range redactedHeaders {
+		p.redacted[http.CanonicalHeaderKey(name)] = true
+	}
+	return p
+}
+
+func (p *requestCollector) String() string {
+	if p.headers == nil {
+		return ""
+	}
+	var headers []string
+	seen := make(map[string]bool)
+	for _, name := range p.order {
+		key := http.CanonicalHeaderKey(name)
+		if value, ok := p.headers[key]; ok && !seen[key] {
+			seen[key] = true
+			headers = append(headers, fmt.Sprintf("%s=%s", key, value))
+		}
+	}
+	return fmt.Sprintf("method: %s; version: %s; size: %d; order: %s; headers: %s",
+		p.method, p.version, p.size, strings.Join(p.order, ","), strings.Join(headers, ","))
+}
+
+func (p *requestCollector) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Method  string            `json:"method"`
+		Version string            `json:"version"`
+		Order   []string          `json:"header_order"`
+		Headers map[string]string `json:"headers"`
+		Size    int64             `json:"size"`
+	}{
+		Method:  p.method,
+		Version: p.version,
+		Order:   p.order,
+		Headers: p.headers,
+		Size:    p.size,
+	})
+}
+
+func (p *requestCollector) processPacket(packet *decode.Packet, tcp *layers.TCP, dir reassembly.TCPFlowDirection) {
+	if p.done || dir != reassembly.TCPDirClientToServer || len(tcp.Payload) == 0 {
 		return
 	}
+	if p.data == nil {
+		// Most requests fit in their first segment, which is parsed once for
+		// all the fields
+		if req := packet.HTTPRequest(); req != nil {
+			p.done = true
+			p.record(req, packet.Payload())
+			return
+		}
+		if !requestStart(tcp.Payload) {
+			p.done = true
+			return
+		}
+	} else if seq := tcp.Seq; seq != p.nextSeq {
+		if int32(seq-p.nextSeq) > 0 {
+			// Segments are missing, so the request cannot be read
+			p.done, p.data = true, nil
+		}
+		return // retransmitted
+	}
 
-	*p = uriCollector(req.RequestURI)
+	payload := tcp.Payload
+	if len(p.data)+len(payload) > maxRequestLength {
+		payload = payload[:maxRequestLength-len(p.data)]
+	}
+	p.data = append(p.data, payload...)
+	p.nextSeq = tcp.Seq + uint32(len(tcp.Payload))
+	if !bytes.Contains(p.data, []byte("\n\r\n")) && !bytes.Contains(p.data, []byte("\n\n")) {
+		if len(p.data) >= maxRequestLength {
+			p.done, p.data = true, nil
+		}
+		return
+	}
+	p.done = true
+	if req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(p.data))); err == nil {
+		p.record(req, p.data)
+	}
+	p.data = nil
+}
+
+// requestStart returns whether the payload may start a request, with a method
+// token followed by a space
+func requestStart(payload []byte) bool {
+	for i, c := range payload {
+		switch {
+		case c == ' ':
+			return i > 0
+		case c < 'A' || c > 'Z':
+			return false
+		}
+	}
+	return false
+}
+
+// record records the request parsed from the data
+func (p *requestCollector) record(req *http.Request, data []byte) {
+	p.method, p.version = req.Method, req.Proto
+	p.headers = make(map[string]string)
+
+	// The parsed request loses the order and case of the headers, so they are
+	// read from the data, which the request was parsed from in full
+	var headerLength int
+	for line := 0; ; line++ {
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 {
+			break
+		}
+		header := bytes.TrimRight(data[:i], "\r")
+		data = data[i+1:]
+		headerLength += i + 1
+		if line == 0 {
+			continue // request line
+		}
+		if len(header) == 0 {
+			break
+		}
+		colon := bytes.IndexByte(header, ':')
+		if colon <= 0 {
+			continue
+		}
+		name := string(header[:colon])
+		p.order = append(p.order, name)
+
+		key := http.CanonicalHeaderKey(name)
+		if !p.selected[key] {
+			continue
+		}
+		value := string(bytes.TrimSpace(header[colon+1:]))
+		if p.redacted[key] {
+			value = redacted
+		}
+		if previous, ok := p.headers[key]; ok && !p.redacted[key] {
+			value = previous + ", " + value
+		}
+		p.headers[key] = value
+	}
+
+	p.size = int64(headerLength)
+	if req.ContentLength > 0 {
+		p.size += req.ContentLength
+	}
 }
 
 // sniCollector collects the TLS server name extension value
@@ -405,30 +917,8 @@ func (p *sniCollector) MarshalJSON() ([]byte, error) {
 	return json.Marshal(*p)
 }
 
-func (p *sniCollector) processPacket(packet gopacket.Packet) {
-	var clientHello *layers.TLSClientHello
-
-	if packet.ApplicationLayer() != nil {
-		var tls layers.TLS
-		var decoded []gopacket.LayerType
-		parser := gopacket.NewDecodingLayerParser(layers.LayerTypeTLS, &tls)
-		err := parser.DecodeLayers(packet.ApplicationLayer().LayerContents(), &decoded)
-		if err != nil {
-			return
-		}
-		for _, layerType := range decoded {
-			switch layerType {
-			case layers.LayerTypeTLS:
-				if len(tls.Handshake) > 0 {
-					hs := tls.Handshake[0]
-					if hs.HandshakeType == 1 {
-						clientHello = hs.ClientHello
-					}
-				}
-			}
-		}
-	}
-	if clientHello != nil {
+func (p *sniCollector) processPacket(packet *decode.Packet) {
+	if clientHello := packet.ClientHello(); clientHello != nil {
 		*p = sniCollector(clientHello.ServerName)
 	}
 }
@@ -448,31 +938,238 @@ func (p *tlsExtensionsCollector) MarshalJSON() ([]byte, error) {
 	return json.Marshal(*p)
 }
 
-func (p *tlsExtensionsCollector) processPacket(packet gopacket.Packet) {
-	var clientHello *layers.TLSClientHello
+func (p *tlsExtensionsCollector) processPacket(packet *decode.Packet) {
+	if clientHello := packet.ClientHello(); clientHello != nil {
+		*p = tlsExtensionsCollector(clientHello.Extensions)
+	}
+}
+
+// echCollector collects whether the TLS ClientHello offered Encrypted Client
+// Hello: "outer" when its server name is the public name of an ECH provider, as
+// real ECH hides the server name behind it, "grease" otherwise, as clients
+// without an ECH configuration send a GREASE extension that looks the same,
+// "esni" for the legacy Encrypted SNI, and "none" without either
+type echCollector struct {
+	publicNames map[string]bool
+	buffer      decode.ClientHelloBuffer
+	status      string
+}
+
+func newECHCollector(publicNames []string) *echCollector {
+	p := &echCollector{publicNames: make(map[string]bool)}
+	for _, name := range publicNames {
+		p.publicNames[strings.ToLower(name)] = true
+	}
+	return p
+}
+
+func (p *echCollector) String() string {
+	return p.status
+}
+
+func (p *echCollector) MarshalJSON() ([]byte, error) {
+	return json.Marshal(p.status)
+}
+
+func (p *echCollector) processReassembled(dir reassembly.TCPFlowDirection, skip int, payload []byte) {
+	if p.status != "" || dir != reassembly.TCPDirClientToServer {
+		return
+	}
+	p.buffer.ProcessReassembled(skip, payload)
+	clientHello, _ := p.buffer.ClientHello()
+	if clientHello == nil {
+		return
+	}
+	p.status = "none"
+	for _, extension := range clientHello.Extensions {
+		switch {
+		case extension == decode.ExtensionECH && p.publicNames[strings.ToLower(clientHello.ServerName)]:
+			p.status = "outer"
+		case extension == decode.ExtensionECH:
+			p.status = "grease"
+		case extension == decode.ExtensionESNI:
+			p.status = "esni"
+		}
+	}
+}
+
+// clientHelloCollector collects the fields and fingerprints of the TLS
+// ClientHello starting the stream. It is parsed from the reassembled payload
+// of the client, so ClientHellos spanning several segments are parsed as well.
+type clientHelloCollector struct {
+	buffer decode.ClientHelloBuffer
+	hello  *decode.ClientHello
+}
+
+type clientHelloJSON struct {
+	Version             uint16   `json:"version"`
+	SupportedVersions   []uint16 `json:"supported_versions"`
+	CipherSuites        []uint16 `json:"cipher_suites"`
+	SupportedGroups     []uint16 `json:"supported_groups"`
+	PointFormats        []int    `json:"point_formats"`
+	SignatureAlgorithms []uint16 `json:"signature_algorithms"`
+	ALPN                []string `json:"alpn"`
+	KeyShareGroups      []uint16 `json:"key_share_groups"`
+	JA3                 string   `json:"ja3"`
+	JA3Hash             string   `json:"ja3_hash"`
+	JA4                 string   `json:"ja4"`
+}
+
+func newClientHelloCollector() *clientHelloCollector {
+	return &clientHelloCollector{}
+}
+
+func (p *clientHelloCollector) processReassembled(dir reassembly.TCPFlowDirection, skip int, payload []byte) {
+	if dir != reassembly.TCPDirClientToServer {
+		return
+	}
+	p.buffer.ProcessReassembled(skip, payload)
+	p.hello, _ = p.buffer.ClientHello()
+}
+
+func (p *clientHelloCollector) MarshalJSON() ([]byte, error) {
+	if p.hello == nil {
+		return json.Marshal(nil)
+	}
+	h := p.hello
+	formats := make([]int, len(h.PointFormats))
+	for i, format := range h.PointFormats {
+		formats[i] = int(format)
+	}
+	ja3, ja3Hash := h.JA3()
+	return json.Marshal(clientHelloJSON{
+		Version:             h.Version,
+		SupportedVersions:   h.SupportedVersions,
+		CipherSuites:        h.CipherSuites,
+		SupportedGroups:     h.SupportedGroups,
+		PointFormats:        formats,
+		SignatureAlgorithms: h.SignatureAlgorithms,
+		ALPN:                h.ALPN,
+		KeyShareGroups:      h.KeyShareGroups,
+		JA3:                 ja3,
+		JA3Hash:             ja3Hash,
+		JA4:                 h.JA4(),
+	})
+}
+
+func (p *clientHelloCollector) String() string {
+	if p.hello == nil {
+		return ""
+	}
+	h := p.hello
+	_, ja3Hash := h.JA3()
+	list := func(values []uint16) string {
+		return strings.Join(strings.Fields(fmt.Sprintf("%d", values)), ",")
+	}
+	return fmt.Sprintf("ja3: %s; ja4: %s; version: %d; versions: %s; ciphers: %s; groups: %s; sigalgs: %s; alpn: %s; keyshares: %s",
+		ja3Hash, h.JA4(), h.Version, list(h.SupportedVersions), list(h.CipherSuites), list(h.SupportedGroups),
+		list(h.SignatureAlgorithms), strings.Join(h.ALPN, ","), list(h.KeyShareGroups))
+}
+
+// sourceCollector collects the names of the capture sources the packets of the
+// stream were read from, such as the mirror ports each seeing one direction
+type sourceCollector []string
+
+func newSourceCollector() *sourceCollector {
+	return new(sourceCollector)
+}
+
+func (p *sourceCollector) String() string {
+	return strings.Join(*p, ",")
+}
+
+func (p *sourceCollector) MarshalJSON() ([]byte, error) {
+	return json.Marshal(*p)
+}
+
+func (p *sourceCollector) processPacket(packet *decode.Packet) {
+	for _, source := range *p {
+		if source == packet.Source {
+			return
+		}
+	}
+	*p = append(*p, packet.Source)
+}
+
+// interfaceCollector collects the indexes of the interfaces the packets of the
+// stream were captured on, as told by Linux cooked v2 headers
+type interfaceCollector []uint32
 
-	if packet.ApplicationLayer() != nil {
-		var tls layers.TLS
-		var decoded []gopacket.LayerType
-		parser := gopacket.NewDecodingLayerParser(layers.LayerTypeTLS, &tls)
-		err := parser.DecodeLayers(packet.ApplicationLayer().LayerContents(), &decoded)
-		if err != nil {
+func newInterfaceCollector() *interfaceCollector {
+	return new(interfaceCollector)
+}
+
+func (p *interfaceCollector) String() string {
+	return strings.Join(strings.Fields(fmt.Sprintf("%d", *p)), ",")
+}
+
+func (p *interfaceCollector) MarshalJSON() ([]byte, error) {
+	return json.Marshal(*p)
+}
+
+func (p *interfaceCollector) processPacket(packet *decode.Packet) {
+	if packet.InterfaceIndex == 0 {
+		return
+	}
+	for _, index := range *p {
+		if index == packet.InterfaceIndex {
 			return
 		}
-		for _, layerType := range decoded {
-			switch layerType {
-			case layers.LayerTypeTLS:
-				if len(tls.Handshake) > 0 {
-					hs := tls.Handshake[0]
-					if hs.HandshakeType == 1 {
-						clientHello = hs.ClientHello
-						break
-					}
-				}
-			}
+	}
+	*p = append(*p, packet.InterfaceIndex)
+}
+
+// Encapsulations kept per stream, against streams hopping across many tunnels
+const maxTunnels = 4
+
+// tunnelCollector collects the outer headers removed from the packets of the
+// stream, such as the VLAN, VNI or ERSPAN session of the mirror they came from
+type tunnelCollector []decode.Encapsulation
+
+// tunnelJSON is the JSON encoding of an encapsulation
+type tunnelJSON struct {
+	VLANs     []uint16     `json:"vlans,omitempty"`
+	Labels    []uint32     `json:"mpls,omitempty"`
+	Tunnel    string       `json:"tunnel,omitempty"`
+	Outer     *ipCollector `json:"outer,omitempty"`
+	Key       uint32       `json:"key,omitempty"`
+	SessionID uint16       `json:"session_id,omitempty"`
+	VNI       uint32       `json:"vni,omitempty"`
+}
+
+func newTunnelCollector() *tunnelCollector {
+	return new(tunnelCollector)
+}
+
+func (p *tunnelCollector) String() string {
+	var tunnels []string
+	for i := range *p {
+		tunnels = append(tunnels, (*p)[i].String())
+	}
+	return strings.Join(tunnels, ",")
+}
+
+func (p *tunnelCollector) MarshalJSON() ([]byte, error) {
+	tunnels := make([]tunnelJSON, 0, len(*p))
+	for _, e := range *p {
+		t := tunnelJSON{VLANs: e.VLANs, Labels: e.Labels, Tunnel: e.Tunnel, Key: e.Key, SessionID: e.SessionID, VNI: e.VNI}
+		if e.Tunnel != "" {
+			outer := e.Outer
+			t.Outer = (*ipCollector)(&outer)
 		}
+		tunnels = append(tunnels, t)
 	}
-	if clientHello != nil {
-		*p = tlsExtensionsCollector(clientHello.Extensions)
+	return json.Marshal(tunnels)
+}
+
+func (p *tunnelCollector) processPacket(packet *decode.Packet) {
+	if packet.Encapsulation.Empty() || len(*p) >= maxTunnels {
+		return
+	}
+	for i := range *p {
+		if (*p)[i].Equal(&packet.Encapsulation) {
+			return
+		}
 	}
+	*p = append(*p, packet.Encapsulation.Clone())
 }
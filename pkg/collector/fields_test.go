@@ -0,0 +1,319 @@
+package collector
+
+import (
+	"encoding/json"
+	"net"
+	"reflect"
+	"testing"
+
+	"tripwire/pkg/decode"
+
+	"github.com/Kkevsterrr/gopacket"
+	"github.com/Kkevsterrr/gopacket/layers"
+	"github.com/Kkevsterrr/gopacket/reassembly"
+)
+
+// frame returns the decoded packet of the network layer, the TCP layer and
+// the payload
+func frame(t *testing.T, network gopacket.NetworkLayer, tcp *layers.TCP, payload []byte) *decode.Packet {
+	_ = tcp.SetNetworkLayerForChecksum(network)
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, network.(gopacket.SerializableLayer), tcp, gopacket.Payload(payload)); err != nil {
+		t.Fatal(err)
+	}
+	packet := decode.NewPacket(layers.LinkTypeRaw)
+	if err := packet.DecodeCopy(buf.Bytes(), gopacket.CaptureInfo{}); err != nil {
+		t.Fatal(err)
+	}
+	return packet
+}
+
+func ipv4(tos uint8, flags layers.IPv4Flag) *layers.IPv4 {
+	return &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolTCP, TOS: tos, Flags: flags,
+		SrcIP: net.IP{10, 0, 0, 1}, DstIP: net.IP{192, 0, 2, 1}}
+}
+
+func ipv6(trafficClass uint8) *layers.IPv6 {
+	return &layers.IPv6{Version: 6, HopLimit: 64, NextHeader: layers.IPProtocolTCP, TrafficClass: trafficClass,
+		SrcIP: net.ParseIP("2001:db8::1"), DstIP: net.ParseIP("2001:db8::2")}
+}
+
+func TestUnitWindowCollector(t *testing.T) {
+	// windowScale returns the window scale option with the shift count
+	windowScale := func(shift byte) []layers.TCPOption {
+		return []layers.TCPOption{{OptionType: layers.TCPOptionKindWindowScale, OptionLength: 3, OptionData: []byte{shift}}}
+	}
+	type packet struct {
+		dir reassembly.TCPFlowDirection
+		tcp layers.TCP
+	}
+	var tests = []struct {
+		packets []packet
+		raw     []uint16
+		scaled  []uint32
+	}{
+		{ // Windows scaled once both SYNs were seen
+			packets: []packet{
+				{dir: reassembly.TCPDirClientToServer, tcp: layers.TCP{SYN: true, Window: 64240, Options: windowScale(7)}},
+				{dir: reassembly.TCPDirClientToServer, tcp: layers.TCP{ACK: true, Window: 502}},
+				{dir: reassembly.TCPDirServerToClient, tcp: layers.TCP{SYN: true, ACK: true, Window: 65160, Options: windowScale(8)}},
+				{dir: reassembly.TCPDirClientToServer, tcp: layers.TCP{ACK: true, Window: 502}},
+				{dir: reassembly.TCPDirServerToClient, tcp: layers.TCP{ACK: true, Window: 509}},
+			},
+			raw:    []uint16{64240, 502, 65160, 502, 509},
+			scaled: []uint32{64240, 502, 65160, 502 << 7, 509 << 8},
+		},
+		{ // Windows not scaled without the option on both SYNs
+			packets: []packet{
+				{dir: reassembly.TCPDirClientToServer, tcp: layers.TCP{SYN: true, Window: 64240, Options: windowScale(7)}},
+				{dir: reassembly.TCPDirServerToClient, tcp: layers.TCP{SYN: true, ACK: true, Window: 65160}},
+				{dir: reassembly.TCPDirClientToServer, tcp: layers.TCP{ACK: true, Window: 502}},
+			},
+			raw:    []uint16{64240, 65160, 502},
+			scaled: []uint32{64240, 65160, 502},
+		},
+		{ // Shift counts past 14 are taken as 14
+			packets: []packet{
+				{dir: reassembly.TCPDirClientToServer, tcp: layers.TCP{SYN: true, Window: 1024, Options: windowScale(15)}},
+				{dir: reassembly.TCPDirServerToClient, tcp: layers.TCP{SYN: true, ACK: true, Window: 1024, Options: windowScale(0)}},
+				{dir: reassembly.TCPDirClientToServer, tcp: layers.TCP{ACK: true, Window: 2}},
+				{dir: reassembly.TCPDirServerToClient, tcp: layers.TCP{ACK: true, Window: 2}},
+			},
+			raw:    []uint16{1024, 1024, 2, 2},
+			scaled: []uint32{1024, 1024, 2 << 14, 2},
+		},
+	}
+
+	for i, test := range tests {
+		collector := newWindowCollector()
+		for _, p := range test.packets {
+			tcp := p.tcp
+			tcp.SrcPort, tcp.DstPort = 40000, 80
+			packet := frame(t, ipv4(0, 0), &tcp, nil)
+			collector.processPacket(packet, packet.TCP, p.dir)
+		}
+		if !reflect.DeepEqual(collector.raw, test.raw) || !reflect.DeepEqual(collector.scaled, test.scaled) {
+			t.Fatalf("test %d: Expected %v %v but got %v %v", i, test.raw, test.scaled, collector.raw, collector.scaled)
+		}
+	}
+}
+
+func TestUnitHeaderCollectors(t *testing.T) {
+	var tests = []struct {
+		network   gopacket.NetworkLayer
+		payload   []byte
+		ip        int // IP total length
+		dscp, ecn int
+		df        bool
+		dfJSON    string
+	}{
+		{ // IPv4 type of service
+			network: ipv4(0xb8|0x01, layers.IPv4DontFragment), payload: []byte("GET"),
+			ip: 20 + 20 + 3, dscp: 46, ecn: 1, df: true, dfJSON: "[true]",
+		},
+		{
+			network: ipv4(0x02, 0),
+			ip:      20 + 20, dscp: 0, ecn: 2, df: false, dfJSON: "[false]",
+		},
+		{ // IPv6 traffic class, and no Don't Fragment bit
+			network: ipv6(0x28 | 0x03), payload: []byte("GET"),
+			ip: 40 + 20 + 3, dscp: 10, ecn: 3, df: false, dfJSON: "[false]",
+		},
+	}
+
+	for i, test := range tests {
+		packet := frame(t, test.network, &layers.TCP{SrcPort: 40000, DstPort: 80, PSH: true, ACK: true}, test.payload)
+		length, tos, df := newLengthCollector(), newTOSCollector(), newDFCollector()
+		length.processPacket(packet, packet.TCP)
+		tos.processPacket(packet)
+		df.processPacket(packet)
+
+		if !reflect.DeepEqual(length.ip, []int{test.ip}) || !reflect.DeepEqual(length.payload, []int{len(test.payload)}) {
+			t.Fatalf("test %d: Expected %v %v but got %v %v", i, test.ip, len(test.payload), length.ip, length.payload)
+		}
+		if !reflect.DeepEqual(tos.dscp, []int{test.dscp}) || !reflect.DeepEqual(tos.ecn, []int{test.ecn}) {
+			t.Fatalf("test %d: Expected %v %v but got %v %v", i, test.dscp, test.ecn, tos.dscp, tos.ecn)
+		}
+		// IPv6 packets are collected as false rather than left out
+		if !reflect.DeepEqual([]bool(*df), []bool{test.df}) {
+			t.Fatalf("test %d: Expected %v but got %v", i, []bool{test.df}, *df)
+		}
+		if bytes, _ := json.Marshal(df); string(bytes) != test.dfJSON {
+			t.Fatalf("test %d: Expected %v but got %s", i, test.dfJSON, bytes)
+		}
+	}
+}
+
+func TestUnitRequestCollector(t *testing.T) {
+	type segment struct {
+		seq     uint32
+		payload string
+	}
+	var tests = []struct {
+		segments []segment
+		method   string
+		order    []string
+		headers  map[string]string
+		size     int64
+	}{
+		{ // Header names are recorded as sent, values by canonical name, and
+			// redacted headers that are not selected are left out
+			segments: []segment{{seq: 1, payload: "GET / HTTP/1.1\r\nhost: a\r\nuser-agent: curl\r\nACCEPT-LANGUAGE: en\r\ncookie: id=1\r\n\r\n"}},
+			method:   "GET",
+			order:    []string{"host", "user-agent", "ACCEPT-LANGUAGE", "cookie"},
+			headers:  map[string]string{"User-Agent": "curl", "Accept-Language": "en"},
+			size:     80,
+		},
+		{ // Repeated headers are joined
+			segments: []segment{{seq: 1, payload: "GET / HTTP/1.1\r\nAccept-Language: en\r\nCookie: a=1\r\nAccept-Language: fr\r\nCookie: b=2\r\n\r\n"}},
+			method:   "GET",
+			order:    []string{"Accept-Language", "Cookie", "Accept-Language", "Cookie"},
+			headers:  map[string]string{"Accept-Language": "en, fr"},
+			size:     86,
+		},
+		{ // Request split across segments, the first one retransmitted
+			segments: []segment{
+				{seq: 1, payload: "GET / HTTP/1.1\r\nHost: a\r\nUser-Ag"},
+				{seq: 1, payload: "GET / HTTP/1.1\r\nHost: a\r\nUser-Ag"},
+				{seq: 33, payload: "ent: curl\r\n\r\n"},
+			},
+			method:  "GET",
+			order:   []string{"Host", "User-Agent"},
+			headers: map[string]string{"User-Agent": "curl"},
+			size:    45,
+		},
+		{ // Segment missing from a split request
+			segments: []segment{
+				{seq: 1, payload: "GET / HTTP/1.1\r\nHost: a\r\nUser-Ag"},
+				{seq: 40, payload: "\r\n\r\n"},
+			},
+		},
+		{ // Selected headers that are also redacted are redacted, once if repeated
+			segments: []segment{{seq: 1, payload: "GET / HTTP/1.1\r\nAuthorization: Basic YTpi\r\nAuthorization: Bearer x\r\n\r\n"}},
+			method:   "GET",
+			order:    []string{"Authorization", "Authorization"},
+			headers:  map[string]string{"Authorization": "[redacted]"},
+			size:     70,
+		},
+		{ // The size counts the header and the body it declares, sent or not
+			segments: []segment{{seq: 1, payload: "POST / HTTP/1.1\r\nContent-Length: 100\r\n\r\nhello"}},
+			method:   "POST",
+			order:    []string{"Content-Length"},
+			headers:  map[string]string{},
+			size:     40 + 100,
+		},
+		{ // Not a request
+			segments: []segment{{seq: 1, payload: "\x16\x03\x01\x00\x05hello"}, {seq: 11, payload: "GET / HTTP/1.1\r\n\r\n"}},
+		},
+	}
+
+	for i, test := range tests {
+		collector := newRequestCollector([]string{"user-agent", "Accept-Language", "authorization"}, []string{"COOKIE", "Authorization"})
+		for _, segment := range test.segments {
+			tcp := &layers.TCP{SrcPort: 40000, DstPort: 80, Seq: segment.seq, PSH: true, ACK: true}
+			packet := frame(t, ipv4(0, 0), tcp, []byte(segment.payload))
+			collector.processPacket(packet, packet.TCP, reassembly.TCPDirClientToServer)
+		}
+		if collector.method != test.method || !reflect.DeepEqual(collector.order, test.order) ||
+			!reflect.DeepEqual(collector.headers, test.headers) || collector.size != test.size {
+			t.Fatalf("test %d: Expected %v %v %v %v but got %v %v %v %v", i, test.method, test.order, test.headers, test.size,
+				collector.method, collector.order, collector.headers, collector.size)
+		}
+		if test.headers == nil && collector.String() != "" {
+			t.Fatalf("test %d: Expected %q but got %q", i, "", collector.String())
+		}
+	}
+}
+
+func TestUnitECHCollector(t *testing.T) {
+	// clientHello returns a ClientHello to the server name with the extension,
+	// padded to span more than one segment
+	clientHello := func(serverName string, extension uint16) []byte {
+		name := append([]byte{0, byte(len(serverName) >> 8), byte(len(serverName))}, serverName...)
+		sni := append([]byte{byte(len(name) >> 8), byte(len(name))}, name...)
+		extensions := append([]byte{0, 0, byte(len(sni) >> 8), byte(len(sni))}, sni...)
+		extensions = append(extensions, byte(extension>>8), byte(extension), 0, 0)
+		extensions = append(extensions, 0, 21, 0x07, 0xd0) // padding
+		extensions = append(extensions, make([]byte, 2000)...)
+		hello := []byte{0x03, 0x03}
+		hello = append(hello, make([]byte, 32)...)       // random
+		hello = append(hello, 0, 0, 2, 0x13, 0x01, 1, 0) // session id, cipher suites, compression methods
+		hello = append(hello, byte(len(extensions)>>8), byte(len(extensions)))
+		hello = append(hello, extensions...)
+		handshake := append([]byte{1, 0, byte(len(hello) >> 8), byte(len(hello))}, hello...)
+		return append([]byte{22, 3, 1, byte(len(handshake) >> 8), byte(len(handshake))}, handshake...)
+	}
+	var tests = []struct {
+		request []byte
+		skip    int
+		status  string
+	}{
+		{request: clientHello("public.example.com", decode.ExtensionECH), status: "outer"},
+		{request: clientHello("example.com", decode.ExtensionECH), status: "grease"},
+		{request: clientHello("example.com", decode.ExtensionESNI), status: "esni"},
+		{request: clientHello("example.com", 23), status: "none"},
+		{request: []byte("GET / HTTP/1.1\r\n\r\n"), status: ""},
+		// The start of the ClientHello was never seen
+		{request: clientHello("public.example.com", decode.ExtensionECH), skip: 100, status: ""},
+	}
+	for testN, test := range tests {
+		collector := newECHCollector([]string{"Public.example.com"})
+		// The ClientHello is split across two segments, and only the end of
+		// it tells whether ECH was offered
+		segments := [][]byte{test.request}
+		if len(test.request) > 1400 {
+			segments = [][]byte{test.request[:1400], test.request[1400:]}
+		}
+		for i, segment := range segments {
+			if i == 1 && collector.status != "" {
+				t.Fatalf("Run: %d: Expected %v but got %v", testN+1, "", collector.status)
+			}
+			skip := 0
+			if i == 0 {
+				skip = test.skip
+			}
+			collector.processReassembled(reassembly.TCPDirServerToClient, 0, segment)
+			collector.processReassembled(reassembly.TCPDirClientToServer, skip, segment)
+		}
+		if collector.String() != test.status {
+			t.Fatalf("Run: %d: Expected %v but got %v", testN+1, test.status, collector.String())
+		}
+	}
+}
+
+func TestUnitPayloadCollector(t *testing.T) {
+	collector := newPayloadCollector(1000, 1000, []string{"cookie", "Authorization"})
+	// The Cookie header is split across segments
+	for _, segment := range []string{"GET / HTTP/1.1\r\nHost: a\r\ncoo", "kie: id=1\r\n\tsession=2\r\nAuthorization: Basic YTpi\r\n\r\n"} {
+		collector.processReassembled(reassembly.TCPDirClientToServer, len(segment), []byte(segment))
+	}
+	response := "HTTP/1.1 200 OK\r\nSet-Cookie: id=1\r\n\r\nCookie: in the body"
+	collector.processReassembled(reassembly.TCPDirServerToClient, len(response), []byte(response))
+
+	expected := []string{
+		"GET / HTTP/1.1\r\nHost: a\r\ncookie: [redacted]\r\nAuthorization: [redacted]\r\n\r\n",
+		"HTTP/1.1 200 OK\r\nSet-Cookie: id=1\r\n\r\nCookie: [redacted]",
+	}
+	var payload struct {
+		Client []byte `json:"cli"`
+		Server []byte `json:"srv"`
+	}
+	b, err := collector.MarshalJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(b, &payload); err != nil {
+		t.Fatal(err)
+	}
+	if actual := []string{string(payload.Client), string(payload.Server)}; !reflect.DeepEqual(actual, expected) {
+		t.Fatalf("Expected %q but got %q", expected, actual)
+	}
+
+	// Without redacted headers, the payload is left as is
+	collector = newPayloadCollector(1000, 1000, nil)
+	collector.processReassembled(reassembly.TCPDirServerToClient, len(response), []byte(response))
+	if actual := string(collector.redact(collector.server.Bytes())); actual != response {
+		t.Fatalf("Expected %q but got %q", response, actual)
+	}
+}
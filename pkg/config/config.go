@@ -4,18 +4,43 @@ import (
 	"fmt"
 	"io"
 	"strings"
+	"time"
+
+	"tripwire/pkg/logger"
 
 	"gopkg.in/yaml.v2"
 )
 
 type DetectorConfig struct {
-	Name            string `yaml:"name"` // name used for metrics logging
-	Signature       string `yaml:"signature"`
-	Protocol        string `yaml:"protocol"`
-	Port            uint16 `yaml:"port"`
-	BPF             string `yaml:"bpf"`
-	TimeThresholdMs int    `yaml:"time_thresh,omitempty"`
-	PacketThreshold int    `yaml:"pkt_thresh,omitempty"`
+	Name            string          `yaml:"name"` // name used for metrics logging
+	Signature       string          `yaml:"signature"`
+	Protocol        string          `yaml:"protocol"`
+	Port            uint16          `yaml:"port"`
+	BPF             string          `yaml:"bpf"`
+	TimeThresholdMs int             `yaml:"time_thresh,omitempty"`
+	PacketThreshold int             `yaml:"pkt_thresh,omitempty"`
+	RTTThreshold    int             `yaml:"rtt_thresh,omitempty"`
+	ECH             *ECHConfig      `yaml:"ech,omitempty"`      // Comparison of ECH and non-ECH streams by the ech signature
+	Sampling        *SamplingConfig `yaml:"sampling,omitempty"` // Baseline sampling of non-disrupted streams
+	Outcomes        []string        `yaml:"outcomes,omitempty"` // Stream outcomes for which verdicts are valid
+}
+
+type ECHConfig struct {
+	MinStreams    int     `yaml:"min_streams,omitempty"`  // Minimum number of ECH and of non-ECH streams from a prefix to compare them
+	RateThreshold float64 `yaml:"rate_thresh,omitempty"`  // Excess failure rate of ECH streams from a prefix for them to be disrupted
+	PrefixLen4    int     `yaml:"prefix4,omitempty"`      // IPv4 client prefix length
+	PrefixLen6    int     `yaml:"prefix6,omitempty"`      // IPv6 client prefix length
+	MaxPrefixes   int     `yaml:"max_prefixes,omitempty"` // Client prefixes whose streams are counted at once
+}
+
+type SamplingConfig struct {
+	Rate        float64       `yaml:"rate,omitempty"`         // Fraction of non-disrupted streams written as they end
+	Reservoir   int           `yaml:"reservoir,omitempty"`    // Number of non-disrupted streams kept and written every interval and at exit
+	PerPrefix   bool          `yaml:"per_prefix,omitempty"`   // Keep a separate reservoir for each client prefix
+	PrefixLen4  int           `yaml:"prefix4,omitempty"`      // IPv4 client prefix length used by PerPrefix
+	PrefixLen6  int           `yaml:"prefix6,omitempty"`      // IPv6 client prefix length used by PerPrefix
+	MaxPrefixes int           `yaml:"max_prefixes,omitempty"` // Client prefixes with a reservoir at once, used by PerPrefix
+	Interval    time.Duration `yaml:"interval,omitempty"`     // How often reservoirs are written and emptied
 }
 
 type CollectorConfig struct {
@@ -24,17 +49,64 @@ type CollectorConfig struct {
 	RelativeTimestamps     bool     `yaml:"relative_timestamps,omitempty"` // Used by Timestamp
 	MaxClientPayloadLength int      `yaml:"cli_maxlen,omitempty"`          // Used by Payload
 	MaxServerPayloadLength int      `yaml:"srv_maxlen,omitempty"`          // Used by Payload
+	ECHPublicNames         []string `yaml:"ech_public_names,omitempty"`    // Used by ECH
+	HTTPHeaders            []string `yaml:"http_headers,omitempty"`        // Used by Request
+	HTTPRedactedHeaders    []string `yaml:"http_redacted,omitempty"`       // Used by Request and Payload
 }
 
 type TCPConfig struct {
 	// Support streams without SYN/SYN+ACK/ACK sequence
-	AllowMissingInit bool `yaml:"allowmissinginit,omitempty"`
-	MaxPacketCount   int  `yaml:"max_packets"` // Maximum number of packets to accept from each of the client and server
+	AllowMissingInit bool          `yaml:"allowmissinginit,omitempty"`
+	MaxPacketCount   int           `yaml:"max_packets"` // Maximum number of packets to accept from each of the client and server
+	Timeouts         TimeoutConfig `yaml:"timeouts,omitempty"`
+	Limits           LimitConfig   `yaml:"limits,omitempty"`
+	Sampling         FlowSampling  `yaml:"sampling,omitempty"`
+}
+
+// TimeoutConfig holds how long a stream may go without packets, depending on
+// its state, before its verdict is written
+type TimeoutConfig struct {
+	Handshake   time.Duration `yaml:"handshake,omitempty"`   // Handshake not completed
+	Established time.Duration `yaml:"established,omitempty"` // Handshake completed
+	HalfClosed  time.Duration `yaml:"half_closed,omitempty"` // FIN sent by one side only
+	Closed      time.Duration `yaml:"closed,omitempty"`      // FIN sent by both sides, or RST sent
+}
+
+// LimitConfig bounds the memory used to track streams, shared among the workers
+type LimitConfig struct {
+	MaxStreams     int `yaml:"max_streams,omitempty"`      // Streams tracked at once, beyond which streams are evicted
+	MemoryBudgetMB int `yaml:"memory_budget_mb,omitempty"` // Out of order segments buffered for reassembly
+}
+
+// FlowSampling keeps a consistent share of the flows, decided by a symmetric
+// hash before assembly, so that busy links can be monitored at a fraction of
+// the cost
+type FlowSampling struct {
+	OneIn      int  `yaml:"one_in,omitempty"`     // Keep one in this many flows, or every flow if 0 or 1
+	PerPrefix  bool `yaml:"per_prefix,omitempty"` // Keep or skip all the flows of a client prefix together
+	PrefixLen4 int  `yaml:"prefix4,omitempty"`    // IPv4 client prefix length used by PerPrefix
+	PrefixLen6 int  `yaml:"prefix6,omitempty"`    // IPv6 client prefix length used by PerPrefix
 }
 
 type InputConfig struct {
-	Interface string `yaml:"interface,omitempty"`
-	PcapFile  string `yaml:"pcap,omitempty"`
+	Interface  string         `yaml:"interface,omitempty"`
+	PcapFile   string         `yaml:"pcap,omitempty"`
+	Interfaces []string       `yaml:"interfaces,omitempty"` // More interfaces, captured at once
+	PcapFiles  []string       `yaml:"pcaps,omitempty"`      // More pcap files, glob patterns or directories, read in order
+	Backend    string         `yaml:"backend,omitempty"`    // Live capture backend: pcap or afpacket
+	Timeout    time.Duration  `yaml:"timeout,omitempty"`    // How long a live capture waits for packets before handing them over
+	AFPacket   AFPacketConfig `yaml:"afpacket,omitempty"`   // Used by the afpacket backend
+	Replay     float64        `yaml:"replay,omitempty"`     // Replay pcap files as a live capture, at this multiple of their speed
+}
+
+// AFPacketConfig sets up the AF_PACKET (TPACKET_V3) ring buffers. Sockets in the
+// same fanout group share the packets of the interface, whether they belong to
+// this process or to others.
+type AFPacketConfig struct {
+	BufferMB    int    `yaml:"buffer_mb,omitempty"`    // Size of the ring buffer of each socket
+	Sockets     int    `yaml:"sockets,omitempty"`      // Number of sockets, each read on its own goroutine
+	FanoutGroup int    `yaml:"fanout_group,omitempty"` // Fanout group id, derived from the process id if 0
+	FanoutMode  string `yaml:"fanout_mode,omitempty"`  // How packets are spread: hash, lb, cpu, rollover, random or qm
 }
 
 type ParserConfig struct {
@@ -42,9 +114,41 @@ type ParserConfig struct {
 	Filter struct {
 		BPF string `yaml:"bpf,omitempty"`
 	} `yaml:"filter,omitempty"`
-	SnapLen int       `yaml:"snaplen,omitempty"`
-	Flush   int       `yaml:"flush,omitempty"`
-	TCP     TCPConfig `yaml:"tcp,omitempty"`
+	SnapLen       int           `yaml:"snaplen,omitempty"`
+	Flush         int           `yaml:"flush,omitempty"`          // Deprecated and ignored, replaced by flush_interval and tcp.timeouts
+	FlushInterval time.Duration `yaml:"flush_interval,omitempty"` // How often timed out streams are closed
+	Workers       int           `yaml:"workers,omitempty"`        // Number of goroutines assembling streams
+	QueueSize     int           `yaml:"queue_size,omitempty"`     // Number of packets queued for each worker
+	TCP           TCPConfig     `yaml:"tcp,omitempty"`
+	Decapsulation DecapConfig   `yaml:"decapsulation,omitempty"`
+	Defrag        DefragConfig  `yaml:"defrag,omitempty"`
+}
+
+// DefragConfig bounds the IP datagrams reassembled from fragments, on each
+// capture source
+type DefragConfig struct {
+	MaxDatagrams int           `yaml:"max_datagrams,omitempty"` // Datagrams reassembled at once, beyond which the oldest is dropped
+	MaxFragments int           `yaml:"max_fragments,omitempty"` // Fragments of a datagram, beyond which it is dropped
+	Timeout      time.Duration `yaml:"timeout,omitempty"`       // How long the fragments of a datagram are waited for
+}
+
+// DecapConfig selects the encapsulations removed before assembly, so that
+// mirrored or tunneled traffic is analyzed by its inner flows
+type DecapConfig struct {
+	Tunnels    []string `yaml:"tunnels,omitempty"`     // Any of vlan, mpls, gre, erspan, vxlan and geneve
+	VXLANPort  uint16   `yaml:"vxlan_port,omitempty"`  // UDP destination port of VXLAN
+	GenevePort uint16   `yaml:"geneve_port,omitempty"` // UDP destination port of GENEVE
+}
+
+type DiscoveryConfig struct {
+	ASNFile    string        `yaml:"asn_db,omitempty"`     // pyasn-style "prefix<TAB>asn" file used to group clients by ASN
+	PrefixLen4 int           `yaml:"prefix4,omitempty"`    // IPv4 client prefix length used when no ASN is known
+	PrefixLen6 int           `yaml:"prefix6,omitempty"`    // IPv6 client prefix length used when no ASN is known
+	MaxLength  int           `yaml:"max_length,omitempty"` // Maximum number of post-request packets in a sequence
+	MinCount   int           `yaml:"min_count,omitempty"`  // Minimum number of streams for a pattern to be reported
+	Top        int           `yaml:"top,omitempty"`        // Number of patterns to report
+	MaxGroups  int           `yaml:"max_groups,omitempty"` // Client groups counted at once, beyond which the least recently seen is dropped
+	Interval   time.Duration `yaml:"interval,omitempty"`   // How often patterns are reported and counted anew
 }
 
 type LoggerConfig struct {
@@ -63,11 +167,57 @@ type Config struct {
 	Detectors []DetectorConfig `yaml:"detectors"`
 	Collector CollectorConfig  `yaml:"collector"`
 	Metrics   *addrYaml        `yaml:"metrics,omitempty"`
+	Discovery *DiscoveryConfig `yaml:"discovery,omitempty"`
 }
 
 func (addr addrYaml) Network() string { return addr.Netw }
 func (addr addrYaml) String() string  { return addr.Addr }
 
+// Max returns the longest timeout, after which every stream has timed out
+func (t TimeoutConfig) Max() time.Duration {
+	max := t.Handshake
+	for _, timeout := range []time.Duration{t.Established, t.HalfClosed, t.Closed} {
+		if timeout > max {
+			max = timeout
+		}
+	}
+	return max
+}
+
+// AllInterfaces returns every interface to capture
+func (i InputConfig) AllInterfaces() []string {
+	var ifaces []string
+	if i.Interface != "" {
+		ifaces = append(ifaces, i.Interface)
+	}
+	return append(ifaces, i.Interfaces...)
+}
+
+// AllPcapFiles returns every pcap file, glob pattern or directory to read
+func (i InputConfig) AllPcapFiles() []string {
+	var files []string
+	if i.PcapFile != "" {
+		files = append(files, i.PcapFile)
+	}
+	return append(files, i.PcapFiles...)
+}
+
+// PerWorker returns the share of the limits of each of the given number of workers
+func (l LimitConfig) PerWorker(workers int) LimitConfig {
+	return LimitConfig{
+		MaxStreams:     (l.MaxStreams + workers - 1) / workers,
+		MemoryBudgetMB: (l.MemoryBudgetMB + workers - 1) / workers,
+	}
+}
+
+// Rate returns the number of flows each kept flow stands for
+func (s FlowSampling) Rate() int {
+	if s.OneIn < 1 {
+		return 1
+	}
+	return s.OneIn
+}
+
 func (cfg *Config) Write(w io.Writer) error {
 	encoder := yaml.NewEncoder(w)
 	defer encoder.Close()
@@ -79,6 +229,14 @@ func (cfg *Config) Read(r io.Reader) error {
 	if err := decoder.Decode(&cfg); err != nil {
 		return err
 	}
+	if cfg.Parser.Flush != 0 {
+		// Flushing every so many packets has no equivalent in the timeouts of
+		// streams, so the key is ignored, as configs dumped before it was
+		// removed all hold it
+		logger.Info.Printf("[Config] parser.flush is deprecated and ignored: streams are closed after the parser.tcp.timeouts " +
+			"of their state, checked every parser.flush_interval (10s by default)")
+		cfg.Parser.Flush = 0
+	}
 	cfg.SetDefaults()
 	return nil
 }
@@ -88,12 +246,80 @@ func (cfg *Config) SetDefaults() {
 	if cfg.Logger.Outform == "" {
 		cfg.Logger.Outform = "json"
 	}
-	if cfg.Parser.Flush == 0 {
-		cfg.Parser.Flush = 50
+	input := &cfg.Parser.Input
+	if input.Backend == "" {
+		input.Backend = "pcap"
+	}
+	if input.Timeout == 0 {
+		input.Timeout = time.Second
+	}
+	if input.AFPacket.BufferMB == 0 {
+		input.AFPacket.BufferMB = 64
+	}
+	if input.AFPacket.Sockets == 0 {
+		input.AFPacket.Sockets = 1
+	}
+	if input.AFPacket.FanoutMode == "" {
+		input.AFPacket.FanoutMode = "hash"
+	}
+	if cfg.Parser.FlushInterval == 0 {
+		cfg.Parser.FlushInterval = 10 * time.Second
+	}
+	if cfg.Parser.Workers == 0 {
+		cfg.Parser.Workers = 1
+	}
+	if cfg.Parser.QueueSize == 0 {
+		cfg.Parser.QueueSize = 4096
+	}
+	if decap := &cfg.Parser.Decapsulation; len(decap.Tunnels) > 0 {
+		if decap.VXLANPort == 0 {
+			decap.VXLANPort = 4789
+		}
+		if decap.GenevePort == 0 {
+			decap.GenevePort = 6081
+		}
+	}
+	defrag := &cfg.Parser.Defrag
+	if defrag.MaxDatagrams == 0 {
+		defrag.MaxDatagrams = 1024
+	}
+	if defrag.MaxFragments == 0 {
+		defrag.MaxFragments = 64
+	}
+	if defrag.Timeout == 0 {
+		defrag.Timeout = 30 * time.Second
 	}
 	if cfg.Parser.TCP.MaxPacketCount == 0 {
 		cfg.Parser.TCP.MaxPacketCount = 25
 	}
+	timeouts := &cfg.Parser.TCP.Timeouts
+	if timeouts.Handshake == 0 {
+		timeouts.Handshake = 30 * time.Second
+	}
+	if timeouts.Established == 0 {
+		timeouts.Established = 2 * time.Minute
+	}
+	if timeouts.HalfClosed == 0 {
+		timeouts.HalfClosed = time.Minute
+	}
+	if timeouts.Closed == 0 {
+		timeouts.Closed = 10 * time.Second
+	}
+	limits := &cfg.Parser.TCP.Limits
+	if limits.MaxStreams == 0 {
+		limits.MaxStreams = 100000
+	}
+	if limits.MemoryBudgetMB == 0 {
+		limits.MemoryBudgetMB = 256
+	}
+	if sampling := &cfg.Parser.TCP.Sampling; sampling.PerPrefix {
+		if sampling.PrefixLen4 == 0 {
+			sampling.PrefixLen4 = 24
+		}
+		if sampling.PrefixLen6 == 0 {
+			sampling.PrefixLen6 = 48
+		}
+	}
 	if len(cfg.Detectors) == 0 {
 		cfg.Detectors = []DetectorConfig{
 			{
@@ -121,9 +347,43 @@ func (cfg *Config) SetDefaults() {
 	if len(cfg.Collector.Fields) == 0 {
 		cfg.Collector.Fields = []string{"ip", "ports", "direction",
 			"timestamp", "ipid", "ttl", "flags", "seqnum", "sni",
-			"host", "extensions"}
+			"host", "extensions", "source"}
 		cfg.Collector.TruncateIPs = true
 	}
+	if cfg.Collector.ECHPublicNames == nil {
+		// Public name of Cloudflare, the largest ECH deployment
+		cfg.Collector.ECHPublicNames = []string{"cloudflare-ech.com"}
+	}
+	if cfg.Collector.HTTPHeaders == nil {
+		cfg.Collector.HTTPHeaders = []string{"User-Agent", "Accept-Language", "Referer"}
+	}
+	if cfg.Collector.HTTPRedactedHeaders == nil {
+		cfg.Collector.HTTPRedactedHeaders = []string{"Authorization", "Cookie", "Proxy-Authorization"}
+	}
+
+	if cfg.Discovery != nil {
+		if cfg.Discovery.PrefixLen4 == 0 {
+			cfg.Discovery.PrefixLen4 = 24
+		}
+		if cfg.Discovery.PrefixLen6 == 0 {
+			cfg.Discovery.PrefixLen6 = 48
+		}
+		if cfg.Discovery.MaxLength == 0 {
+			cfg.Discovery.MaxLength = 8
+		}
+		if cfg.Discovery.MinCount == 0 {
+			cfg.Discovery.MinCount = 3
+		}
+		if cfg.Discovery.Top == 0 {
+			cfg.Discovery.Top = 10
+		}
+		if cfg.Discovery.MaxGroups == 0 {
+			cfg.Discovery.MaxGroups = 65536
+		}
+		if cfg.Discovery.Interval == 0 {
+			cfg.Discovery.Interval = time.Hour
+		}
+	}
 
 	var filters []string
 	for idx := range cfg.Detectors {
@@ -143,13 +403,59 @@ func (cfg *Config) SetDefaults() {
 		if strings.ToLower(cfg.Detectors[idx].Signature) == "packetcount" && cfg.Detectors[idx].PacketThreshold == 0 {
 			cfg.Detectors[idx].PacketThreshold = 10
 		}
+		if strings.ToLower(cfg.Detectors[idx].Signature) == "rtt" && cfg.Detectors[idx].RTTThreshold == 0 {
+			cfg.Detectors[idx].RTTThreshold = 100
+		}
+		if strings.ToLower(cfg.Detectors[idx].Signature) == "ech" {
+			if cfg.Detectors[idx].ECH == nil {
+				cfg.Detectors[idx].ECH = &ECHConfig{}
+			}
+			ech := cfg.Detectors[idx].ECH
+			if ech.MinStreams == 0 {
+				ech.MinStreams = 10
+			}
+			if ech.RateThreshold == 0 {
+				ech.RateThreshold = 0.5
+			}
+			if ech.PrefixLen4 == 0 {
+				ech.PrefixLen4 = 24
+			}
+			if ech.PrefixLen6 == 0 {
+				ech.PrefixLen6 = 48
+			}
+			if ech.MaxPrefixes == 0 {
+				ech.MaxPrefixes = 65536
+			}
+		}
+		if sampling := cfg.Detectors[idx].Sampling; sampling != nil {
+			if sampling.PrefixLen4 == 0 {
+				sampling.PrefixLen4 = 24
+			}
+			if sampling.PrefixLen6 == 0 {
+				sampling.PrefixLen6 = 48
+			}
+			if sampling.MaxPrefixes == 0 {
+				sampling.MaxPrefixes = 1024
+			}
+			if sampling.Interval == 0 {
+				sampling.Interval = time.Hour
+			}
+		}
 	}
 
-	if cfg.Parser.Filter.BPF == "" {
+	// The filter sees the outer headers of tunneled packets, which the filters
+	// of the detectors would not match
+	if cfg.Parser.Filter.BPF == "" && len(cfg.Parser.Decapsulation.Tunnels) == 0 && len(filters) > 0 {
+		// Fragments past the first lack the ports the filters match on
+		filters = append(filters, fragmentsBPF)
 		cfg.Parser.Filter.BPF = strings.Join(filters, " or ")
 	}
 }
 
+// fragmentsBPF matches IPv4 fragments and IPv6 packets whose first extension
+// header is a fragment header
+const fragmentsBPF = "(ip[6:2] & 0x3fff != 0) or (ip6[6] == 44)"
+
 func DefaultConfig() *Config {
 	cfg := new(Config)
 	cfg.SetDefaults()
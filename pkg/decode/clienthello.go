@@ -0,0 +1,412 @@
+package decode
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// TLS extensions the ClientHello fields are parsed from
+const (
+	extensionServerName          = 0
+	extensionSupportedGroups     = 10
+	extensionPointFormats        = 11
+	extensionSignatureAlgorithms = 13
+	extensionALPN                = 16
+	extensionSupportedVersions   = 43
+	extensionKeyShare            = 51
+)
+
+// TLS extensions encrypting the ClientHello: Encrypted Client Hello, and the
+// legacy Encrypted SNI it replaced
+const (
+	ExtensionECH  = 0xfe0d
+	ExtensionESNI = 0xffce
+)
+
+// ErrIncompleteClientHello is returned while the data holds the start of a
+// ClientHello but not all of it
+var ErrIncompleteClientHello = errors.New("Incomplete TLS ClientHello")
+
+var errNotClientHello = errors.New("Not a TLS ClientHello")
+
+// ClientHello holds the fields of a TLS ClientHello that tell client
+// implementations apart. GREASE values are kept, in the order they were sent.
+type ClientHello struct {
+	Version             uint16 // legacy_version
+	SupportedVersions   []uint16
+	CipherSuites        []uint16
+	Extensions          []uint16
+	ServerName          string
+	SupportedGroups     []uint16
+	PointFormats        []uint8
+	SignatureAlgorithms []uint16
+	ALPN                []string
+	KeyShareGroups      []uint16
+}
+
+// ParseClientHello parses the ClientHello starting the TLS records of the data,
+// which may span several records. It returns ErrIncompleteClientHello if the
+// data ends before the ClientHello does.
+func ParseClientHello(data []byte) (*ClientHello, error) {
+	// Gather the handshake message from the fragments of the records
+	var message []byte
+	for {
+		if len(data) < 5 {
+			return nil, ErrIncompleteClientHello
+		}
+		if data[0] != 22 || data[1] != 3 {
+			return nil, errNotClientHello
+		}
+		length := int(be.Uint16(data[3:]))
+		if len(data) < 5+length {
+			message = append(message, data[5:]...)
+		} else {
+			message = append(message, data[5:5+length]...)
+		}
+		data = data[min(len(data), 5+length):]
+
+		if len(message) >= 1 && message[0] != 1 {
+			return nil, errNotClientHello
+		}
+		if len(message) >= 4 {
+			n := int(message[1])<<16 | int(message[2])<<8 | int(message[3])
+			if len(message) >= 4+n {
+				return parseClientHello(helloReader(message[4 : 4+n]))
+			}
+		}
+		if len(data) == 0 {
+			return nil, ErrIncompleteClientHello
+		}
+	}
+}
+
+// Longest ClientHello parsed, records included
+const maxClientHelloLength = 1 << 16
+
+// ClientHelloBuffer gathers the reassembled payload of the client until the
+// ClientHello starting it is complete, so that ClientHellos spanning several
+// segments, such as those with post-quantum key shares, are parsed as well
+type ClientHelloBuffer struct {
+	data  []byte
+	done  bool
+	hello *ClientHello
+}
+
+// ProcessReassembled appends reassembled payload of the client, following skip
+// bytes that were never seen
+func (b *ClientHelloBuffer) ProcessReassembled(skip int, payload []byte) {
+	if b.done {
+		return
+	}
+	if skip != 0 {
+		// The ClientHello cannot be told from bytes that were never seen
+		b.done, b.data = true, nil
+		return
+	}
+	if len(b.data)+len(payload) > maxClientHelloLength {
+		payload = payload[:maxClientHelloLength-len(b.data)]
+	}
+	b.data = append(b.data, payload...)
+	hello, err := ParseClientHello(b.data)
+	if err == ErrIncompleteClientHello && len(b.data) < maxClientHelloLength {
+		return
+	}
+	b.done, b.data, b.hello = true, nil, hello
+}
+
+// ClientHello returns the ClientHello starting the payload, or nil if it did
+// not start with one, and whether enough payload was seen to tell
+func (b *ClientHelloBuffer) ClientHello() (*ClientHello, bool) {
+	return b.hello, b.done
+}
+
+// helloReader reads the big-endian fields of a handshake message
+type helloReader []byte
+
+func (r *helloReader) uint8() (uint8, bool) {
+	if len(*r) < 1 {
+		return 0, false
+	}
+	v := (*r)[0]
+	*r = (*r)[1:]
+	return v, true
+}
+
+func (r *helloReader) uint16() (uint16, bool) {
+	if len(*r) < 2 {
+		return 0, false
+	}
+	v := be.Uint16(*r)
+	*r = (*r)[2:]
+	return v, true
+}
+
+func (r *helloReader) bytes(n int) (helloReader, bool) {
+	if len(*r) < n {
+		return nil, false
+	}
+	v := (*r)[:n]
+	*r = (*r)[n:]
+	return v, true
+}
+
+// vector reads a vector prefixed with its length, of lengthSize bytes
+func (r *helloReader) vector(lengthSize int) (helloReader, bool) {
+	var n int
+	switch lengthSize {
+	case 1:
+		l, ok := r.uint8()
+		if !ok {
+			return nil, false
+		}
+		n = int(l)
+	default:
+		l, ok := r.uint16()
+		if !ok {
+			return nil, false
+		}
+		n = int(l)
+	}
+	return r.bytes(n)
+}
+
+// uint16s reads a vector of 16 bits values
+func (r *helloReader) uint16s(lengthSize int) ([]uint16, bool) {
+	v, ok := r.vector(lengthSize)
+	if !ok || len(v)%2 != 0 {
+		return nil, false
+	}
+	values := make([]uint16, 0, len(v)/2)
+	for len(v) > 0 {
+		value, _ := v.uint16()
+		values = append(values, value)
+	}
+	return values, true
+}
+
+var errMalformedClientHello = errors.New("Malformed TLS ClientHello")
+
+// parseClientHello parses the body of a ClientHello handshake message, as laid
+// out in RFC 8446, section 4.1.2
+func parseClientHello(r helloReader) (*ClientHello, error) {
+	var h ClientHello
+	var ok bool
+	if h.Version, ok = r.uint16(); !ok {
+		return nil, errMalformedClientHello
+	}
+	if _, ok = r.bytes(32); !ok { // random
+		return nil, errMalformedClientHello
+	}
+	if _, ok = r.vector(1); !ok { // legacy_session_id
+		return nil, errMalformedClientHello
+	}
+	if h.CipherSuites, ok = r.uint16s(2); !ok {
+		return nil, errMalformedClientHello
+	}
+	if _, ok = r.vector(1); !ok { // legacy_compression_methods
+		return nil, errMalformedClientHello
+	}
+	if len(r) == 0 {
+		return &h, nil // no extensions
+	}
+	extensions, ok := r.vector(2)
+	if !ok {
+		return nil, errMalformedClientHello
+	}
+	for len(extensions) > 0 {
+		extension, ok := extensions.uint16()
+		if !ok {
+			return nil, errMalformedClientHello
+		}
+		data, ok := extensions.vector(2)
+		if !ok {
+			return nil, errMalformedClientHello
+		}
+		h.Extensions = append(h.Extensions, extension)
+		if !h.parseExtension(extension, data) {
+			return nil, errMalformedClientHello
+		}
+	}
+	return &h, nil
+}
+
+func (h *ClientHello) parseExtension(extension uint16, data helloReader) (ok bool) {
+	switch extension {
+	case extensionServerName:
+		// RFC 6066, section 3
+		names, ok := data.vector(2)
+		for ok && len(names) > 0 {
+			var nameType uint8
+			var name helloReader
+			if nameType, ok = names.uint8(); ok {
+				name, ok = names.vector(2)
+			}
+			if ok && nameType == 0 && h.ServerName == "" {
+				h.ServerName = string(name)
+			}
+		}
+		return ok
+	case extensionSupportedGroups:
+		h.SupportedGroups, ok = data.uint16s(2)
+		return ok
+	case extensionPointFormats:
+		var formats helloReader
+		formats, ok = data.vector(1)
+		h.PointFormats = append([]uint8(nil), formats...)
+		return ok
+	case extensionSignatureAlgorithms:
+		h.SignatureAlgorithms, ok = data.uint16s(2)
+		return ok
+	case extensionALPN:
+		// RFC 7301, section 3.1
+		protocols, ok := data.vector(2)
+		for ok && len(protocols) > 0 {
+			var protocol helloReader
+			if protocol, ok = protocols.vector(1); ok {
+				h.ALPN = append(h.ALPN, string(protocol))
+			}
+		}
+		return ok
+	case extensionSupportedVersions:
+		h.SupportedVersions, ok = data.uint16s(1)
+		return ok
+	case extensionKeyShare:
+		// RFC 8446, section 4.2.8
+		shares, ok := data.vector(2)
+		for ok && len(shares) > 0 {
+			var group uint16
+			if group, ok = shares.uint16(); ok {
+				_, ok = shares.vector(2)
+				h.KeyShareGroups = append(h.KeyShareGroups, group)
+			}
+		}
+		return ok
+	}
+	return true
+}
+
+// grease returns whether the value is one of the GREASE values of RFC 8701,
+// which clients send at random to keep servers tolerant of unknown values
+func grease(value uint16) bool {
+	return value&0x0f0f == 0x0a0a && value>>8 == value&0xff
+}
+
+// withoutGREASE returns the values that are not GREASE values
+func withoutGREASE(values []uint16) []uint16 {
+	var filtered []uint16
+	for _, value := range values {
+		if !grease(value) {
+			filtered = append(filtered, value)
+		}
+	}
+	return filtered
+}
+
+// join joins the values formatted with the format
+func join(values []uint16, format, sep string) string {
+	s := make([]string, len(values))
+	for i, value := range values {
+		s[i] = fmt.Sprintf(format, value)
+	}
+	return strings.Join(s, sep)
+}
+
+// JA3 returns the JA3 fingerprint of the ClientHello, in the clear and hashed
+func (h *ClientHello) JA3() (string, string) {
+	formats := make([]uint16, len(h.PointFormats))
+	for i, format := range h.PointFormats {
+		formats[i] = uint16(format)
+	}
+	ja3 := fmt.Sprintf("%d,%s,%s,%s,%s", h.Version,
+		join(withoutGREASE(h.CipherSuites), "%d", "-"),
+		join(withoutGREASE(h.Extensions), "%d", "-"),
+		join(withoutGREASE(h.SupportedGroups), "%d", "-"),
+		join(formats, "%d", "-"))
+	hash := md5.Sum([]byte(ja3))
+	return ja3, hex.EncodeToString(hash[:])
+}
+
+// ja4Versions are the version codes of JA4 fingerprints
+var ja4Versions = map[uint16]string{
+	0x0304: "13",
+	0x0303: "12",
+	0x0302: "11",
+	0x0301: "10",
+	0x0300: "s3",
+	0x0200: "s2",
+	0xfeff: "d1",
+	0xfefd: "d2",
+	0xfefc: "d3",
+}
+
+// ja4Hash returns the truncated SHA-256 hash of JA4 fingerprints
+func ja4Hash(s string) string {
+	if s == "" {
+		return "000000000000"
+	}
+	hash := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(hash[:6])
+}
+
+// JA4 returns the JA4 fingerprint of the ClientHello, as seen over TCP
+func (h *ClientHello) JA4() string {
+	// TLS 1.3 clients give the versions they support in an extension
+	version := h.Version
+	if supported := withoutGREASE(h.SupportedVersions); len(supported) > 0 {
+		version = 0
+		for _, v := range supported {
+			if v > version {
+				version = v
+			}
+		}
+	}
+	versionCode, ok := ja4Versions[version]
+	if !ok {
+		versionCode = "00"
+	}
+	sni := "i"
+	if h.ServerName != "" {
+		sni = "d"
+	}
+	alpn := "00"
+	if len(h.ALPN) > 0 && h.ALPN[0] != "" {
+		first, last := h.ALPN[0][0], h.ALPN[0][len(h.ALPN[0])-1]
+		if alphanumeric(first) && alphanumeric(last) {
+			alpn = string([]byte{first, last})
+		} else {
+			s := hex.EncodeToString([]byte(h.ALPN[0]))
+			alpn = s[:1] + s[len(s)-1:]
+		}
+	}
+	ciphers := withoutGREASE(h.CipherSuites)
+	extensions := withoutGREASE(h.Extensions)
+	a := fmt.Sprintf("t%s%s%02d%02d%s", versionCode, sni, min(len(ciphers), 99), min(len(extensions), 99), alpn)
+
+	sorted := append([]uint16(nil), ciphers...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	b := ja4Hash(join(sorted, "%04x", ","))
+
+	// The server name and ALPN are left out of the hashed extensions, as they
+	// are accounted for in the first part
+	sorted = sorted[:0]
+	for _, extension := range extensions {
+		if extension != extensionServerName && extension != extensionALPN {
+			sorted = append(sorted, extension)
+		}
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	c := join(sorted, "%04x", ",")
+	if algorithms := withoutGREASE(h.SignatureAlgorithms); c != "" && len(algorithms) > 0 {
+		c += "_" + join(algorithms, "%04x", ",")
+	}
+	return a + "_" + b + "_" + ja4Hash(c)
+}
+
+func alphanumeric(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z'
+}
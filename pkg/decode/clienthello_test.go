@@ -0,0 +1,55 @@
+package decode
+
+import (
+	"encoding/hex"
+	"reflect"
+	"testing"
+)
+
+func TestUnitClientHello(t *testing.T) {
+	// A ClientHello with GREASE values, split across two records
+	data, _ := hex.DecodeString("160301003c010000b1030300000000000000000000000000000000000000000000000000" +
+		"000000000000000000082a2a13011302c02b010000803a3a0000000000160303007910000e00000b6578616d706c652e" +
+		"636f6d000a000800064a4a001d0017000b00020100000d00060004040308040010000e000c02683208687474702f312e" +
+		"31002b0007065a5a030403030033002b00294a4a000100001d0020111111111111111111111111111111111111111111" +
+		"1111111111111111111111")
+
+	hello, err := ParseClientHello(data)
+	if err != nil {
+		t.Fatalf("Expected %v but got %v", nil, err)
+	}
+	expected := ClientHello{
+		Version:             0x0303,
+		SupportedVersions:   []uint16{0x5a5a, 0x0304, 0x0303},
+		CipherSuites:        []uint16{0x2a2a, 0x1301, 0x1302, 0xc02b},
+		Extensions:          []uint16{0x3a3a, 0, 10, 11, 13, 16, 43, 51},
+		ServerName:          "example.com",
+		SupportedGroups:     []uint16{0x4a4a, 29, 23},
+		PointFormats:        []uint8{0},
+		SignatureAlgorithms: []uint16{0x0403, 0x0804},
+		ALPN:                []string{"h2", "http/1.1"},
+		KeyShareGroups:      []uint16{0x4a4a, 29},
+	}
+	if !reflect.DeepEqual(*hello, expected) {
+		t.Fatalf("Expected %v but got %v", expected, *hello)
+	}
+
+	ja3, ja3Hash := hello.JA3()
+	if ja3 != "771,4865-4866-49195,0-10-11-13-16-43-51,29-23,0" || ja3Hash != "ce04116d61aa4c0fc142193e54a2a31e" {
+		t.Fatalf("Expected %v but got %v %v", "771,4865-4866-49195,0-10-11-13-16-43-51,29-23,0", ja3, ja3Hash)
+	}
+	if ja4 := hello.JA4(); ja4 != "t13d0307h2_5559582ccdc4_078775ef5e04" {
+		t.Fatalf("Expected %v but got %v", "t13d0307h2_5559582ccdc4_078775ef5e04", ja4)
+	}
+
+	// Until the whole ClientHello is seen, more data is needed
+	for i := 0; i < len(data); i++ {
+		if _, err := ParseClientHello(data[:i]); err != ErrIncompleteClientHello {
+			t.Fatalf("Expected %v but got %v for %d bytes", ErrIncompleteClientHello, err, i)
+		}
+	}
+
+	if _, err := ParseClientHello([]byte("GET / HTTP/1.1\r\n\r\n")); err == nil || err == ErrIncompleteClientHello {
+		t.Fatalf("Expected %v but got %v", errNotClientHello, err)
+	}
+}
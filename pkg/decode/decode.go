@@ -0,0 +1,362 @@
+// Package decode decodes the layers tripwire looks at once per packet, into
+// layers allocated once and reused for every packet read.
+package decode
+
+import (
+	"bufio"
+	"bytes"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/Kkevsterrr/gopacket"
+	"github.com/Kkevsterrr/gopacket/layers"
+)
+
+// Packet is the decode context of a packet shared by the parser, the detectors
+// and the collectors. Its layers point into the packet data and are only valid
+// until the packet is decoded again.
+type Packet struct {
+	CaptureInfo gopacket.CaptureInfo
+	Source      string // Name of the capture source the packet was read from
+
+	// Decoded network and transport layers, nil when the packet has none. Those
+	// of tunneled packets are the inner ones.
+	IPv4 *layers.IPv4
+	IPv6 *layers.IPv6
+	TCP  *layers.TCP
+
+	// Outer headers removed by decapsulation
+	Encapsulation Encapsulation
+
+	// Index of the interface the packet was captured on, given by Linux cooked
+	// v2 headers, 0 if unknown
+	InterfaceIndex uint32
+
+	// Number of IP fragments the packet was reassembled from, 0 if it was not
+	// fragmented, and their identification
+	Fragments  int
+	FragmentID uint32
+
+	linkType   layers.LinkType
+	first      gopacket.Decoder // decoder of the link type, for the slow path
+	data       []byte
+	tunnels    *Tunnels
+	fragmented bool     // whether the packet is a fragment, left to a Defragmenter
+	frag       fragment // the fragment, if it is one
+
+	// Preallocated layers of the fast path
+	parser   *gopacket.DecodingLayerParser
+	decoded  []gopacket.LayerType
+	eth      layers.Ethernet
+	dot1q    layers.Dot1Q
+	sll      layers.LinuxSLL
+	sll2     linuxSLL2
+	loopback layers.Loopback
+	ipv4     layers.IPv4
+	ipv6     layers.IPv6
+	ipv6ext  ipv6Extensions
+	tcp      layers.TCP
+	// Fast paths of decapsulated packets, by first layer
+	innerParsers map[gopacket.LayerType]*gopacket.DecodingLayerParser
+
+	// TCP options and application layers, decoded on first use
+	tcpOptions     TCPOptions
+	tcpOptionsDone bool
+	tls            layers.TLS
+	tlsDone        bool
+	clientHello    *layers.TLSClientHello
+	httpDone       bool
+	httpRequest    *http.Request
+	payloadReader  bytes.Reader
+	bufferedReader *bufio.Reader
+}
+
+// terminalLayers are the layers the fast path stops at without a TCP layer,
+// for which the packet is known not to be TCP
+var terminalLayers = map[gopacket.LayerType]bool{
+	layers.LayerTypeUDP:        true,
+	layers.LayerTypeICMPv4:     true,
+	layers.LayerTypeICMPv6:     true,
+	layers.LayerTypeARP:        true,
+	layers.LayerTypeIGMP:       true,
+	layers.LayerTypeSCTP:       true,
+	layers.LayerTypeUDPLite:    true,
+	gopacket.LayerTypeFragment: true,
+}
+
+// NewPacket returns a packet decoding frames of the given link type
+func NewPacket(linkType layers.LinkType) *Packet {
+	p := &Packet{
+		decoded: make([]gopacket.LayerType, 0, 8),
+	}
+	p.ipv6ext.ip = &p.ipv6
+	p.setLinkType(linkType)
+	return p
+}
+
+// SetLinkType changes the link type of the frames decoded next, for sources
+// mixing link types
+func (p *Packet) SetLinkType(linkType layers.LinkType) {
+	if linkType != p.linkType {
+		p.setLinkType(linkType)
+	}
+}
+
+func (p *Packet) setLinkType(linkType layers.LinkType) {
+	p.linkType, p.first = linkType, linkType
+	var first gopacket.LayerType
+	switch {
+	case linkType == layers.LinkTypeEthernet:
+		first = layers.LayerTypeEthernet
+	case linkType == layers.LinkTypeLinuxSLL:
+		first = layers.LayerTypeLinuxSLL
+	case linkType == LinkTypeLinuxSLL2:
+		first, p.first = layerTypeLinuxSLL2, layerTypeLinuxSLL2
+	case linkType == layers.LinkTypeNull, linkType == layers.LinkTypeLoop:
+		first = layers.LayerTypeLoopback
+	case rawLinkType(linkType):
+		// The fast path of raw IP packets is chosen by their version
+		p.first, p.parser = layers.LinkTypeRaw, nil
+		return
+	default:
+		// Other link types are always decoded by gopacket.NewPacket
+		p.parser = nil
+		return
+	}
+	p.parser = p.newParser(first)
+}
+
+func (p *Packet) newParser(first gopacket.LayerType) *gopacket.DecodingLayerParser {
+	return gopacket.NewDecodingLayerParser(first,
+		&p.eth, &p.dot1q, &p.sll, &p.sll2, &p.loopback, &p.ipv4, &p.ipv6, &p.ipv6ext, &p.tcp)
+}
+
+// SetTunnels sets the encapsulations removed from the frames decoded next, none
+// if nil
+func (p *Packet) SetTunnels(tunnels *Tunnels) {
+	p.tunnels = tunnels
+}
+
+// innerParser returns the fast path of decapsulated packets starting with the
+// given layer
+func (p *Packet) innerParser(first gopacket.LayerType) *gopacket.DecodingLayerParser {
+	parser, ok := p.innerParsers[first]
+	if !ok {
+		if p.innerParsers == nil {
+			p.innerParsers = make(map[gopacket.LayerType]*gopacket.DecodingLayerParser)
+		}
+		parser = p.newParser(first)
+		p.innerParsers[first] = parser
+	}
+	return parser
+}
+
+// Decode decodes data in place. The packet keeps referencing data, which must
+// not be modified until the packet is decoded again.
+func (p *Packet) Decode(data []byte, ci gopacket.CaptureInfo) error {
+	p.Encapsulation.reset()
+	p.InterfaceIndex = 0
+	parser, first := p.parser, p.first
+	switch {
+	case p.linkType == LinkTypeLinuxSLL2:
+		if len(data) >= sll2HeaderLen {
+			p.InterfaceIndex = be.Uint32(data[4:])
+		}
+	case rawLinkType(p.linkType):
+		if layerType := ipLayer(data); layerType != gopacket.LayerTypeZero {
+			parser, first = p.innerParser(layerType), layerType
+		}
+	}
+	if p.tunnels != nil {
+		if inner, layerType, ok := p.decapsulate(data); ok {
+			data, parser, first = inner, p.innerParser(layerType), layerType
+		}
+	}
+	return p.decode(data, ci, parser, first)
+}
+
+// decode decodes data with the given fast path, or from the given first layer
+// without one
+func (p *Packet) decode(data []byte, ci gopacket.CaptureInfo, parser *gopacket.DecodingLayerParser, first gopacket.Decoder) error {
+	p.CaptureInfo = ci
+	p.IPv4, p.IPv6, p.TCP = nil, nil, nil
+	p.Fragments, p.FragmentID, p.fragmented = 0, 0, false
+	p.ipv6ext.reset()
+	p.tcpOptionsDone = false
+	p.tlsDone, p.clientHello = false, nil
+	p.httpDone, p.httpRequest = false, nil
+
+	if parser == nil {
+		err := p.decodeSlow(data, first)
+		p.findFragment()
+		return err
+	}
+	err := parser.DecodeLayers(data, &p.decoded)
+	for _, layerType := range p.decoded {
+		switch layerType {
+		case layers.LayerTypeIPv4:
+			p.IPv4 = &p.ipv4
+		case layers.LayerTypeIPv6:
+			p.IPv6 = &p.ipv6
+		case layers.LayerTypeTCP:
+			p.TCP = &p.tcp
+		}
+	}
+	if p.TCP != nil {
+		// Application layers are decoded on demand from the TCP payload
+		return nil
+	}
+	if unsupported, ok := err.(gopacket.UnsupportedLayerType); ok && !terminalLayers[gopacket.LayerType(unsupported)] {
+		// Encapsulations the fast path does not know about
+		err = p.decodeSlow(data, first)
+	}
+	p.findFragment()
+	return err
+}
+
+// DecodeCopy copies data into a buffer owned by the packet before decoding it,
+// for data the caller reuses, such as the buffers of zero-copy reads
+func (p *Packet) DecodeCopy(data []byte, ci gopacket.CaptureInfo) error {
+	p.data = append(p.data[:0], data...)
+	return p.Decode(p.data, ci)
+}
+
+// decodeSlow decodes the packet with gopacket.NewPacket from its first layer and
+// copies the layers it found into the packet
+func (p *Packet) decodeSlow(data []byte, first gopacket.Decoder) error {
+	packet := gopacket.NewPacket(data, first, gopacket.NoCopy)
+	switch ip := packet.NetworkLayer().(type) {
+	case *layers.IPv4:
+		p.ipv4 = *ip
+		p.IPv4 = &p.ipv4
+	case *layers.IPv6:
+		p.ipv6 = *ip
+		p.IPv6 = &p.ipv6
+	}
+	if tcp, ok := packet.Layer(layers.LayerTypeTCP).(*layers.TCP); ok {
+		p.tcp = *tcp
+		p.TCP = &p.tcp
+	} else if p.IPv6 != nil {
+		// Looks for a fragment header the way the fast path does
+		_ = p.ipv6ext.DecodeFromBytes(p.ipv6.Payload, gopacket.NilDecodeFeedback)
+	}
+	if errLayer := packet.ErrorLayer(); errLayer != nil && p.TCP == nil {
+		return errLayer.Error()
+	}
+	return nil
+}
+
+// NetworkFlow returns the flow of the network layer
+func (p *Packet) NetworkFlow() gopacket.Flow {
+	switch {
+	case p.IPv4 != nil:
+		return p.IPv4.NetworkFlow()
+	case p.IPv6 != nil:
+		return p.IPv6.NetworkFlow()
+	}
+	return gopacket.InvalidFlow
+}
+
+// Payload returns the TCP payload
+func (p *Packet) Payload() []byte {
+	if p.TCP == nil {
+		return nil
+	}
+	return p.TCP.Payload
+}
+
+// ClientHello returns the TLS Client Hello starting the payload, or nil. The
+// payload is decoded on the first call only.
+func (p *Packet) ClientHello() *layers.TLSClientHello {
+	if p.tlsDone {
+		return p.clientHello
+	}
+	p.tlsDone = true
+	payload := p.Payload()
+	// A Client Hello is the first record of a connection, so other payloads
+	// are not worth decoding
+	if len(payload) == 0 || layers.TLSType(payload[0]) != layers.TLSHandshake {
+		return nil
+	}
+	if err := p.tls.DecodeFromBytes(payload, gopacket.NilDecodeFeedback); err != nil {
+		return nil
+	}
+	if len(p.tls.Handshake) > 0 {
+		hs := p.tls.Handshake[0]
+		if hs.HandshakeType == 1 {
+			p.clientHello = hs.ClientHello
+		}
+	}
+	return p.clientHello
+}
+
+// HTTPRequest returns the HTTP request starting the payload, or nil. The
+// payload is parsed on the first call only.
+func (p *Packet) HTTPRequest() *http.Request {
+	if p.httpDone {
+		return p.httpRequest
+	}
+	p.httpDone = true
+	payload := p.Payload()
+	if !maybeRequest(payload) {
+		return nil
+	}
+	p.payloadReader.Reset(payload)
+	if p.bufferedReader == nil {
+		p.bufferedReader = bufio.NewReader(&p.payloadReader)
+	} else {
+		p.bufferedReader.Reset(&p.payloadReader)
+	}
+	req, err := http.ReadRequest(p.bufferedReader)
+	if err != nil {
+		return nil
+	}
+	p.httpRequest = req
+	return req
+}
+
+// maybeRequest returns false for payloads http.ReadRequest is bound to reject,
+// which are most of them, without allocating: requests end their header with a
+// line feed and start with a method token followed by a space
+func maybeRequest(payload []byte) bool {
+	if bytes.IndexByte(payload, '\n') < 0 {
+		return false
+	}
+	for i, c := range payload {
+		switch {
+		case c == ' ':
+			return i > 0
+		case c <= ' ' || c >= 0x7f || strings.IndexByte(`"(),/:;<=>?@[\]{}`, c) >= 0:
+			return false
+		}
+	}
+	return false
+}
+
+// Pool recycles the packets of a link type
+type Pool struct {
+	pool sync.Pool
+}
+
+// NewPool returns a pool of packets decoding frames of the given link type,
+// removing the given encapsulations
+func NewPool(linkType layers.LinkType, tunnels *Tunnels) *Pool {
+	return &Pool{
+		pool: sync.Pool{New: func() interface{} {
+			packet := NewPacket(linkType)
+			packet.SetTunnels(tunnels)
+			return packet
+		}},
+	}
+}
+
+// Get returns a packet from the pool
+func (p *Pool) Get() *Packet {
+	return p.pool.Get().(*Packet)
+}
+
+// Put returns a packet to the pool once it is no longer used
+func (p *Pool) Put(packet *Packet) {
+	p.pool.Put(packet)
+}
@@ -0,0 +1,185 @@
+package decode
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net/http"
+	"os"
+	"testing"
+
+	"github.com/Kkevsterrr/gopacket"
+	"github.com/Kkevsterrr/gopacket/layers"
+	"github.com/Kkevsterrr/gopacket/pcapgo"
+)
+
+type frame struct {
+	data []byte
+	ci   gopacket.CaptureInfo
+}
+
+func readPcap(tb testing.TB, path string) ([]frame, layers.LinkType) {
+	f, err := os.Open(path)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer f.Close()
+	r, err := pcapgo.NewReader(f)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	var frames []frame
+	for {
+		data, ci, err := r.ReadPacketData()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			tb.Fatal(err)
+		}
+		frames = append(frames, frame{data: data, ci: ci})
+	}
+	return frames, r.LinkType()
+}
+
+func TestUnitDecode(t *testing.T) {
+	tests := []struct {
+		pcap string
+		sni  string
+		host string
+	}{
+		{pcap: "../../testdata/full_http_request.pcap", host: "localhost:8081"},
+		{pcap: "../../testdata/airtel_https_example.pcap", sni: "youporn.com"},
+	}
+
+	for _, test := range tests {
+		frames, linkType := readPcap(t, test.pcap)
+		packet := NewPacket(linkType)
+		var sni, host string
+		for _, f := range frames {
+			expected := gopacket.NewPacket(f.data, linkType, gopacket.Default)
+			packet.Decode(f.data, f.ci)
+
+			tcp, _ := expected.Layer(layers.LayerTypeTCP).(*layers.TCP)
+			if (tcp == nil) != (packet.TCP == nil) {
+				t.Fatalf("Expected TCP %v but got %v", tcp, packet.TCP)
+			}
+			if tcp == nil {
+				continue
+			}
+			if tcp.Seq != packet.TCP.Seq || tcp.Ack != packet.TCP.Ack || tcp.Window != packet.TCP.Window ||
+				!bytes.Equal(tcp.Payload, packet.Payload()) {
+				t.Fatalf("Expected TCP %v but got %v", tcp, packet.TCP)
+			}
+			if flow := expected.NetworkLayer().NetworkFlow(); flow != packet.NetworkFlow() {
+				t.Fatalf("Expected %v but got %v", flow, packet.NetworkFlow())
+			}
+			if clientHello := packet.ClientHello(); clientHello != nil {
+				sni = clientHello.ServerName
+			}
+			if req := packet.HTTPRequest(); req != nil {
+				host = req.Host
+			}
+		}
+		if sni != test.sni {
+			t.Fatalf("Expected %v but got %v", test.sni, sni)
+		}
+		if host != test.host {
+			t.Fatalf("Expected %v but got %v", test.host, host)
+		}
+	}
+}
+
+// BenchmarkNewPacket decodes packets the way tripwire did before the decode
+// context: a gopacket.Packet per packet, with the TLS and HTTP layers decoded
+// again by every detector and collector looking at them
+func BenchmarkNewPacket(b *testing.B) {
+	frames, linkType := readPcap(b, "../../testdata/tripwire-1597963966.pcap")
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		f := frames[i%len(frames)]
+		packet := gopacket.NewPacket(f.data, linkType, gopacket.Default)
+		if packet.Layer(layers.LayerTypeTCP) == nil {
+			continue
+		}
+		_ = packet.NetworkLayer().NetworkFlow()
+		app := packet.ApplicationLayer()
+		if app == nil {
+			continue
+		}
+		// httpsProtocol, sniCollector and tlsExtensionsCollector
+		for j := 0; j < 3; j++ {
+			var tls layers.TLS
+			var decoded []gopacket.LayerType
+			parser := gopacket.NewDecodingLayerParser(layers.LayerTypeTLS, &tls)
+			_ = parser.DecodeLayers(app.LayerContents(), &decoded)
+		}
+		// httpProtocol, hostCollector and uriCollector
+		for j := 0; j < 3; j++ {
+			_, _ = http.ReadRequest(bufio.NewReader(bytes.NewReader(app.Payload())))
+		}
+	}
+}
+
+// BenchmarkDecode decodes packets into a reused decode context, with the TLS
+// and HTTP layers decoded once
+func BenchmarkDecode(b *testing.B) {
+	frames, linkType := readPcap(b, "../../testdata/tripwire-1597963966.pcap")
+	packet := NewPacket(linkType)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		f := frames[i%len(frames)]
+		packet.Decode(f.data, f.ci)
+		if packet.TCP == nil {
+			continue
+		}
+		_ = packet.NetworkFlow()
+		for j := 0; j < 3; j++ {
+			packet.ClientHello()
+			packet.HTTPRequest()
+		}
+	}
+}
+
+// BenchmarkDecodeCopy is BenchmarkDecode for zero-copy reads, whose data is
+// copied into the packet first
+func BenchmarkDecodeCopy(b *testing.B) {
+	frames, linkType := readPcap(b, "../../testdata/tripwire-1597963966.pcap")
+	packet := NewPacket(linkType)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		f := frames[i%len(frames)]
+		packet.DecodeCopy(f.data, f.ci)
+		if packet.TCP == nil {
+			continue
+		}
+		_ = packet.NetworkFlow()
+		for j := 0; j < 3; j++ {
+			packet.ClientHello()
+			packet.HTTPRequest()
+		}
+	}
+}
+
+func TestUnitMaybeRequest(t *testing.T) {
+	tests := []struct {
+		payload  string
+		expected bool
+	}{
+		{payload: "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n", expected: true},
+		{payload: "M-SEARCH * HTTP/1.1\r\n\r\n", expected: true},
+		{payload: "GET / HTTP/1.1", expected: false},
+		{payload: "HTTP/1.1 200 OK\r\n\r\n", expected: false},
+		{payload: " GET / HTTP/1.1\r\n\r\n", expected: false},
+		{payload: "\x16\x03\x01\x02\x00\n", expected: false},
+	}
+
+	for _, test := range tests {
+		if got := maybeRequest([]byte(test.payload)); got != test.expected {
+			t.Fatalf("Expected %v but got %v for %q", test.expected, got, test.payload)
+		}
+	}
+}
@@ -0,0 +1,390 @@
+package decode
+
+import (
+	"bytes"
+	"container/list"
+	"errors"
+	"time"
+
+	"github.com/Kkevsterrr/gopacket"
+	"github.com/Kkevsterrr/gopacket/layers"
+)
+
+// ipv6ExtensionClass are the extension headers ipv6Extensions walks
+var ipv6ExtensionClass = gopacket.NewLayerClass([]gopacket.LayerType{
+	layers.LayerTypeIPv6HopByHop,
+	layers.LayerTypeIPv6Routing,
+	layers.LayerTypeIPv6Fragment,
+	layers.LayerTypeIPv6Destination,
+	layers.LayerTypeIPSecAH,
+})
+
+var errIPv6Extensions = errors.New("Invalid IPv6 extension headers")
+
+// ipv6Extensions decodes the whole chain of extension headers following an
+// IPv6 header at once. Unlike IPv6ExtensionSkipper, it knows the length of
+// authentication headers, and stops at fragments, whose data is not the upper
+// layer yet.
+type ipv6Extensions struct {
+	layers.BaseLayer
+	NextHeader layers.IPProtocol
+
+	ip *layers.IPv6 // the header the extensions follow
+
+	// Offset in Contents of the fragment header, and of the next header field
+	// pointing at it, -1 for that of the IPv6 or hop-by-hop header
+	fragment   int
+	nextHeader int
+	// Whether the fragment header is that of an actual fragment, rather than an
+	// atomic fragment carrying the whole datagram
+	fragmented bool
+}
+
+func (e *ipv6Extensions) reset() {
+	e.fragment, e.nextHeader, e.fragmented = -1, -1, false
+}
+
+func (e *ipv6Extensions) CanDecode() gopacket.LayerClass {
+	return ipv6ExtensionClass
+}
+
+func (e *ipv6Extensions) NextLayerType() gopacket.LayerType {
+	if e.fragmented {
+		return gopacket.LayerTypeFragment
+	}
+	return e.NextHeader.LayerType()
+}
+
+func (e *ipv6Extensions) DecodeFromBytes(data []byte, df gopacket.DecodeFeedback) error {
+	e.reset()
+	protocol := e.ip.NextHeader
+	if e.ip.HopByHop != nil {
+		protocol = e.ip.HopByHop.NextHeader
+	}
+	off, prev := 0, -1
+	for i := 0; i < maxHeaders; i++ {
+		var length int
+		switch protocol {
+		case layers.IPProtocolIPv6HopByHop, layers.IPProtocolIPv6Routing, layers.IPProtocolIPv6Destination:
+			if len(data) >= off+2 {
+				length = (int(data[off+1]) + 1) * 8
+			}
+		case layers.IPProtocolAH:
+			if len(data) >= off+2 {
+				length = (int(data[off+1]) + 2) * 4
+			}
+		case layers.IPProtocolIPv6Fragment:
+			if len(data) < off+8 {
+				break
+			}
+			length = 8
+			if e.fragment < 0 {
+				e.fragment, e.nextHeader = off, prev
+			}
+			if be.Uint16(data[off+2:])&0xfff9 != 0 {
+				e.fragmented = true
+				e.BaseLayer = layers.BaseLayer{Contents: data[:off+length], Payload: data[off+length:]}
+				e.NextHeader = layers.IPProtocol(data[off])
+				return nil
+			}
+		default:
+			e.BaseLayer = layers.BaseLayer{Contents: data[:off], Payload: data[off:]}
+			e.NextHeader = protocol
+			return nil
+		}
+		if length == 0 || len(data) < off+length {
+			break
+		}
+		protocol = layers.IPProtocol(data[off])
+		prev, off = off, off+length
+	}
+	df.SetTruncated()
+	return errIPv6Extensions
+}
+
+// fragment locates the parts of an IP fragment in the packet data
+type fragment struct {
+	id       uint32
+	offset   int  // of the data in the datagram
+	more     bool // whether more fragments follow
+	protocol byte // upper layer protocol, only told by first IPv6 fragments
+	// IPv4 header, or IPv6 header and the extension headers preceding the
+	// fragment header, whose next header field is at nextHeader
+	header     []byte
+	nextHeader int
+	data       []byte
+}
+
+// findFragment records whether the decoded packet is an IP fragment
+func (p *Packet) findFragment() {
+	switch {
+	case p.IPv4 != nil:
+		ip := p.IPv4
+		if ip.Flags&layers.IPv4MoreFragments == 0 && ip.FragOffset == 0 {
+			return
+		}
+		p.frag = fragment{
+			id:       uint32(ip.Id),
+			offset:   int(ip.FragOffset) * 8,
+			more:     ip.Flags&layers.IPv4MoreFragments != 0,
+			protocol: byte(ip.Protocol),
+			header:   ip.Contents,
+			data:     ip.Payload,
+		}
+	case p.IPv6 != nil && p.ipv6ext.fragmented:
+		ip, e := p.IPv6, &p.ipv6ext
+		// The extension headers follow the IPv6 header and its hop-by-hop header,
+		// in the same packet data
+		extensions := cap(ip.Contents) - cap(e.Contents)
+		header := e.Contents[e.fragment:]
+		p.frag = fragment{
+			id:         be.Uint32(header[4:]),
+			offset:     int(be.Uint16(header[2:]) & 0xfff8),
+			more:       header[3]&0x01 != 0,
+			protocol:   header[0],
+			header:     ip.Contents[:extensions+e.fragment],
+			nextHeader: extensions + e.nextHeader,
+			data:       e.Payload,
+		}
+		if e.nextHeader < 0 {
+			p.frag.nextHeader = 6
+			if ip.HopByHop != nil {
+				p.frag.nextHeader = 40
+			}
+		}
+	default:
+		return
+	}
+	p.fragmented = true
+}
+
+// IsFragment returns whether the packet is an IP fragment, which has no
+// transport layer until reassembled
+func (p *Packet) IsFragment() bool {
+	return p.fragmented
+}
+
+// DefragLimits bound the datagrams a Defragmenter reassembles
+type DefragLimits struct {
+	MaxDatagrams int           // Datagrams reassembled at once, beyond which the oldest is dropped
+	MaxFragments int           // Fragments of a datagram, beyond which it is dropped
+	Timeout      time.Duration // How long, in capture time, the fragments of a datagram are waited for
+}
+
+// Reasons datagrams are dropped for
+const (
+	DropTimeout = "timeout" // fragments missing past the timeout
+	DropEvicted = "evicted" // too many datagrams reassembled at once
+	DropInvalid = "invalid" // inconsistent lengths or too many fragments
+	DropOverlap = "overlap" // fragments overlapping with different data
+)
+
+// Largest IP datagram, without the IPv4 header or the IPv6 header
+const maxDatagram = 65535
+
+// Defragmenter reassembles the IPv4 and IPv6 datagrams of fragmented packets.
+// Datagrams whose fragments overlap with different data are dropped, as
+// recent Linux kernels do, whereas duplicate fragments are ignored.
+type Defragmenter struct {
+	limits    DefragLimits
+	datagrams map[datagramKey]*list.Element
+	order     *list.List // datagrams, oldest first
+	dropped   func(reason string)
+}
+
+type datagramKey struct {
+	src, dst [16]byte
+	id       uint32
+	protocol byte // IPv4 only, as IPv6 tells it in the first fragment only
+	ipv6     bool
+}
+
+type datagram struct {
+	key        datagramKey
+	first      time.Time // of the first fragment received
+	fragments  int
+	header     []byte // of the first fragment
+	nextHeader int
+	protocol   byte
+	data       []byte
+	received   [][2]int // ranges of data received, sorted and disjoint
+	length     int      // length of data, told by the last fragment, or -1
+}
+
+// NewDefragmenter returns a defragmenter within the given limits, which calls
+// dropped, if not nil, with the reason of every datagram it drops
+func NewDefragmenter(limits DefragLimits, dropped func(reason string)) *Defragmenter {
+	return &Defragmenter{
+		limits:    limits,
+		datagrams: make(map[datagramKey]*list.Element),
+		order:     list.New(),
+		dropped:   dropped,
+	}
+}
+
+// Defrag adds the fragment the packet is to its datagram. It returns whether
+// the packet is a whole datagram: either it was not fragmented, or its last
+// missing fragment completed the datagram, which it now holds.
+func (d *Defragmenter) Defrag(p *Packet) bool {
+	if !p.fragmented {
+		return true
+	}
+	now := p.CaptureInfo.Timestamp
+	for e := d.order.Front(); e != nil && now.Sub(e.Value.(*datagram).first) > d.limits.Timeout; e = d.order.Front() {
+		d.drop(e, DropTimeout)
+	}
+
+	key := p.datagramKey()
+	e, ok := d.datagrams[key]
+	if !ok {
+		if d.order.Len() >= d.limits.MaxDatagrams {
+			d.drop(d.order.Front(), DropEvicted)
+		}
+		e = d.order.PushBack(&datagram{key: key, first: now, length: -1})
+		d.datagrams[key] = e
+	}
+	g := e.Value.(*datagram)
+	if reason := g.add(&p.frag, d.limits.MaxFragments); reason != "" {
+		d.drop(e, reason)
+		return false
+	}
+	if g.length < 0 || g.header == nil || len(g.received) != 1 || g.received[0][1] != g.length {
+		return false
+	}
+	d.order.Remove(e)
+	delete(d.datagrams, key)
+	p.reassemble(g)
+	return true
+}
+
+// Pending returns the number of datagrams being reassembled
+func (d *Defragmenter) Pending() int {
+	return d.order.Len()
+}
+
+func (d *Defragmenter) drop(e *list.Element, reason string) {
+	d.order.Remove(e)
+	delete(d.datagrams, e.Value.(*datagram).key)
+	if d.dropped != nil {
+		d.dropped(reason)
+	}
+}
+
+func (p *Packet) datagramKey() datagramKey {
+	key := datagramKey{id: p.frag.id}
+	if p.IPv4 != nil {
+		copy(key.src[:], p.IPv4.SrcIP)
+		copy(key.dst[:], p.IPv4.DstIP)
+		key.protocol = p.frag.protocol
+	} else {
+		copy(key.src[:], p.IPv6.SrcIP)
+		copy(key.dst[:], p.IPv6.DstIP)
+		key.ipv6 = true
+	}
+	return key
+}
+
+// add copies a fragment into the datagram. It returns why the datagram is to be
+// dropped, if it is.
+func (g *datagram) add(f *fragment, maxFragments int) string {
+	g.fragments++
+	start, end := f.offset, f.offset+len(f.data)
+	switch {
+	case g.fragments > maxFragments, end > maxDatagram:
+		return DropInvalid
+	case f.more && (len(f.data) == 0 || len(f.data)%8 != 0):
+		return DropInvalid
+	case g.length >= 0 && (end > g.length || !f.more && end != g.length):
+		return DropInvalid
+	case !f.more && len(g.received) > 0 && g.received[len(g.received)-1][1] > end:
+		return DropInvalid
+	}
+	if !f.more {
+		g.length = end
+	}
+
+	// Data received twice must not differ
+	i := 0
+	for ; i < len(g.received) && g.received[i][1] < start; i++ {
+	}
+	j := i
+	for ; j < len(g.received) && g.received[j][0] <= end; j++ {
+		from, to := max(start, g.received[j][0]), min(end, g.received[j][1])
+		if from < to && !bytes.Equal(g.data[from:to], f.data[from-start:to-start]) {
+			return DropOverlap
+		}
+	}
+	if end > len(g.data) {
+		g.data = append(g.data, make([]byte, end-len(g.data))...)
+	}
+	copy(g.data[start:end], f.data)
+	// Ranges i to j-1 touch the fragment and merge with it
+	merged := [2]int{start, end}
+	if i < j {
+		merged = [2]int{min(start, g.received[i][0]), max(end, g.received[j-1][1])}
+	}
+	g.received = append(g.received[:i], append([][2]int{merged}, g.received[j:]...)...)
+
+	if start == 0 {
+		g.header = append(g.header[:0], f.header...)
+		g.nextHeader, g.protocol = f.nextHeader, f.protocol
+	}
+	return ""
+}
+
+// reassemble decodes a complete datagram into the packet, which was decoded
+// from its last fragment
+func (p *Packet) reassemble(g *datagram) {
+	p.data = append(append(p.data[:0], g.header...), g.data...)
+	header := p.data[:len(g.header)]
+	first := layers.LayerTypeIPv4
+	if g.key.ipv6 {
+		first = layers.LayerTypeIPv6
+		header[g.nextHeader] = g.protocol
+		be.PutUint16(header[4:], uint16(len(p.data)-40))
+	} else {
+		be.PutUint16(header[2:], uint16(len(p.data)))
+		// Only Don't Fragment remains of the flags and the offset
+		header[6], header[7] = header[6]&0x40, 0
+		header[10], header[11] = 0, 0
+		be.PutUint16(header[10:], checksum(header))
+	}
+
+	ci := p.CaptureInfo
+	ci.CaptureLength, ci.Length = len(p.data), len(p.data)
+	data, parser, next := p.data, p.innerParser(first), gopacket.Decoder(first)
+	// Tunnels carried by fragments are removed from the datagram
+	if p.tunnels != nil {
+		if inner, layerType, ok := p.decapsulateFrom(data, 0, first); ok {
+			data, parser, next = inner, p.innerParser(layerType), layerType
+		}
+	}
+	_ = p.decode(data, ci, parser, next)
+	p.Fragments, p.FragmentID = g.fragments, g.key.id
+}
+
+// checksum returns the checksum of an IPv4 header
+func checksum(header []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(header); i += 2 {
+		sum += uint32(be.Uint16(header[i:]))
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func max(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
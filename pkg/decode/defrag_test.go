@@ -0,0 +1,183 @@
+package decode
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/Kkevsterrr/gopacket"
+	"github.com/Kkevsterrr/gopacket/layers"
+)
+
+// payload is long enough to be split into several fragments
+var payload = append([]byte("GET / HTTP/1.1\r\nHost: example.com\r\nUser-Agent: "), append(bytes.Repeat([]byte{'a'}, 100), "\r\n\r\n"...)...)
+
+// ipv6Packet returns an IPv6 packet of a TCP segment from 2001:db8::1:40000 to
+// 2001:db8::2:80, with a hop-by-hop header
+func ipv6Packet(t *testing.T) []byte {
+	ip := &layers.IPv6{Version: 6, HopLimit: 64, NextHeader: layers.IPProtocolTCP,
+		SrcIP: net.ParseIP("2001:db8::1"), DstIP: net.ParseIP("2001:db8::2")}
+	tcp := &layers.TCP{SrcPort: 40000, DstPort: 80, Seq: 1, PSH: true, ACK: true, Window: 512}
+	if err := tcp.SetNetworkLayerForChecksum(ip); err != nil {
+		t.Fatal(err)
+	}
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, ip, tcp, gopacket.Payload(payload)); err != nil {
+		t.Fatal(err)
+	}
+	// The hop-by-hop header only holds padding
+	data := append([]byte(nil), buf.Bytes()[:40]...)
+	data[6] = 0
+	data = append(data, byte(layers.IPProtocolTCP), 0, 1, 4, 0, 0, 0, 0)
+	data = append(data, buf.Bytes()[40:]...)
+	binary.BigEndian.PutUint16(data[4:], uint16(len(data)-40))
+	return data
+}
+
+// fragmentIPv4 splits the payload of an IPv4 packet into fragments of size bytes
+func fragmentIPv4(ip []byte, size int) [][]byte {
+	headerLen := int(ip[0]&0x0f) * 4
+	var fragments [][]byte
+	for off := headerLen; off < len(ip); off += size {
+		end := off + size
+		if end > len(ip) {
+			end = len(ip)
+		}
+		fragment := append(append([]byte(nil), ip[:headerLen]...), ip[off:end]...)
+		binary.BigEndian.PutUint16(fragment[2:], uint16(len(fragment)))
+		flags := uint16(off-headerLen) / 8
+		if end < len(ip) {
+			flags |= 0x2000
+		}
+		binary.BigEndian.PutUint16(fragment[6:], flags)
+		fragments = append(fragments, fragment)
+	}
+	return fragments
+}
+
+// fragmentIPv6 splits the payload of an IPv6 packet following its hop-by-hop
+// header into fragments of size bytes
+func fragmentIPv6(ip []byte, size int, id uint32) [][]byte {
+	unfragmentable := 48
+	var fragments [][]byte
+	for off := unfragmentable; off < len(ip); off += size {
+		end := off + size
+		if end > len(ip) {
+			end = len(ip)
+		}
+		fragment := append([]byte(nil), ip[:unfragmentable]...)
+		fragment[40] = byte(layers.IPProtocolIPv6Fragment)
+		header := []byte{ip[40], 0, 0, 0, 0, 0, 0, 0}
+		flags := uint16(off - unfragmentable)
+		if end < len(ip) {
+			flags |= 1
+		}
+		binary.BigEndian.PutUint16(header[2:], flags)
+		binary.BigEndian.PutUint32(header[4:], id)
+		fragment = append(append(fragment, header...), ip[off:end]...)
+		binary.BigEndian.PutUint16(fragment[4:], uint16(len(fragment)-40))
+		fragments = append(fragments, fragment)
+	}
+	return fragments
+}
+
+func TestUnitDefrag(t *testing.T) {
+	var dropped []string
+	d := NewDefragmenter(DefragLimits{MaxDatagrams: 2, MaxFragments: 8, Timeout: time.Second},
+		func(reason string) { dropped = append(dropped, reason) })
+	packet := NewPacket(layers.LinkTypeEthernet)
+	start := time.Unix(1, 0)
+	// defrag feeds frames to the defragmenter, returning whether the last one
+	// completed a datagram
+	defrag := func(frames [][]byte, etherType uint16, at time.Duration) bool {
+		var done bool
+		for _, frame := range frames {
+			_ = packet.DecodeCopy(ether(etherType, frame), gopacket.CaptureInfo{Timestamp: start.Add(at)})
+			if !packet.IsFragment() || packet.TCP != nil {
+				t.Fatalf("Expected fragment but got %v", packet.TCP)
+			}
+			done = d.Defrag(packet)
+		}
+		return done
+	}
+	check := func(name string, fragments int, id uint32) {
+		if packet.TCP == nil || packet.TCP.DstPort != 80 || !bytes.Equal(packet.Payload(), payload) {
+			t.Fatalf("Expected TCP payload %q but got %v for %s", payload, packet.TCP, name)
+		}
+		if req := packet.HTTPRequest(); req == nil || req.Host != "example.com" {
+			t.Fatalf("Expected HTTP request but got %v for %s", req, name)
+		}
+		if packet.Fragments != fragments || packet.FragmentID != id {
+			t.Fatalf("Expected %v fragments of %v but got %v of %v for %s", fragments, id, packet.Fragments, packet.FragmentID, name)
+		}
+	}
+
+	// Fragments in any order, some duplicated, make up the datagram
+	ipv4 := innerFrame(t)[14:]
+	binary.BigEndian.PutUint16(ipv4[4:], 1234)
+	ipv4 = append(ipv4[:40:40], payload...)
+	binary.BigEndian.PutUint16(ipv4[2:], uint16(len(ipv4)))
+	fragments := fragmentIPv4(ipv4, 64)
+	if len(fragments) != 3 {
+		t.Fatalf("Expected %v fragments but got %v", 3, len(fragments))
+	}
+	if !defrag([][]byte{fragments[2], fragments[0], fragments[0], fragments[1]}, 0x0800, 0) {
+		t.Fatalf("Expected datagram to be reassembled")
+	}
+	check("ipv4", 4, 1234)
+	if packet.IPv4.Flags != 0 || packet.IPv4.FragOffset != 0 || int(packet.IPv4.Length) != len(ipv4) ||
+		checksum(packet.IPv4.Contents) != 0 {
+		t.Fatalf("Expected %v but got %v", ipv4, packet.IPv4)
+	}
+
+	ipv6 := ipv6Packet(t)
+	fragments = fragmentIPv6(ipv6, 64, 99)
+	if !defrag([][]byte{fragments[1], fragments[2], fragments[0]}, 0x86dd, 0) {
+		t.Fatalf("Expected datagram to be reassembled")
+	}
+	check("ipv6", 3, 99)
+	if !bytes.Equal(packet.data, ipv6) {
+		t.Fatalf("Expected %x but got %x", ipv6, packet.data)
+	}
+
+	// Fragments overlapping with different data drop their datagram
+	fragments = fragmentIPv6(ipv6, 64, 100)
+	overlap := append([]byte(nil), fragments[1]...)
+	overlap[len(overlap)-1]++
+	if defrag([][]byte{fragments[1], overlap, fragments[0], fragments[2]}, 0x86dd, 0) {
+		t.Fatalf("Expected datagram to be dropped")
+	}
+	// Datagrams are dropped past the timeout, or for newer ones past the limit
+	for id := 1; id <= 3; id++ {
+		binary.BigEndian.PutUint16(ipv4[4:], uint16(id))
+		defrag(fragmentIPv4(ipv4, 64)[:1], 0x0800, 2*time.Second)
+	}
+	expected := []string{DropOverlap, DropTimeout, DropEvicted}
+	if !reflect.DeepEqual(dropped, expected) {
+		t.Fatalf("Expected %v but got %v", expected, dropped)
+	}
+	if d.Pending() != 2 {
+		t.Fatalf("Expected %v but got %v", 2, d.Pending())
+	}
+
+	// Link types decoded by gopacket.NewPacket find fragments the same way
+	raw := NewPacket(layers.LinkTypeRaw)
+	for _, fragment := range fragmentIPv6(ipv6, 64, 102) {
+		_ = raw.Decode(fragment, gopacket.CaptureInfo{})
+		if !raw.IsFragment() || raw.TCP != nil {
+			t.Fatalf("Expected fragment but got %v", raw.TCP)
+		}
+	}
+
+	// Atomic fragments and packets that are not fragmented are whole datagrams
+	atomic := fragmentIPv6(ipv6, len(ipv6), 101)[0]
+	_ = packet.DecodeCopy(ether(0x86dd, atomic), gopacket.CaptureInfo{})
+	if packet.IsFragment() || !d.Defrag(packet) {
+		t.Fatalf("Expected whole datagram but got fragment")
+	}
+	check("atomic", 0, 0)
+}
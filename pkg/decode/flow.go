@@ -0,0 +1,29 @@
+package decode
+
+import (
+	"net"
+
+	"github.com/Kkevsterrr/gopacket"
+)
+
+// ClientPrefix returns the client address truncated to the prefix length of
+// its family, in CIDR notation
+func ClientPrefix(client gopacket.Endpoint, len4, len6 int) string {
+	ip := net.IP(client.Raw())
+	bits, ones := 8*net.IPv6len, len6
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, bits, ones = ip4, 8*net.IPv4len, len4
+	}
+	ipNet := net.IPNet{IP: ip.Mask(net.CIDRMask(ones, bits)), Mask: net.CIDRMask(ones, bits)}
+	return ipNet.String()
+}
+
+// MixHash is the finalizer of SplitMix64, spreading every bit of hash over the
+// result. Flow hashes also spread flows across workers, so they are mixed before
+// sampling: otherwise the sampled flows would share their low bits, and all be
+// handed to the same workers.
+func MixHash(hash uint64) uint64 {
+	hash = (hash ^ hash>>30) * 0xbf58476d1ce4e5b9
+	hash = (hash ^ hash>>27) * 0x94d049bb133111eb
+	return hash ^ hash>>31
+}
@@ -0,0 +1,39 @@
+package decode
+
+import (
+	"net"
+	"testing"
+
+	"github.com/Kkevsterrr/gopacket/layers"
+)
+
+func TestUnitClientPrefix(t *testing.T) {
+	var tests = []struct {
+		ip     string
+		prefix string
+	}{
+		{"192.0.2.77", "192.0.2.0/24"},
+		{"2001:db8:1234:5678::1", "2001:db8:1234::/48"},
+		{"::ffff:198.51.100.9", "198.51.100.0/24"},
+	}
+	for _, test := range tests {
+		ip := net.ParseIP(test.ip)
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		if prefix := ClientPrefix(layers.NewIPEndpoint(ip), 24, 48); prefix != test.prefix {
+			t.Fatalf("Expected %v but got %v", test.prefix, prefix)
+		}
+	}
+}
+
+func TestUnitMixHash(t *testing.T) {
+	// Consecutive hashes must not share their low bits once mixed
+	seen := make(map[uint64]bool)
+	for hash := uint64(0); hash < 64; hash++ {
+		seen[MixHash(hash<<8)%16] = true
+	}
+	if len(seen) != 16 {
+		t.Fatalf("Expected %v but got %v", 16, len(seen))
+	}
+}
@@ -0,0 +1,88 @@
+package decode
+
+import (
+	"errors"
+	"net"
+	"runtime"
+
+	"github.com/Kkevsterrr/gopacket"
+	"github.com/Kkevsterrr/gopacket/layers"
+)
+
+// LinkTypeLinuxSLL2 is LINKTYPE_LINUX_SLL2 (276), the link type of captures
+// taken with tcpdump -i any. gopacket's link types are 8 bits wide, so captures
+// of that link type are read with this truncated value, which no other link
+// type uses.
+const LinkTypeLinuxSLL2 = layers.LinkType(276 & 0xff)
+
+// dltRaw is DLT_RAW, the link type of live raw IP captures, which differs from
+// LINKTYPE_RAW used in capture files
+var dltRaw = layers.LinkType(12)
+
+func init() {
+	if runtime.GOOS == "openbsd" {
+		dltRaw = 14
+	}
+}
+
+// rawLinkType returns whether frames of the link type are bare IP packets
+func rawLinkType(linkType layers.LinkType) bool {
+	switch linkType {
+	case layers.LinkTypeRaw, layers.LinkTypeIPv4, layers.LinkTypeIPv6, dltRaw:
+		return true
+	}
+	return false
+}
+
+// Length of Linux cooked capture v2 headers
+const sll2HeaderLen = 20
+
+// layerTypeLinuxSLL2 is the layer of Linux cooked capture v2 headers, which
+// gopacket does not know about
+var layerTypeLinuxSLL2 = gopacket.RegisterLayerType(1000, gopacket.LayerTypeMetadata{
+	Name:    "LinuxSLL2",
+	Decoder: gopacket.DecodeFunc(decodeLinuxSLL2),
+})
+
+// linuxSLL2 is a Linux cooked capture v2 header. Unlike v1, it holds the index
+// of the interface the packet was captured on.
+type linuxSLL2 struct {
+	layers.BaseLayer
+	Protocol        layers.EthernetType
+	InterfaceIndex  uint32
+	ARPHardwareType uint16
+	PacketType      layers.LinuxSLLPacketType
+	Addr            net.HardwareAddr
+}
+
+func (s *linuxSLL2) LayerType() gopacket.LayerType { return layerTypeLinuxSLL2 }
+
+func (s *linuxSLL2) CanDecode() gopacket.LayerClass { return layerTypeLinuxSLL2 }
+
+func (s *linuxSLL2) NextLayerType() gopacket.LayerType { return s.Protocol.LayerType() }
+
+func (s *linuxSLL2) DecodeFromBytes(data []byte, df gopacket.DecodeFeedback) error {
+	if len(data) < sll2HeaderLen {
+		return errors.New("Linux SLL2 packet too small")
+	}
+	s.Protocol = layers.EthernetType(be.Uint16(data[0:]))
+	s.InterfaceIndex = be.Uint32(data[4:])
+	s.ARPHardwareType = be.Uint16(data[8:])
+	s.PacketType = layers.LinuxSLLPacketType(data[10])
+	addrLen := int(data[11])
+	if addrLen > 8 {
+		addrLen = 8
+	}
+	s.Addr = net.HardwareAddr(data[12 : 12+addrLen])
+	s.BaseLayer = layers.BaseLayer{Contents: data[:sll2HeaderLen], Payload: data[sll2HeaderLen:]}
+	return nil
+}
+
+func decodeLinuxSLL2(data []byte, p gopacket.PacketBuilder) error {
+	s := &linuxSLL2{}
+	if err := s.DecodeFromBytes(data, p); err != nil {
+		return err
+	}
+	p.AddLayer(s)
+	return p.NextDecoder(s.Protocol)
+}
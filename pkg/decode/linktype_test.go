@@ -0,0 +1,86 @@
+package decode
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/Kkevsterrr/gopacket"
+	"github.com/Kkevsterrr/gopacket/layers"
+)
+
+// sll returns a Linux cooked v1 header of the given protocol
+func sll(protocol uint16) []byte {
+	data := []byte{0, 0, 0, 1, 0, 6, 2, 0, 0, 0, 0, 1, 0, 0, 0, 0}
+	binary.BigEndian.PutUint16(data[14:], protocol)
+	return data
+}
+
+// sll2 returns a Linux cooked v2 header of the given protocol and interface
+func sll2(protocol uint16, index uint32) []byte {
+	data := []byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0, 6, 2, 0, 0, 0, 0, 1, 0, 0}
+	binary.BigEndian.PutUint16(data, protocol)
+	binary.BigEndian.PutUint32(data[4:], index)
+	return data
+}
+
+func TestUnitLinkTypes(t *testing.T) {
+	ipv4 := innerFrame(t)[14:]
+	ipv6 := ipv6Packet(t)
+	join := func(headers ...[]byte) []byte {
+		var data []byte
+		for _, header := range headers {
+			data = append(data, header...)
+		}
+		return data
+	}
+
+	tests := []struct {
+		name     string
+		linkType layers.LinkType
+		data     []byte
+		tunnels  *Tunnels
+		index    uint32
+		expected string // encapsulation
+	}{
+		{name: "sll", linkType: layers.LinkTypeLinuxSLL, data: join(sll(0x0800), ipv4)},
+		{name: "sll2", linkType: LinkTypeLinuxSLL2, data: join(sll2(0x0800, 3), ipv4), index: 3},
+		{name: "sll2 ipv6", linkType: LinkTypeLinuxSLL2, data: join(sll2(0x86dd, 4), ipv6), index: 4},
+		{name: "sll2 vlan", linkType: LinkTypeLinuxSLL2, data: join(sll2(0x8100, 5), []byte{0, 7, 0x08, 0}, ipv4),
+			tunnels: &Tunnels{VLAN: true}, index: 5, expected: "vlan=7"},
+		{name: "sll2 mpls slow path", linkType: LinkTypeLinuxSLL2, data: join(sll2(0x8847, 6), []byte{0, 1, 0x01, 64}, ipv4),
+			index: 6},
+		{name: "raw", linkType: layers.LinkTypeRaw, data: ipv4},
+		{name: "raw ipv6", linkType: layers.LinkTypeRaw, data: ipv6},
+		{name: "dlt raw", linkType: dltRaw, data: ipv6},
+		{name: "ipv4", linkType: layers.LinkTypeIPv4, data: ipv4},
+		{name: "ipv6", linkType: layers.LinkTypeIPv6, data: ipv6},
+		{name: "raw gre", linkType: layers.LinkTypeIPv4, data: outerIPv4(47, []byte{0, 0, 0x08, 0}, ipv4),
+			tunnels: &Tunnels{GRE: true}, expected: "gre 172.16.0.1->172.16.0.2"},
+		{name: "null", linkType: layers.LinkTypeNull, data: join([]byte{2, 0, 0, 0}, ipv4)},
+		{name: "loop ipv6", linkType: layers.LinkTypeLoop, data: join([]byte{0, 0, 0, 24}, ipv6)},
+		{name: "null vlan", linkType: layers.LinkTypeNull, data: join([]byte{30, 0, 0, 0}, ipv6),
+			tunnels: &Tunnels{VLAN: true}},
+	}
+
+	// Packets are decoded in turn with the link type of each, as for pcapng
+	// files mixing link types
+	packet := NewPacket(layers.LinkTypeEthernet)
+	for _, test := range tests {
+		packet.SetLinkType(test.linkType)
+		packet.SetTunnels(test.tunnels)
+		_ = packet.DecodeCopy(test.data, gopacket.CaptureInfo{})
+
+		if packet.TCP == nil || packet.TCP.DstPort != 80 {
+			t.Fatalf("Expected TCP to port 80 but got %v for %s", packet.TCP, test.name)
+		}
+		if req := packet.HTTPRequest(); req == nil {
+			t.Fatalf("Expected HTTP request but got %v for %s", req, test.name)
+		}
+		if packet.InterfaceIndex != test.index {
+			t.Fatalf("Expected %v but got %v for %s", test.index, packet.InterfaceIndex, test.name)
+		}
+		if s := packet.Encapsulation.String(); s != test.expected {
+			t.Fatalf("Expected %v but got %v for %s", test.expected, s, test.name)
+		}
+	}
+}
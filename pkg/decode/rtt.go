@@ -0,0 +1,38 @@
+package decode
+
+import (
+	"time"
+
+	"github.com/Kkevsterrr/gopacket"
+	"github.com/Kkevsterrr/gopacket/layers"
+)
+
+// HandshakeRTT measures the round trip time between the sensor and the client,
+// from the server's SYN-ACK to the client's ACK of it. A retransmitted SYN-ACK
+// restarts the measurement, as the client acknowledges the last copy it got.
+type HandshakeRTT struct {
+	synAck   time.Time
+	rtt      time.Duration
+	measured bool
+}
+
+// ProcessPacket updates the measurement with a packet of the client, or of the
+// server if client is false
+func (h *HandshakeRTT) ProcessPacket(tcp *layers.TCP, ci gopacket.CaptureInfo, client bool) {
+	switch {
+	case h.measured || tcp.RST:
+	case !client:
+		if tcp.SYN && tcp.ACK {
+			h.synAck = ci.Timestamp
+		}
+	case tcp.ACK && !tcp.SYN:
+		if !h.synAck.IsZero() {
+			h.rtt, h.measured = ci.Timestamp.Sub(h.synAck), true
+		}
+	}
+}
+
+// RTT returns the round trip time, and whether it was measured
+func (h *HandshakeRTT) RTT() (time.Duration, bool) {
+	return h.rtt, h.measured
+}
@@ -0,0 +1,75 @@
+package decode
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Kkevsterrr/gopacket"
+	"github.com/Kkevsterrr/gopacket/layers"
+)
+
+func TestUnitHandshakeRTT(t *testing.T) {
+	start := time.Unix(1597964040, 0)
+	type packet struct {
+		tcp    layers.TCP
+		client bool
+		at     time.Duration
+	}
+	var tests = []struct {
+		packets  []packet
+		rtt      time.Duration
+		measured bool
+	}{
+		{ // Handshake
+			packets: []packet{
+				{client: true, tcp: layers.TCP{SYN: true}},
+				{tcp: layers.TCP{SYN: true, ACK: true}, at: 50 * time.Millisecond},
+				{client: true, tcp: layers.TCP{ACK: true}, at: 150 * time.Millisecond},
+				{tcp: layers.TCP{SYN: true, ACK: true}, at: 400 * time.Millisecond},
+				{client: true, tcp: layers.TCP{PSH: true, ACK: true}, at: 450 * time.Millisecond},
+			},
+			rtt: 100 * time.Millisecond, measured: true,
+		},
+		{ // SYN-ACK retransmitted, as the first one was lost past the sensor
+			packets: []packet{
+				{client: true, tcp: layers.TCP{SYN: true}},
+				{tcp: layers.TCP{SYN: true, ACK: true}, at: 50 * time.Millisecond},
+				{client: true, tcp: layers.TCP{SYN: true}, at: time.Second},
+				{tcp: layers.TCP{SYN: true, ACK: true}, at: 1050 * time.Millisecond},
+				{client: true, tcp: layers.TCP{ACK: true}, at: 1150 * time.Millisecond},
+			},
+			rtt: 100 * time.Millisecond, measured: true,
+		},
+		{ // Request acknowledging the SYN-ACK
+			packets: []packet{
+				{client: true, tcp: layers.TCP{SYN: true}},
+				{tcp: layers.TCP{SYN: true, ACK: true}, at: 50 * time.Millisecond},
+				{client: true, tcp: layers.TCP{PSH: true, ACK: true}, at: 80 * time.Millisecond},
+			},
+			rtt: 30 * time.Millisecond, measured: true,
+		},
+		{ // Reset instead of an ACK
+			packets: []packet{
+				{client: true, tcp: layers.TCP{SYN: true}},
+				{tcp: layers.TCP{SYN: true, ACK: true}, at: 50 * time.Millisecond},
+				{client: true, tcp: layers.TCP{RST: true, ACK: true}, at: 80 * time.Millisecond},
+			},
+		},
+		{ // No SYN-ACK seen
+			packets: []packet{
+				{client: true, tcp: layers.TCP{SYN: true}},
+				{client: true, tcp: layers.TCP{ACK: true}, at: 80 * time.Millisecond},
+			},
+		},
+	}
+
+	for i, test := range tests {
+		var h HandshakeRTT
+		for _, packet := range test.packets {
+			h.ProcessPacket(&packet.tcp, gopacket.CaptureInfo{Timestamp: start.Add(packet.at)}, packet.client)
+		}
+		if rtt, measured := h.RTT(); rtt != test.rtt || measured != test.measured {
+			t.Fatalf("test %d: Expected %v %v but got %v %v", i, test.rtt, test.measured, rtt, measured)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package decode
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/Kkevsterrr/gopacket/layers"
+)
+
+// TCPOptions are the TCP options of a packet
+type TCPOptions struct {
+	MSS           uint16      // Maximum segment size, 0 if absent
+	WindowScale   int         // Window scale shift count, -1 if absent
+	SACKPermitted bool        // Whether SACK is permitted
+	SACK          [][2]uint32 // Left and right edges of SACK blocks
+	Timestamps    bool        // Whether the timestamps option is present
+	TSval, TSecr  uint32      // Timestamp value and echo reply
+	Other         []uint8     // Kinds of other options, and of malformed ones
+}
+
+// Clone returns a copy of the options that outlives the packet
+func (o *TCPOptions) Clone() TCPOptions {
+	c := *o
+	c.SACK = append([][2]uint32(nil), o.SACK...)
+	c.Other = append([]uint8(nil), o.Other...)
+	return c
+}
+
+func (o *TCPOptions) String() string {
+	var fields []string
+	if o.MSS != 0 {
+		fields = append(fields, fmt.Sprintf("mss=%d", o.MSS))
+	}
+	if o.WindowScale >= 0 {
+		fields = append(fields, fmt.Sprintf("ws=%d", o.WindowScale))
+	}
+	if o.SACKPermitted {
+		fields = append(fields, "sackok")
+	}
+	for _, block := range o.SACK {
+		fields = append(fields, fmt.Sprintf("sack=%d-%d", block[0], block[1]))
+	}
+	if o.Timestamps {
+		fields = append(fields, fmt.Sprintf("ts=%d/%d", o.TSval, o.TSecr))
+	}
+	for _, kind := range o.Other {
+		fields = append(fields, fmt.Sprintf("kind=%d", kind))
+	}
+	return strings.Join(fields, " ")
+}
+
+func (o *TCPOptions) reset() {
+	o.MSS, o.WindowScale, o.SACKPermitted = 0, -1, false
+	o.SACK, o.Other = o.SACK[:0], o.Other[:0]
+	o.Timestamps, o.TSval, o.TSecr = false, 0, 0
+}
+
+// parse fills the options from those gopacket decoded
+func (o *TCPOptions) parse(options []layers.TCPOption) {
+	o.reset()
+	for _, option := range options {
+		data := option.OptionData
+		switch option.OptionType {
+		case layers.TCPOptionKindEndList, layers.TCPOptionKindNop:
+			continue
+		case layers.TCPOptionKindMSS:
+			if len(data) == 2 {
+				o.MSS = be.Uint16(data)
+				continue
+			}
+		case layers.TCPOptionKindWindowScale:
+			if len(data) == 1 {
+				o.WindowScale = int(data[0])
+				continue
+			}
+		case layers.TCPOptionKindSACKPermitted:
+			if len(data) == 0 {
+				o.SACKPermitted = true
+				continue
+			}
+		case layers.TCPOptionKindSACK:
+			if len(data) > 0 && len(data)%8 == 0 {
+				for i := 0; i < len(data); i += 8 {
+					o.SACK = append(o.SACK, [2]uint32{be.Uint32(data[i:]), be.Uint32(data[i+4:])})
+				}
+				continue
+			}
+		case layers.TCPOptionKindTimestamps:
+			if len(data) == 8 {
+				o.Timestamps, o.TSval, o.TSecr = true, be.Uint32(data), be.Uint32(data[4:])
+				continue
+			}
+		}
+		o.Other = append(o.Other, uint8(option.OptionType))
+	}
+}
+
+// TCPOptions returns the TCP options of the packet, or nil without TCP layer.
+// The options are parsed on the first call only.
+func (p *Packet) TCPOptions() *TCPOptions {
+	if p.TCP == nil {
+		return nil
+	}
+	if !p.tcpOptionsDone {
+		p.tcpOptionsDone = true
+		p.tcpOptions.parse(p.TCP.Options)
+	}
+	return &p.tcpOptions
+}
@@ -0,0 +1,47 @@
+package decode
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/Kkevsterrr/gopacket"
+	"github.com/Kkevsterrr/gopacket/layers"
+)
+
+func TestUnitTCPOptions(t *testing.T) {
+	// A SYN's options, followed by a SACK block and an unknown option
+	options := []byte{
+		2, 4, 0x05, 0xb4, // MSS 1460
+		4, 2, // SACK permitted
+		8, 10, 0, 0, 0, 100, 0, 0, 0, 0, // Timestamps
+		1,       // NOP
+		3, 3, 7, // Window scale
+		5, 10, 0, 0, 0, 1, 0, 0, 0, 2, // SACK block
+		30, 4, 0, 0, // Multipath TCP
+		3, 2, // Malformed window scale
+		0, 0, 0, 0, // End of options
+	}
+	frame := innerFrame(t)
+	data := append(append(append([]byte(nil), frame[:54]...), options...), frame[54:]...)
+	be.PutUint16(data[16:], uint16(len(data)-14))
+	data[46] = byte(20+len(options)) / 4 << 4
+
+	packet := NewPacket(layers.LinkTypeEthernet)
+	_ = packet.Decode(data, gopacket.CaptureInfo{})
+	expected := TCPOptions{MSS: 1460, WindowScale: 7, SACKPermitted: true, SACK: [][2]uint32{{1, 2}},
+		Timestamps: true, TSval: 100, Other: []uint8{30, 3}}
+	o := packet.TCPOptions()
+	if o == nil || !reflect.DeepEqual(o.Clone(), expected) {
+		t.Fatalf("Expected %v but got %v", expected, o)
+	}
+	if s := o.String(); s != "mss=1460 ws=7 sackok sack=1-2 ts=100/0 kind=30 kind=3" {
+		t.Fatalf("Expected %v but got %v", "mss=1460 ws=7 sackok sack=1-2 ts=100/0 kind=30 kind=3", s)
+	}
+
+	// Options are parsed again for the next packet
+	_ = packet.Decode(frame, gopacket.CaptureInfo{})
+	expected = TCPOptions{WindowScale: -1}
+	if o := packet.TCPOptions(); !reflect.DeepEqual(o.Clone(), expected) || o.String() != "" {
+		t.Fatalf("Expected %v but got %v", expected, o)
+	}
+}
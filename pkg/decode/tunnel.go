@@ -0,0 +1,343 @@
+package decode
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+
+	"github.com/Kkevsterrr/gopacket"
+	"github.com/Kkevsterrr/gopacket/layers"
+)
+
+// Tunnels selects the encapsulations removed before packets are decoded, so
+// that mirrored traffic is assembled by its inner flows
+type Tunnels struct {
+	VLAN   bool // 802.1Q and 802.1ad (QinQ) tags
+	MPLS   bool // MPLS label stacks carrying IP
+	GRE    bool // GRE carrying IP or Ethernet
+	ERSPAN bool // ERSPAN type I, II and III, over GRE
+	VXLAN  bool
+	Geneve bool
+
+	VXLANPort  uint16 // UDP destination port of VXLAN
+	GenevePort uint16 // UDP destination port of GENEVE
+}
+
+// Encapsulation describes the outer headers removed from a packet. Tunnel
+// metadata is that of the innermost tunnel.
+type Encapsulation struct {
+	VLANs     []uint16      // VLAN IDs, outermost first
+	Labels    []uint32      // MPLS labels, outermost first
+	Tunnel    string        // gre, erspan1, erspan2, erspan3, vxlan or geneve
+	Outer     gopacket.Flow // IP endpoints of the tunnel
+	Key       uint32        // GRE key
+	SessionID uint16        // ERSPAN session ID
+	VNI       uint32        // VXLAN or GENEVE network identifier
+}
+
+// Empty returns whether no header was removed
+func (e *Encapsulation) Empty() bool {
+	return len(e.VLANs) == 0 && len(e.Labels) == 0 && e.Tunnel == ""
+}
+
+// Equal returns whether both packets were encapsulated the same way
+func (e *Encapsulation) Equal(o *Encapsulation) bool {
+	if len(e.VLANs) != len(o.VLANs) || len(e.Labels) != len(o.Labels) {
+		return false
+	}
+	for i := range e.VLANs {
+		if e.VLANs[i] != o.VLANs[i] {
+			return false
+		}
+	}
+	for i := range e.Labels {
+		if e.Labels[i] != o.Labels[i] {
+			return false
+		}
+	}
+	return e.Tunnel == o.Tunnel && e.Outer == o.Outer && e.Key == o.Key && e.SessionID == o.SessionID && e.VNI == o.VNI
+}
+
+// Clone returns a copy of the encapsulation that outlives the packet
+func (e *Encapsulation) Clone() Encapsulation {
+	c := *e
+	c.VLANs = append([]uint16(nil), e.VLANs...)
+	c.Labels = append([]uint32(nil), e.Labels...)
+	return c
+}
+
+func (e *Encapsulation) String() string {
+	var fields []string
+	for _, vlan := range e.VLANs {
+		fields = append(fields, fmt.Sprintf("vlan=%d", vlan))
+	}
+	for _, label := range e.Labels {
+		fields = append(fields, fmt.Sprintf("mpls=%d", label))
+	}
+	if e.Tunnel != "" {
+		fields = append(fields, e.Tunnel, e.Outer.String())
+	}
+	if e.Key != 0 {
+		fields = append(fields, fmt.Sprintf("key=%d", e.Key))
+	}
+	if e.SessionID != 0 {
+		fields = append(fields, fmt.Sprintf("session=%d", e.SessionID))
+	}
+	if e.VNI != 0 {
+		fields = append(fields, fmt.Sprintf("vni=%d", e.VNI))
+	}
+	return strings.Join(fields, " ")
+}
+
+func (e *Encapsulation) reset() {
+	e.VLANs, e.Labels = e.VLANs[:0], e.Labels[:0]
+	e.Tunnel, e.Outer = "", gopacket.Flow{}
+	e.Key, e.SessionID, e.VNI = 0, 0, 0
+}
+
+// Tunnel protocols carried by GRE and UDP
+const (
+	ipProtocolGRE = 47
+	ipProtocolUDP = 17
+
+	greProtocolEthernet = 0x6558 // Transparent Ethernet bridging
+	greProtocolERSPAN   = 0x88be // ERSPAN type I and II
+	greProtocolERSPAN3  = 0x22eb
+
+	// Bound on the headers walked, against crafted packets
+	maxHeaders = 32
+)
+
+var be = binary.BigEndian
+
+// etherLayer returns the layer of an EtherType decapsulation knows about
+func etherLayer(etherType uint16) gopacket.LayerType {
+	switch layers.EthernetType(etherType) {
+	case layers.EthernetTypeIPv4:
+		return layers.LayerTypeIPv4
+	case layers.EthernetTypeIPv6:
+		return layers.LayerTypeIPv6
+	case layers.EthernetTypeDot1Q, layers.EthernetTypeQinQ, 0x9100:
+		return layers.LayerTypeDot1Q
+	case layers.EthernetTypeMPLSUnicast, layers.EthernetTypeMPLSMulticast:
+		return layers.LayerTypeMPLS
+	case greProtocolEthernet:
+		return layers.LayerTypeEthernet
+	}
+	return gopacket.LayerTypeZero
+}
+
+// ipLayer returns the layer of an IP header, told by its version
+func ipLayer(data []byte) gopacket.LayerType {
+	if len(data) > 0 {
+		switch data[0] >> 4 {
+		case 4:
+			return layers.LayerTypeIPv4
+		case 6:
+			return layers.LayerTypeIPv6
+		}
+	}
+	return gopacket.LayerTypeZero
+}
+
+// decapsulate walks the headers at the start of data, removing the enabled
+// encapsulations and recording them in p.Encapsulation. It returns the data
+// left, starting with an Ethernet or IP header, and its layer. ok is false when
+// nothing was removed.
+func (p *Packet) decapsulate(data []byte) (inner []byte, first gopacket.LayerType, ok bool) {
+	var next gopacket.LayerType
+	off := 0
+	switch p.linkType {
+	case layers.LinkTypeEthernet:
+		next = layers.LayerTypeEthernet
+	case layers.LinkTypeLinuxSLL:
+		if len(data) < 16 {
+			return data, 0, false
+		}
+		off, next = 16, etherLayer(be.Uint16(data[14:]))
+	case LinkTypeLinuxSLL2:
+		if len(data) < sll2HeaderLen {
+			return data, 0, false
+		}
+		off, next = sll2HeaderLen, etherLayer(be.Uint16(data))
+	case layers.LinkTypeNull, layers.LinkTypeLoop:
+		// Loopback headers only tell IP versions apart
+		if len(data) < 4 {
+			return data, 0, false
+		}
+		off, next = 4, ipLayer(data[4:])
+	default:
+		if !rawLinkType(p.linkType) {
+			return data, 0, false
+		}
+		next = ipLayer(data)
+	}
+	return p.decapsulateFrom(data, off, next)
+}
+
+// decapsulateFrom is decapsulate starting with the header of the given layer at
+// data[off:]
+func (p *Packet) decapsulateFrom(data []byte, off int, next gopacket.LayerType) (inner []byte, first gopacket.LayerType, ok bool) {
+	t, e := p.tunnels, &p.Encapsulation
+
+	// Decoding resumes at the last Ethernet or IP header reached
+	start, removed := 0, false
+	for i := 0; i < maxHeaders; i++ {
+		switch next {
+		case layers.LayerTypeEthernet:
+			if len(data) < off+14 {
+				return data[start:], first, removed
+			}
+			start, first = off, next
+			next = etherLayer(be.Uint16(data[off+12:]))
+			off += 14
+		case layers.LayerTypeDot1Q:
+			if !t.VLAN || len(data) < off+4 {
+				return data[start:], first, removed
+			}
+			e.VLANs = append(e.VLANs, be.Uint16(data[off:])&0x0fff)
+			next = etherLayer(be.Uint16(data[off+2:]))
+			off += 4
+			removed = true
+		case layers.LayerTypeMPLS:
+			if !t.MPLS {
+				return data[start:], first, removed
+			}
+			for bottom := false; !bottom; off += 4 {
+				if len(data) < off+4 {
+					return data[start:], first, removed
+				}
+				entry := be.Uint32(data[off:])
+				e.Labels = append(e.Labels, entry>>12)
+				bottom = entry&0x100 != 0
+			}
+			next = ipLayer(data[off:])
+			removed = true
+		case layers.LayerTypeIPv4, layers.LayerTypeIPv6:
+			var protocol byte
+			var src, dst []byte
+			var endpoint gopacket.EndpointType
+			ipOff := off
+			if next == layers.LayerTypeIPv4 {
+				if len(data) < off+20 {
+					return data[start:], first, removed
+				}
+				headerLen := int(data[off]&0x0f) * 4
+				// Fragments are decapsulated once reassembled
+				if headerLen < 20 || len(data) < off+headerLen || be.Uint16(data[off+6:])&0x3fff != 0 {
+					return data[start:], first, removed
+				}
+				protocol, src, dst, endpoint = data[off+9], data[off+12:off+16], data[off+16:off+20], layers.EndpointIPv4
+				off += headerLen
+			} else {
+				if len(data) < off+40 {
+					return data[start:], first, removed
+				}
+				protocol, src, dst, endpoint = data[off+6], data[off+8:off+24], data[off+24:off+40], layers.EndpointIPv6
+				off += 40
+			}
+			start, first = ipOff, next
+			if next, off = p.tunnel(data, off, protocol); next == gopacket.LayerTypeZero {
+				return data[start:], first, removed
+			}
+			e.Outer = gopacket.NewFlow(endpoint, src, dst)
+			removed = true
+		default:
+			return data[start:], first, removed
+		}
+	}
+	return data[start:], first, removed
+}
+
+// tunnel removes the header of an enabled tunnel carried by IP at data[off:],
+// recording its metadata. It returns the layer of the tunneled data and its
+// offset, or gopacket.LayerTypeZero if there is no such tunnel.
+func (p *Packet) tunnel(data []byte, off int, protocol byte) (gopacket.LayerType, int) {
+	t, e := p.tunnels, &p.Encapsulation
+	switch protocol {
+	case ipProtocolGRE:
+		if len(data) < off+4 {
+			return gopacket.LayerTypeZero, off
+		}
+		flags, greProtocol := be.Uint16(data[off:]), be.Uint16(data[off+2:])
+		// Version 0 only, without source routing
+		if flags&0x4007 != 0 {
+			return gopacket.LayerTypeZero, off
+		}
+		headerLen := 4
+		if flags&0x8000 != 0 { // Checksum
+			headerLen += 4
+		}
+		var key uint32
+		if flags&0x2000 != 0 {
+			if len(data) < off+headerLen+4 {
+				return gopacket.LayerTypeZero, off
+			}
+			key = be.Uint32(data[off+headerLen:])
+			headerLen += 4
+		}
+		sequence := flags&0x1000 != 0
+		if sequence {
+			headerLen += 4
+		}
+		off += headerLen
+		switch greProtocol {
+		case greProtocolERSPAN, greProtocolERSPAN3:
+			if !t.ERSPAN {
+				return gopacket.LayerTypeZero, off
+			}
+			name, headerLen := "erspan1", 0
+			if greProtocol == greProtocolERSPAN3 {
+				name, headerLen = "erspan3", 12
+			} else if sequence {
+				name, headerLen = "erspan2", 8
+			}
+			if len(data) < off+headerLen {
+				return gopacket.LayerTypeZero, off
+			}
+			e.Tunnel, e.Key, e.SessionID, e.VNI = name, key, 0, 0
+			if headerLen > 0 {
+				e.SessionID = be.Uint16(data[off+2:]) & 0x03ff
+			}
+			// ERSPAN III may be followed by a platform specific subheader
+			if greProtocol == greProtocolERSPAN3 && data[off+11]&0x01 != 0 {
+				headerLen += 8
+			}
+			return layers.LayerTypeEthernet, off + headerLen
+		default:
+			next := etherLayer(greProtocol)
+			if !t.GRE || next != layers.LayerTypeEthernet && next != layers.LayerTypeIPv4 && next != layers.LayerTypeIPv6 {
+				return gopacket.LayerTypeZero, off
+			}
+			e.Tunnel, e.Key, e.SessionID, e.VNI = "gre", key, 0, 0
+			return next, off
+		}
+	case ipProtocolUDP:
+		if len(data) < off+16 {
+			return gopacket.LayerTypeZero, off
+		}
+		port := be.Uint16(data[off+2:])
+		off += 8
+		switch {
+		case t.VXLAN && port == t.VXLANPort:
+			// The I flag marks a valid network identifier
+			if data[off]&0x08 == 0 {
+				return gopacket.LayerTypeZero, off
+			}
+			e.Tunnel, e.Key, e.SessionID, e.VNI = "vxlan", 0, 0, be.Uint32(data[off+4:])>>8
+			return layers.LayerTypeEthernet, off + 8
+		case t.Geneve && port == t.GenevePort:
+			if data[off]>>6 != 0 {
+				return gopacket.LayerTypeZero, off
+			}
+			headerLen := 8 + int(data[off]&0x3f)*4
+			next := etherLayer(be.Uint16(data[off+2:]))
+			if len(data) < off+headerLen || next != layers.LayerTypeEthernet && next != layers.LayerTypeIPv4 && next != layers.LayerTypeIPv6 {
+				return gopacket.LayerTypeZero, off
+			}
+			e.Tunnel, e.Key, e.SessionID, e.VNI = "geneve", 0, 0, be.Uint32(data[off+4:])>>8
+			return next, off + headerLen
+		}
+	}
+	return gopacket.LayerTypeZero, off
+}
@@ -0,0 +1,131 @@
+package decode
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/Kkevsterrr/gopacket"
+	"github.com/Kkevsterrr/gopacket/layers"
+)
+
+// innerFrame returns an Ethernet frame of a TCP packet from 10.0.0.1:40000 to
+// 192.0.2.1:80 carrying a payload
+func innerFrame(t *testing.T) []byte {
+	eth := &layers.Ethernet{SrcMAC: net.HardwareAddr{2, 0, 0, 0, 0, 1}, DstMAC: net.HardwareAddr{2, 0, 0, 0, 0, 2},
+		EthernetType: layers.EthernetTypeIPv4}
+	ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolTCP,
+		SrcIP: net.IP{10, 0, 0, 1}, DstIP: net.IP{192, 0, 2, 1}}
+	tcp := &layers.TCP{SrcPort: 40000, DstPort: 80, Seq: 1, PSH: true, ACK: true, Window: 512}
+	if err := tcp.SetNetworkLayerForChecksum(ip); err != nil {
+		t.Fatal(err)
+	}
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, eth, ip, tcp, gopacket.Payload("GET / HTTP/1.1\r\n\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// ether returns an Ethernet header followed by the given headers
+func ether(etherType uint16, headers ...[]byte) []byte {
+	data := []byte{2, 0, 0, 0, 0, 3, 2, 0, 0, 0, 0, 4, 0, 0}
+	binary.BigEndian.PutUint16(data[12:], etherType)
+	for _, header := range headers {
+		data = append(data, header...)
+	}
+	return data
+}
+
+// outerIPv4 returns an IPv4 header from 172.16.0.1 to 172.16.0.2 followed by
+// the given headers
+func outerIPv4(protocol byte, headers ...[]byte) []byte {
+	data := []byte{0x45, 0, 0, 0, 0, 0, 0x40, 0, 64, protocol, 0, 0, 172, 16, 0, 1, 172, 16, 0, 2}
+	for _, header := range headers {
+		data = append(data, header...)
+	}
+	binary.BigEndian.PutUint16(data[2:], uint16(len(data)))
+	return data
+}
+
+// udp returns a UDP header to the given port followed by the given headers
+func udp(port uint16, headers ...[]byte) []byte {
+	data := []byte{0x30, 0x39, 0, 0, 0, 0, 0, 0}
+	binary.BigEndian.PutUint16(data[2:], port)
+	for _, header := range headers {
+		data = append(data, header...)
+	}
+	binary.BigEndian.PutUint16(data[4:], uint16(len(data)))
+	return data
+}
+
+func TestUnitDecapsulate(t *testing.T) {
+	inner := innerFrame(t)
+	innerIP := inner[14:]
+	all := &Tunnels{VLAN: true, MPLS: true, GRE: true, ERSPAN: true, VXLAN: true, Geneve: true,
+		VXLANPort: 4789, GenevePort: 6081}
+	vxlan := outerIPv4(17, udp(4789, []byte{0x08, 0, 0, 0, 0, 0, 100, 0}, inner))
+
+	tests := []struct {
+		name     string
+		linkType layers.LinkType
+		data     []byte
+		tunnels  *Tunnels
+		expected string // encapsulation, or "" if the inner packet is not decoded
+	}{
+		{name: "qinq", data: ether(0x88a8, []byte{0, 100, 0x81, 0}, []byte{0, 10, 0x08, 0}, innerIP),
+			tunnels: all, expected: "vlan=100 vlan=10"},
+		{name: "mpls", data: ether(0x8847, []byte{0, 1, 0, 64}, []byte{0, 1, 0x11, 64}, innerIP),
+			tunnels: all, expected: "mpls=16 mpls=17"},
+		{name: "gre", data: ether(0x0800, outerIPv4(47, []byte{0x20, 0, 0x08, 0, 0, 0, 0, 7}, innerIP)),
+			tunnels: all, expected: "gre 172.16.0.1->172.16.0.2 key=7"},
+		{name: "gre ethernet", linkType: layers.LinkTypeRaw, data: outerIPv4(47, []byte{0, 0, 0x65, 0x58}, inner),
+			tunnels: all, expected: "gre 172.16.0.1->172.16.0.2"},
+		{name: "erspan2", data: ether(0x0800, outerIPv4(47, []byte{0x10, 0, 0x88, 0xbe, 0, 0, 0, 1},
+			[]byte{0x10, 0, 0, 5, 0, 0, 0, 0}, inner)),
+			tunnels: all, expected: "erspan2 172.16.0.1->172.16.0.2 session=5"},
+		{name: "erspan3", data: ether(0x0800, outerIPv4(47, []byte{0, 0, 0x22, 0xeb},
+			[]byte{0x20, 0, 0, 6, 0, 0, 0, 0, 0, 0, 0, 1}, make([]byte, 8), inner)),
+			tunnels: all, expected: "erspan3 172.16.0.1->172.16.0.2 session=6"},
+		{name: "vxlan", data: ether(0x0800, vxlan),
+			tunnels: all, expected: "vxlan 172.16.0.1->172.16.0.2 vni=100"},
+		{name: "geneve", data: ether(0x0800, outerIPv4(17, udp(6081, []byte{1, 0, 0x65, 0x58, 0, 0, 200, 0},
+			make([]byte, 4), inner))),
+			tunnels: all, expected: "geneve 172.16.0.1->172.16.0.2 vni=200"},
+		{name: "vlan vxlan", data: ether(0x8100, []byte{0, 20, 0x08, 0}, vxlan),
+			tunnels: all, expected: "vlan=20 vxlan 172.16.0.1->172.16.0.2 vni=100"},
+		{name: "vxlan disabled", data: ether(0x0800, vxlan), tunnels: &Tunnels{VLAN: true}},
+		{name: "vxlan other port", data: ether(0x0800, vxlan), tunnels: &Tunnels{VXLAN: true, VXLANPort: 8472}},
+		{name: "no tunnels", data: ether(0x0800, vxlan)},
+	}
+
+	for _, test := range tests {
+		linkType := test.linkType
+		if linkType == 0 {
+			linkType = layers.LinkTypeEthernet
+		}
+		packet := NewPacket(linkType)
+		packet.SetTunnels(test.tunnels)
+		_ = packet.Decode(test.data, gopacket.CaptureInfo{})
+
+		if s := packet.Encapsulation.String(); s != test.expected {
+			t.Fatalf("Expected %v but got %v for %s", test.expected, s, test.name)
+		}
+		if test.expected == "" {
+			if packet.TCP != nil {
+				t.Fatalf("Expected %v but got %v for %s", nil, packet.TCP, test.name)
+			}
+			continue
+		}
+		if packet.TCP == nil || packet.TCP.SrcPort != 40000 || packet.TCP.DstPort != 80 {
+			t.Fatalf("Expected TCP 40000->80 but got %v for %s", packet.TCP, test.name)
+		}
+		if flow := packet.NetworkFlow().String(); flow != "10.0.0.1->192.0.2.1" {
+			t.Fatalf("Expected %v but got %v for %s", "10.0.0.1->192.0.2.1", flow, test.name)
+		}
+		if req := packet.HTTPRequest(); req == nil {
+			t.Fatalf("Expected HTTP request but got %v for %s", req, test.name)
+		}
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"strings"
 	"tripwire/pkg/config"
+	"tripwire/pkg/decode"
 
 	"github.com/Kkevsterrr/gopacket"
 	"github.com/Kkevsterrr/gopacket/layers"
@@ -38,6 +39,9 @@ const (
 	SignatureWIN
 	SignatureTime
 	SignaturePacketCount
+	SignatureTSval
+	SignatureRTT
+	SignatureECH
 )
 
 var signatureMap = map[string]SignatureType{
@@ -46,6 +50,9 @@ var signatureMap = map[string]SignatureType{
 	"win":         SignatureWIN,
 	"time":        SignatureTime,
 	"packetcount": SignaturePacketCount,
+	"tsval":       SignatureTSval,
+	"rtt":         SignatureRTT,
+	"ech":         SignatureECH,
 }
 
 type DetectorFactory interface {
@@ -58,10 +65,12 @@ type Detector interface {
 	fmt.Stringer
 	json.Marshaler
 	Label() string // metrics label
-	ProcessPacket(packet gopacket.Packet, tcp *layers.TCP, ci gopacket.CaptureInfo, dir reassembly.TCPFlowDirection)
+	ProcessPacket(packet *decode.Packet, tcp *layers.TCP, ci gopacket.CaptureInfo, dir reassembly.TCPFlowDirection)
 	ProcessReassembled(sg *reassembly.ScatterGather, ac *reassembly.AssemblerContext, dir reassembly.TCPFlowDirection)
-	ProtocolDetected() bool  // whether or not protocol is detected
-	SignatureDetected() bool // whether or not signature detects disruption
+	ProtocolDetected() bool            // whether or not protocol is detected
+	SignatureDetected() bool           // whether or not signature detects disruption
+	ValidOutcome(outcome Outcome) bool // whether or not the verdict holds for streams ending this way
+	Record()                           // called once the stream ended in a way the verdict holds for
 }
 
 type detectorFactory struct {
@@ -71,14 +80,22 @@ type detectorFactory struct {
 	signature SignatureType
 
 	// extra options
-	timeThresholdMs int // time detector
-	packetThreshold int // packetCount detector
+	timeThresholdMs int       // time detector
+	packetThreshold int       // packetCount detector
+	rttThreshold    int       // rtt detector
+	echRates        *echRates // ech detector, shared by its detectors
+
+	// stream outcomes for which verdicts are valid
+	outcomes map[Outcome]bool
 }
 
 type detector struct {
 	// label for metrics
 	label string
 
+	// stream outcomes for which verdicts are valid
+	outcomes map[Outcome]bool
+
 	// protocols
 	anyProtocol bool
 	http        *httpProtocol
@@ -92,6 +109,9 @@ type detector struct {
 	win          *windowSignature
 	time         *TimeSignature
 	packetCount  *PacketCountSignature
+	tsval        *tsvalSignature
+	rtt          *rttSignature
+	ech          *echSignature
 }
 
 func NewDetectorFactory(cfg config.DetectorConfig) (DetectorFactory, error) {
@@ -109,13 +129,47 @@ func NewDetectorFactory(cfg config.DetectorConfig) (DetectorFactory, error) {
 	f.port = cfg.Port
 	f.timeThresholdMs = cfg.TimeThresholdMs
 	f.packetThreshold = cfg.PacketThreshold
+	f.rttThreshold = cfg.RTTThreshold
+	if f.signature == SignatureECH {
+		if cfg.ECH == nil {
+			return nil, fmt.Errorf("[Config] Missing ECH parameters for detector %s\n", cfg.Name)
+		}
+		f.echRates = newECHRates(cfg.ECH)
+	}
+
+	f.outcomes = make(map[Outcome]bool)
+	if len(cfg.Outcomes) > 0 {
+		for _, s := range cfg.Outcomes {
+			outcome, err := ParseOutcome(s)
+			if err != nil {
+				return nil, err
+			}
+			f.outcomes[outcome] = true
+		}
+	} else {
+		for _, outcome := range defaultOutcomes(f.signature) {
+			f.outcomes[outcome] = true
+		}
+	}
 
 	return &f, nil
 }
 
+// defaultOutcomes returns the stream outcomes for which a signature's verdict
+// is valid. Signatures measuring the whole stream need it to have ended on its
+// own rather than being truncated, evicted or cut short by the parser stopping.
+func defaultOutcomes(signature SignatureType) []Outcome {
+	switch signature {
+	case SignatureTime, SignaturePacketCount, SignatureECH:
+		return []Outcome{OutcomeFIN, OutcomeRST, OutcomeIdle}
+	}
+	return Outcomes
+}
+
 func (f *detectorFactory) NewDetector(net, transport gopacket.Flow, tcp *layers.TCP) Detector {
 	var d detector
 	d.label = f.label
+	d.outcomes = f.outcomes
 
 	switch f.protocol {
 	case ProtocolHTTP:
@@ -139,6 +193,12 @@ func (f *detectorFactory) NewDetector(net, transport gopacket.Flow, tcp *layers.
 		d.time = newTimeSignature(f.timeThresholdMs)
 	case SignaturePacketCount:
 		d.packetCount = newPacketCountSignature(f.packetThreshold)
+	case SignatureTSval:
+		d.tsval = newTSvalSignature()
+	case SignatureRTT:
+		d.rtt = newRTTSignature(f.rttThreshold)
+	case SignatureECH:
+		d.ech = newECHSignature(f.echRates, net.Src())
 	case SignatureAny:
 		d.anySignature = true
 	}
@@ -168,7 +228,7 @@ func (d *detector) Label() string {
 	return d.label
 }
 
-func (d *detector) ProcessPacket(packet gopacket.Packet, tcp *layers.TCP,
+func (d *detector) ProcessPacket(packet *decode.Packet, tcp *layers.TCP,
 	ci gopacket.CaptureInfo, dir reassembly.TCPFlowDirection) {
 	// protocols
 	if d.http != nil {
@@ -197,11 +257,24 @@ func (d *detector) ProcessPacket(packet gopacket.Packet, tcp *layers.TCP,
 	if d.packetCount != nil {
 		d.packetCount.processPacket(tcp, dir)
 	}
+	if d.tsval != nil {
+		d.tsval.processPacket(tcp, packet.TCPOptions(), ci, dir)
+	}
+	if d.rtt != nil {
+		d.rtt.processPacket(tcp, ci, dir)
+	}
+	if d.ech != nil {
+		d.ech.processPacket(tcp, dir)
+	}
 }
 
 func (d *detector) ProcessReassembled(sg *reassembly.ScatterGather,
 	ac *reassembly.AssemblerContext, dir reassembly.TCPFlowDirection) {
-	// no current signatures process the reassembled payload
+	if d.ech != nil {
+		length, _ := (*sg).Lengths()
+		_, _, _, skip := (*sg).Info()
+		d.ech.processReassembled(dir, skip, (*sg).Fetch(length))
+	}
 }
 
 func (d *detector) ProtocolDetected() (detected bool) {
@@ -223,6 +296,18 @@ func (d *detector) ProtocolDetected() (detected bool) {
 	return
 }
 
+func (d *detector) ValidOutcome(outcome Outcome) bool {
+	return d.outcomes[outcome]
+}
+
+// Record adds the stream to the statistics signatures compare streams with,
+// before the verdicts of the streams are queried
+func (d *detector) Record() {
+	if d.ech != nil {
+		d.ech.record()
+	}
+}
+
 func (d *detector) SignatureDetected() (detected bool) {
 	if d.anySignature {
 		return true
@@ -239,5 +324,14 @@ func (d *detector) SignatureDetected() (detected bool) {
 	if d.packetCount != nil && d.packetCount.detected() {
 		detected = true
 	}
+	if d.tsval != nil && d.tsval.detected() {
+		detected = true
+	}
+	if d.rtt != nil && d.rtt.detected() {
+		detected = true
+	}
+	if d.ech != nil && d.ech.detected() {
+		detected = true
+	}
 	return
 }
@@ -61,3 +61,52 @@ func TestUnitDetectorFactory(t *testing.T) {
 		t.Fatalf("Expected %v but got %v", "any_8080_any", relevantDetectors[0].Label())
 	}
 }
+
+func TestUnitValidOutcome(t *testing.T) {
+	var tests = []struct {
+		cfg     config.DetectorConfig
+		valid   []Outcome
+		invalid []Outcome
+	}{
+		{ // Signatures looking for specific packets hold for any outcome
+			cfg:   config.DetectorConfig{Name: "http_80_rstacks", Signature: "RSTACKs", Protocol: "HTTP", Port: 80},
+			valid: Outcomes,
+		},
+		{ // Signatures measuring the whole stream need it to have ended on its own
+			cfg:     config.DetectorConfig{Name: "http_80_time", Signature: "Time", Protocol: "HTTP", Port: 80},
+			valid:   []Outcome{OutcomeFIN, OutcomeRST, OutcomeIdle},
+			invalid: []Outcome{OutcomeMaxPackets, OutcomeShutdown, OutcomeEvicted},
+		},
+		{ // Configured outcomes override the defaults
+			cfg: config.DetectorConfig{Name: "http_80_packetcount", Signature: "PacketCount", Protocol: "HTTP", Port: 80,
+				Outcomes: []string{"RST", "shutdown"}},
+			valid:   []Outcome{OutcomeRST, OutcomeShutdown},
+			invalid: []Outcome{OutcomeFIN, OutcomeMaxPackets, OutcomeIdle},
+		},
+	}
+
+	netFlow, _ := gopacket.FlowFromEndpoints(layers.NewIPEndpoint(net.IP{1, 2, 3, 4}), layers.NewIPEndpoint(net.IP{5, 6, 7, 8}))
+	transportFlow, _ := gopacket.FlowFromEndpoints(layers.NewTCPPortEndpoint(4444), layers.NewTCPPortEndpoint(80))
+	for _, test := range tests {
+		df, err := NewDetectorFactory(test.cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		d := df.NewDetector(netFlow, transportFlow, nil)
+		for _, outcome := range test.valid {
+			if !d.ValidOutcome(outcome) {
+				t.Fatalf("%s: Expected %v to be valid", test.cfg.Name, outcome)
+			}
+		}
+		for _, outcome := range test.invalid {
+			if d.ValidOutcome(outcome) {
+				t.Fatalf("%s: Expected %v to be invalid", test.cfg.Name, outcome)
+			}
+		}
+	}
+
+	if _, err := NewDetectorFactory(config.DetectorConfig{Name: "http_80_time", Signature: "Time", Protocol: "HTTP", Port: 80,
+		Outcomes: []string{"timeout"}}); err == nil {
+		t.Fatalf("Expected an error for an invalid outcome")
+	}
+}
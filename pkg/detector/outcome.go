@@ -0,0 +1,53 @@
+package detector
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Outcome is the reason a stream ended, which determines whether the data a
+// detector saw is complete enough for its verdict
+type Outcome int
+
+const (
+	OutcomeFIN        Outcome = iota // closed by a FIN
+	OutcomeRST                       // closed by a RST
+	OutcomeMaxPackets                // truncated after the maximum number of packets
+	OutcomeIdle                      // closed by the parser after a period of inactivity
+	OutcomeShutdown                  // still open when the parser stopped
+	OutcomeEvicted                   // evicted to make room for new streams
+)
+
+var outcomeMap = map[string]Outcome{
+	"fin":         OutcomeFIN,
+	"rst":         OutcomeRST,
+	"max_packets": OutcomeMaxPackets,
+	"idle":        OutcomeIdle,
+	"shutdown":    OutcomeShutdown,
+	"evicted":     OutcomeEvicted,
+}
+
+// Outcomes lists every outcome
+var Outcomes = []Outcome{OutcomeFIN, OutcomeRST, OutcomeMaxPackets, OutcomeIdle, OutcomeShutdown, OutcomeEvicted}
+
+func ParseOutcome(s string) (Outcome, error) {
+	outcome, ok := outcomeMap[strings.ToLower(s)]
+	if !ok {
+		return 0, fmt.Errorf("[Config] Invalid Outcome %s", s)
+	}
+	return outcome, nil
+}
+
+func (o Outcome) String() string {
+	for s, outcome := range outcomeMap {
+		if outcome == o {
+			return s
+		}
+	}
+	return "unknown"
+}
+
+func (o Outcome) MarshalJSON() ([]byte, error) {
+	return json.Marshal(o.String())
+}
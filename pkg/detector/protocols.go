@@ -3,13 +3,10 @@ package detector
 import (
 	"bufio"
 	"bytes"
-	"net/http"
 	"net/mail"
+	"tripwire/pkg/decode"
 
 	"golang.org/x/net/dns/dnsmessage"
-
-	"github.com/Kkevsterrr/gopacket"
-	"github.com/Kkevsterrr/gopacket/layers"
 )
 
 // http detects HTTP streams
@@ -25,18 +22,13 @@ func (p *httpProtocol) detected() bool {
 	return p.isDetected
 }
 
-func (p *httpProtocol) processPacket(packet gopacket.Packet) {
+func (p *httpProtocol) processPacket(packet *decode.Packet) {
 	if p.isDetected {
 		// skip processing packet if already detected
 		return
 	}
 	// Attempt to parse an HTTP request from the packet
-	if app := packet.ApplicationLayer(); app != nil {
-		buf := bufio.NewReader(bytes.NewReader(app.Payload()))
-		_, err := http.ReadRequest(buf)
-		if err != nil {
-			return
-		}
+	if packet.HTTPRequest() != nil {
 		p.isDetected = true
 	}
 }
@@ -54,31 +46,14 @@ func (p *httpsProtocol) detected() bool {
 	return p.isDetected
 }
 
-func (p *httpsProtocol) processPacket(packet gopacket.Packet) {
+func (p *httpsProtocol) processPacket(packet *decode.Packet) {
 	if p.isDetected {
 		// skip processing packet if already detected
 		return
 	}
 	// Attempt to parse a TLS Client Hello from the packet
-	if app := packet.ApplicationLayer(); app != nil {
-		var tls layers.TLS
-		var decoded []gopacket.LayerType
-		parser := gopacket.NewDecodingLayerParser(layers.LayerTypeTLS, &tls)
-		err := parser.DecodeLayers(app.LayerContents(), &decoded)
-		if err != nil {
-			return
-		}
-		for _, layerType := range decoded {
-			if layerType == layers.LayerTypeTLS {
-				if len(tls.Handshake) > 0 {
-					hs := tls.Handshake[0]
-					if hs.HandshakeType == 1 {
-						p.isDetected = true
-						return
-					}
-				}
-			}
-		}
+	if packet.ClientHello() != nil {
+		p.isDetected = true
 	}
 }
 
@@ -95,14 +70,14 @@ func (p *smtpProtocol) detected() bool {
 	return p.isDetected
 }
 
-func (p *smtpProtocol) processPacket(packet gopacket.Packet) {
+func (p *smtpProtocol) processPacket(packet *decode.Packet) {
 	if p.isDetected {
 		// skip processing packet if already detected
 		return
 	}
 	// Attempt to parse a HTTP request from the packet
-	if app := packet.ApplicationLayer(); app != nil {
-		buf := bufio.NewReader(bytes.NewReader(app.Payload()))
+	if payload := packet.Payload(); len(payload) > 0 {
+		buf := bufio.NewReader(bytes.NewReader(payload))
 		_, err := mail.ReadMessage(buf)
 		if err != nil {
 			return
@@ -124,15 +99,15 @@ func (p *dnsProtocol) detected() bool {
 	return p.isDetected
 }
 
-func (p *dnsProtocol) processPacket(packet gopacket.Packet) {
+func (p *dnsProtocol) processPacket(packet *decode.Packet) {
 	if p.isDetected {
 		// skip processing packet if already detected
 		return
 	}
 	// Attempt to parse a DNS message from the packet
-	if app := packet.ApplicationLayer(); app != nil {
+	if payload := packet.Payload(); len(payload) > 0 {
 		var parser dnsmessage.Parser
-		_, err := parser.Start(app.Payload())
+		_, err := parser.Start(payload)
 		if err != nil {
 			return
 		}
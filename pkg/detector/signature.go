@@ -1,10 +1,14 @@
 package detector
 
 import (
+	"container/list"
 	"github.com/Kkevsterrr/gopacket"
 	"github.com/Kkevsterrr/gopacket/layers"
 	"github.com/Kkevsterrr/gopacket/reassembly"
+	"sync"
 	"time"
+	"tripwire/pkg/config"
+	"tripwire/pkg/decode"
 )
 
 // RST--RST-ACK signature, exhibited by the GFW (China)
@@ -67,6 +71,147 @@ func (h *windowSignature) detected() bool {
 	return h.PSH && h.WIN
 }
 
+// Bounds of TCP timestamp clocks, one tick per second to one per millisecond
+// (RFC 7323, section 5.4)
+const (
+	minClockHz = 1
+	maxClockHz = 1000
+)
+
+// Tolerances of the tsval signature: the clock rate is estimated over at least
+// minRateSpan and minRateTicks, and timestamps may be off the prediction by
+// clockSlack of elapsed time plus clockJitter
+const (
+	minRateSpan  = 100 * time.Millisecond
+	minRateTicks = 10
+	clockSlack   = 0.2
+	clockJitter  = 100 * time.Millisecond
+)
+
+// TCP timestamp signature, of packets injected without the client's TCP
+// timestamps. Genuine client packets give the client's TSval and clock rate,
+// and RST, FIN and data packets whose TSval is missing, decreasing or off the
+// client's clock are flagged. Timestamps are only missed if the server did not
+// refuse them.
+type tsvalSignature struct {
+	PSH, anomaly bool
+
+	timestamps bool // whether the client uses TCP timestamps
+	refused    bool // whether the server refused them in its SYN-ACK
+	first      tsvalSample
+	last       tsvalSample
+	rate       float64 // ticks per second, 0 until estimated
+}
+
+type tsvalSample struct {
+	tsval uint32
+	time  time.Time
+}
+
+func newTSvalSignature() *tsvalSignature {
+	return &tsvalSignature{}
+}
+
+func (s *tsvalSignature) processPacket(tcp *layers.TCP, options *decode.TCPOptions, ci gopacket.CaptureInfo,
+	dir reassembly.TCPFlowDirection) {
+	if dir != reassembly.TCPDirClientToServer {
+		if tcp.SYN && !options.Timestamps {
+			s.refused = true
+		}
+		return
+	}
+	if tcp.PSH {
+		s.PSH = true
+	}
+	checked := tcp.RST || tcp.FIN || len(tcp.Payload) > 0
+	if !options.Timestamps {
+		if checked && s.timestamps && !s.refused {
+			s.anomaly = true
+		}
+		return
+	}
+	sample := tsvalSample{tsval: options.TSval, time: ci.Timestamp}
+	if !s.timestamps {
+		s.timestamps, s.first, s.last = true, sample, sample
+		return
+	}
+	if checked && !s.consistent(sample) {
+		s.anomaly = true
+		return
+	}
+	// Retransmissions may repeat older timestamps
+	if int32(sample.tsval-s.last.tsval) < 0 || sample.time.Before(s.last.time) {
+		return
+	}
+	s.last = sample
+	span, ticks := s.last.time.Sub(s.first.time), s.last.tsval-s.first.tsval
+	if span >= minRateSpan && ticks >= minRateTicks {
+		s.rate = float64(ticks) / span.Seconds()
+	}
+}
+
+// consistent returns whether a timestamp follows the client's clock
+func (s *tsvalSignature) consistent(sample tsvalSample) bool {
+	ticks := float64(int32(sample.tsval - s.last.tsval))
+	if ticks < 0 {
+		return false
+	}
+	elapsed := sample.time.Sub(s.last.time).Seconds()
+	if elapsed < 0 {
+		elapsed = 0
+	}
+	slack := elapsed*clockSlack + clockJitter.Seconds()
+	if s.rate == 0 {
+		return ticks >= minClockHz*(elapsed-slack)-1 && ticks <= maxClockHz*(elapsed+slack)+1
+	}
+	expected := s.rate * elapsed
+	return ticks >= expected-s.rate*slack-1 && ticks <= expected+s.rate*slack+1
+}
+
+func (s *tsvalSignature) detected() bool {
+	return s.PSH && s.anomaly
+}
+
+// RTT signature, of client RSTs arriving sooner after the client's request than
+// the handshake RTT, from the SYN-ACK to the client's ACK, would allow a reply
+// to the request to reach the client and be reset
+type rttSignature struct {
+	threshold float64 // fraction of the RTT
+
+	handshake decode.HandshakeRTT
+	psh       time.Time
+	anomaly   bool
+}
+
+// Threshold defined in percent of the RTT
+func newRTTSignature(threshold int) *rttSignature {
+	return &rttSignature{
+		threshold: float64(threshold) / 100,
+	}
+}
+
+func (s *rttSignature) processPacket(tcp *layers.TCP, ci gopacket.CaptureInfo, dir reassembly.TCPFlowDirection) {
+	s.handshake.ProcessPacket(tcp, ci, dir == reassembly.TCPDirClientToServer)
+	if dir != reassembly.TCPDirClientToServer {
+		return
+	}
+	switch {
+	case tcp.RST:
+		rtt, ok := s.handshake.RTT()
+		if !s.psh.IsZero() && ok && float64(ci.Timestamp.Sub(s.psh)) < float64(rtt)*s.threshold {
+			s.anomaly = true
+		}
+	case tcp.PSH:
+		if s.psh.IsZero() {
+			s.psh = ci.Timestamp
+		}
+	}
+}
+
+func (s *rttSignature) detected() bool {
+	return s.anomaly
+}
+
 // Connection Time Signature
 type TimeSignature struct {
 	threshold       time.Duration
@@ -130,3 +275,159 @@ func (s *PacketCountSignature) processPacket(tcp *layers.TCP, dir reassembly.TCP
 func (s *PacketCountSignature) detected() bool {
 	return s.pshPacket && s.packetCount <= s.threshold && s.packetCount != 0
 }
+
+// ECH signature, of streams offering Encrypted Client Hello (or legacy ESNI)
+// that failed, from client prefixes where ECH streams fail more often than the
+// others. A stream fails when the client sent a request but the server never
+// answered it. Whether the stream offered ECH is only decided once its
+// ClientHello, which may span several segments, was reassembled.
+type echSignature struct {
+	rates    *echRates
+	prefix   string
+	hello    decode.ClientHelloBuffer
+	decided  bool
+	ech      bool
+	request  bool
+	response bool
+
+	recorded bool
+}
+
+func newECHSignature(rates *echRates, client gopacket.Endpoint) *echSignature {
+	return &echSignature{
+		rates:  rates,
+		prefix: rates.prefix(client),
+	}
+}
+
+func (s *echSignature) processPacket(tcp *layers.TCP, dir reassembly.TCPFlowDirection) {
+	if len(tcp.Payload) == 0 {
+		return
+	}
+	if dir == reassembly.TCPDirServerToClient {
+		s.response = s.request
+		return
+	}
+	s.request = true
+}
+
+func (s *echSignature) processReassembled(dir reassembly.TCPFlowDirection, skip int, payload []byte) {
+	if s.decided || dir != reassembly.TCPDirClientToServer {
+		return
+	}
+	s.hello.ProcessReassembled(skip, payload)
+	clientHello, done := s.hello.ClientHello()
+	if !done {
+		return
+	}
+	s.decided = true
+	if clientHello != nil {
+		for _, extension := range clientHello.Extensions {
+			if extension == decode.ExtensionECH || extension == decode.ExtensionESNI {
+				s.ech = true
+			}
+		}
+	}
+}
+
+// record counts the stream in the rates of its prefix, once it ended in a way
+// its verdict holds for. Streams whose ClientHello was cut short are left out,
+// as whether they offered ECH is unknown.
+func (s *echSignature) record() {
+	if !s.recorded && s.request && s.decided {
+		s.recorded = true
+		s.rates.add(s.prefix, s.ech, !s.response)
+	}
+}
+
+// detected returns whether the stream failed while the ECH streams of its
+// prefix recorded so far fail more often than the others
+func (s *echSignature) detected() bool {
+	return s.ech && s.request && !s.response && s.rates.exceeded(s.prefix)
+}
+
+// echRates counts the ECH and non-ECH streams that failed by client prefix, for
+// the most recently recorded prefixes. It is shared by the detectors of a
+// factory and safe for concurrent use.
+type echRates struct {
+	minStreams             int
+	threshold              float64
+	prefixLen4, prefixLen6 int
+	maxPrefixes            int
+
+	sync.Mutex
+	counts map[string]*list.Element // prefix -> element of prefixes
+	lru    *list.List               // *echPrefix, most recently recorded first
+}
+
+type echPrefix struct {
+	prefix string
+	counts [2]echCount // non-ECH and ECH streams
+}
+
+type echCount struct {
+	streams, failed int
+}
+
+func newECHRates(cfg *config.ECHConfig) *echRates {
+	return &echRates{
+		minStreams:  cfg.MinStreams,
+		threshold:   cfg.RateThreshold,
+		prefixLen4:  cfg.PrefixLen4,
+		prefixLen6:  cfg.PrefixLen6,
+		maxPrefixes: cfg.MaxPrefixes,
+		counts:      make(map[string]*list.Element),
+		lru:         list.New(),
+	}
+}
+
+// prefix returns the client address truncated to the prefix length
+func (r *echRates) prefix(client gopacket.Endpoint) string {
+	return decode.ClientPrefix(client, r.prefixLen4, r.prefixLen6)
+}
+
+// add counts a stream of the prefix. Past the maximum number of prefixes, the
+// counts of the least recently recorded prefix are dropped.
+func (r *echRates) add(prefix string, ech, failed bool) {
+	r.Lock()
+	defer r.Unlock()
+	element, ok := r.counts[prefix]
+	if ok {
+		r.lru.MoveToFront(element)
+	} else {
+		element = r.lru.PushFront(&echPrefix{prefix: prefix})
+		r.counts[prefix] = element
+		if r.maxPrefixes > 0 && r.lru.Len() > r.maxPrefixes {
+			oldest := r.lru.Remove(r.lru.Back()).(*echPrefix)
+			delete(r.counts, oldest.prefix)
+		}
+	}
+	counts := &element.Value.(*echPrefix).counts
+	count := &counts[0]
+	if ech {
+		count = &counts[1]
+	}
+	count.streams++
+	if failed {
+		count.failed++
+	}
+}
+
+// exceeded returns whether enough ECH and non-ECH streams of the prefix were
+// recorded for ECH streams to fail more often than the others by the threshold
+func (r *echRates) exceeded(prefix string) bool {
+	r.Lock()
+	defer r.Unlock()
+	element, ok := r.counts[prefix]
+	if !ok {
+		return false
+	}
+	counts := element.Value.(*echPrefix).counts
+	if counts[0].streams < r.minStreams || counts[1].streams < r.minStreams {
+		return false
+	}
+	rate := func(count echCount) float64 {
+		return float64(count.failed) / float64(count.streams)
+	}
+	return rate(counts[1])-rate(counts[0]) >= r.threshold
+}
@@ -3,6 +3,8 @@ package detector
 import (
 	"testing"
 	"time"
+	"tripwire/pkg/config"
+	"tripwire/pkg/decode"
 
 	"github.com/Kkevsterrr/gopacket"
 	"github.com/Kkevsterrr/gopacket/layers"
@@ -280,3 +282,269 @@ func TestUnitPacketCount(t *testing.T) {
 		}
 	}
 }
+
+func TestUnitTSval(t *testing.T) {
+	start := time.Now()
+	type packet struct {
+		tcp      layers.TCP
+		dir      reassembly.TCPFlowDirection
+		ts       *decode.TCPOptions // options of the packet, none if nil
+		at       time.Duration
+		detected bool
+	}
+	// ts returns the timestamps option of a client whose 1000 Hz clock reads
+	// 5000 at the start
+	ts := func(at time.Duration) *decode.TCPOptions {
+		return &decode.TCPOptions{WindowScale: -1, Timestamps: true, TSval: 5000 + uint32(at/time.Millisecond)}
+	}
+	// connection returns a connection where the client sends a request after
+	// a 200ms round trip, then the given packet
+	connection := func(last packet) []packet {
+		return []packet{
+			{dir: reassembly.TCPDirClientToServer, tcp: layers.TCP{SYN: true}, ts: ts(0)},
+			{dir: reassembly.TCPDirServerToClient, tcp: layers.TCP{SYN: true, ACK: true}, ts: ts(0), at: 100 * time.Millisecond},
+			{dir: reassembly.TCPDirClientToServer, tcp: layers.TCP{ACK: true}, ts: ts(200 * time.Millisecond), at: 200 * time.Millisecond},
+			{dir: reassembly.TCPDirClientToServer, tcp: layers.TCP{PSH: true, ACK: true, BaseLayer: layers.BaseLayer{Payload: []byte("GET")}},
+				ts: ts(201 * time.Millisecond), at: 201 * time.Millisecond},
+			last,
+		}
+	}
+	var tests = [][]packet{
+		// RST without the timestamps option
+		connection(packet{dir: reassembly.TCPDirClientToServer, tcp: layers.TCP{RST: true, ACK: true}, at: 300 * time.Millisecond,
+			detected: true}),
+		// RST of the client
+		connection(packet{dir: reassembly.TCPDirClientToServer, tcp: layers.TCP{RST: true, ACK: true}, ts: ts(2 * time.Second),
+			at: 2 * time.Second}),
+		// FIN whose TSval went back
+		connection(packet{dir: reassembly.TCPDirClientToServer, tcp: layers.TCP{FIN: true, ACK: true}, ts: ts(100 * time.Millisecond),
+			at: 2 * time.Second, detected: true}),
+		// RST whose TSval is far ahead of the client's clock
+		connection(packet{dir: reassembly.TCPDirClientToServer, tcp: layers.TCP{RST: true}, ts: ts(time.Minute),
+			at: 2 * time.Second, detected: true}),
+		// RST whose TSval is behind the client's clock
+		connection(packet{dir: reassembly.TCPDirClientToServer, tcp: layers.TCP{RST: true}, ts: ts(time.Second),
+			at: 5 * time.Second, detected: true}),
+		// RST of the server
+		connection(packet{dir: reassembly.TCPDirServerToClient, tcp: layers.TCP{RST: true}, at: 300 * time.Millisecond}),
+		{ // Server refusing timestamps
+			{dir: reassembly.TCPDirClientToServer, tcp: layers.TCP{SYN: true}, ts: ts(0)},
+			{dir: reassembly.TCPDirServerToClient, tcp: layers.TCP{SYN: true, ACK: true}, at: 100 * time.Millisecond},
+			{dir: reassembly.TCPDirClientToServer, tcp: layers.TCP{PSH: true, ACK: true}, at: 200 * time.Millisecond},
+			{dir: reassembly.TCPDirClientToServer, tcp: layers.TCP{RST: true, ACK: true}, at: 300 * time.Millisecond},
+		},
+		{ // Client without timestamps
+			{dir: reassembly.TCPDirClientToServer, tcp: layers.TCP{SYN: true}},
+			{dir: reassembly.TCPDirClientToServer, tcp: layers.TCP{PSH: true, ACK: true}, at: 200 * time.Millisecond},
+			{dir: reassembly.TCPDirClientToServer, tcp: layers.TCP{RST: true, ACK: true}, at: 300 * time.Millisecond},
+		},
+	}
+
+	for testN, packets := range tests {
+		signature := newTSvalSignature()
+
+		for i, packet := range packets {
+			options := packet.ts
+			if options == nil {
+				options = &decode.TCPOptions{WindowScale: -1}
+			}
+			signature.processPacket(&packet.tcp, options, gopacket.CaptureInfo{Timestamp: start.Add(packet.at)}, packet.dir)
+			if packet.detected != signature.detected() {
+				t.Errorf("Run: %d, packet %d: got %v, want %v", testN+1, i+1, signature.detected(), packet.detected)
+			}
+		}
+	}
+}
+
+func TestUnitRTT(t *testing.T) {
+	start := time.Now()
+	type packet struct {
+		tcp      layers.TCP
+		dir      reassembly.TCPFlowDirection
+		at       time.Duration
+		detected bool
+	}
+	// connection returns a connection with a 100ms handshake RTT where the
+	// client sends a request at 200ms, then the given packet
+	connection := func(last packet) []packet {
+		return []packet{
+			{dir: reassembly.TCPDirClientToServer, tcp: layers.TCP{SYN: true}},
+			{dir: reassembly.TCPDirServerToClient, tcp: layers.TCP{SYN: true, ACK: true}, at: 50 * time.Millisecond},
+			{dir: reassembly.TCPDirClientToServer, tcp: layers.TCP{ACK: true}, at: 150 * time.Millisecond},
+			{dir: reassembly.TCPDirClientToServer, tcp: layers.TCP{PSH: true, ACK: true}, at: 200 * time.Millisecond},
+			last,
+		}
+	}
+	var tests = []struct {
+		threshold int
+		packets   []packet
+	}{
+		// RST right after the request
+		{100, connection(packet{dir: reassembly.TCPDirClientToServer, tcp: layers.TCP{RST: true, ACK: true}, at: 201 * time.Millisecond,
+			detected: true})},
+		// RST a round trip after the request
+		{100, connection(packet{dir: reassembly.TCPDirClientToServer, tcp: layers.TCP{RST: true, ACK: true}, at: 300 * time.Millisecond})},
+		// RST within a lower threshold
+		{50, connection(packet{dir: reassembly.TCPDirClientToServer, tcp: layers.TCP{RST: true}, at: 240 * time.Millisecond,
+			detected: true})},
+		// RST past a lower threshold
+		{50, connection(packet{dir: reassembly.TCPDirClientToServer, tcp: layers.TCP{RST: true}, at: 260 * time.Millisecond})},
+		// RST of the server
+		{100, connection(packet{dir: reassembly.TCPDirServerToClient, tcp: layers.TCP{RST: true}, at: 201 * time.Millisecond})},
+		{100, []packet{ // RTT not measured
+			{dir: reassembly.TCPDirClientToServer, tcp: layers.TCP{SYN: true}},
+			{dir: reassembly.TCPDirClientToServer, tcp: layers.TCP{PSH: true, ACK: true}, at: 200 * time.Millisecond},
+			{dir: reassembly.TCPDirClientToServer, tcp: layers.TCP{RST: true, ACK: true}, at: 201 * time.Millisecond},
+		}},
+		{100, []packet{ // SYN-ACK retransmitted, RST more than a round trip after the request
+			{dir: reassembly.TCPDirClientToServer, tcp: layers.TCP{SYN: true}},
+			{dir: reassembly.TCPDirServerToClient, tcp: layers.TCP{SYN: true, ACK: true}, at: 50 * time.Millisecond},
+			{dir: reassembly.TCPDirServerToClient, tcp: layers.TCP{SYN: true, ACK: true}, at: 1050 * time.Millisecond},
+			{dir: reassembly.TCPDirClientToServer, tcp: layers.TCP{ACK: true}, at: 1150 * time.Millisecond},
+			{dir: reassembly.TCPDirClientToServer, tcp: layers.TCP{PSH: true, ACK: true}, at: 1200 * time.Millisecond},
+			{dir: reassembly.TCPDirClientToServer, tcp: layers.TCP{RST: true, ACK: true}, at: 1350 * time.Millisecond},
+		}},
+		{100, []packet{ // RST before any request
+			{dir: reassembly.TCPDirClientToServer, tcp: layers.TCP{SYN: true}},
+			{dir: reassembly.TCPDirServerToClient, tcp: layers.TCP{SYN: true, ACK: true}, at: 50 * time.Millisecond},
+			{dir: reassembly.TCPDirClientToServer, tcp: layers.TCP{RST: true}, at: 51 * time.Millisecond},
+		}},
+	}
+
+	for testN, test := range tests {
+		signature := newRTTSignature(test.threshold)
+
+		for i, packet := range test.packets {
+			signature.processPacket(&packet.tcp, gopacket.CaptureInfo{Timestamp: start.Add(packet.at)}, packet.dir)
+			if packet.detected != signature.detected() {
+				t.Errorf("Run: %d, packet %d: got %v, want %v", testN+1, i+1, signature.detected(), packet.detected)
+			}
+		}
+	}
+}
+
+func TestUnitECH(t *testing.T) {
+	// clientHello returns a ClientHello with the extension, padded to length
+	// bytes by a padding extension
+	clientHello := func(extension uint16, length int) []byte {
+		hello := []byte{0x03, 0x03}
+		hello = append(hello, make([]byte, 32)...)       // random
+		hello = append(hello, 0, 0, 2, 0x13, 0x01, 1, 0) // session id, cipher suites, compression methods
+		padding := length - 9 - len(hello) - 12
+		if padding < 0 {
+			padding = 0
+		}
+		hello = append(hello, byte((8+padding)>>8), byte(8+padding), byte(extension>>8), byte(extension), 0, 0)
+		hello = append(hello, 0, 21, byte(padding>>8), byte(padding))
+		hello = append(hello, make([]byte, padding)...)
+		handshake := append([]byte{1, 0, byte(len(hello) >> 8), byte(len(hello))}, hello...)
+		return append([]byte{22, 3, 1, byte(len(handshake) >> 8), byte(len(handshake))}, handshake...)
+	}
+	// frame returns a packet of the client with the payload
+	frame := func(payload []byte) *decode.Packet {
+		ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolTCP, SrcIP: []byte{10, 0, 0, 1}, DstIP: []byte{192, 0, 2, 1}}
+		tcp := &layers.TCP{SrcPort: 40000, DstPort: 443, PSH: true, ACK: true}
+		_ = tcp.SetNetworkLayerForChecksum(ip)
+		buf := gopacket.NewSerializeBuffer()
+		opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+		if err := gopacket.SerializeLayers(buf, opts, ip, tcp, gopacket.Payload(payload)); err != nil {
+			t.Fatal(err)
+		}
+		packet := decode.NewPacket(layers.LinkTypeRaw)
+		_ = packet.DecodeCopy(buf.Bytes(), gopacket.CaptureInfo{})
+		return packet
+	}
+	ech, esni, ems := uint16(decode.ExtensionECH), uint16(decode.ExtensionESNI), uint16(23) // extended master secret
+
+	rates := newECHRates(&config.ECHConfig{MinStreams: 2, RateThreshold: 0.5, PrefixLen4: 24, PrefixLen6: 48})
+	var tests = []struct {
+		client    []byte
+		extension *uint16 // extension of the ClientHello, if any
+		segments  int     // segments the request is split across
+		truncated bool    // whether the stream ends before the ClientHello does
+		answered  bool
+		detected  bool
+	}{
+		// Streams of a prefix, in the order they end
+		{client: []byte{10, 0, 0, 1}, extension: &ems, answered: true},
+		{client: []byte{10, 0, 0, 2}, extension: &ech},
+		// Not enough non-ECH streams yet
+		{client: []byte{10, 0, 0, 3}, extension: &esni},
+		{client: []byte{10, 0, 0, 4}},
+		// ECH streams fail, others are answered
+		{client: []byte{10, 0, 0, 5}, extension: &ech, segments: 2, detected: true},
+		{client: []byte{10, 0, 0, 6}, extension: &ech, answered: true},
+		{client: []byte{10, 0, 0, 7}, extension: &ems},
+		// Whether streams cut short offered ECH is unknown, so they are not recorded
+		{client: []byte{10, 0, 0, 8}, extension: &ech, segments: 2, truncated: true},
+		// Rates of another prefix
+		{client: []byte{10, 0, 1, 1}, extension: &ech},
+	}
+
+	var signatures []*echSignature
+	for testN, test := range tests {
+		signature := newECHSignature(rates, layers.NewIPEndpoint(test.client))
+		request := []byte("GET / HTTP/1.1\r\n\r\n")
+		if test.extension != nil {
+			request = clientHello(*test.extension, 1800)
+		}
+		segments := [][]byte{request}
+		if test.segments == 2 {
+			segments = [][]byte{request[:1400], request[1400:]}
+		}
+		if test.truncated {
+			segments = segments[:1]
+		}
+		for i, segment := range segments {
+			packet := frame(segment)
+			signature.processPacket(packet.TCP, reassembly.TCPDirClientToServer)
+			signature.processReassembled(reassembly.TCPDirClientToServer, 0, segment)
+			// ECH is only decided once the whole ClientHello was seen
+			if decided := i == len(segments)-1 && !test.truncated; signature.decided != decided {
+				t.Fatalf("Run: %d, segment %d: Expected %v but got %v", testN+1, i+1, decided, signature.decided)
+			}
+		}
+		if test.answered {
+			response := frame([]byte("HTTP/1.1 200 OK\r\n\r\n"))
+			signature.processPacket(response.TCP, reassembly.TCPDirServerToClient)
+		}
+		// Querying the verdict before the stream is recorded leaves the rates alone
+		signature.detected()
+		signature.record()
+		signature.record()
+		if signature.detected() != test.detected || signature.detected() != test.detected {
+			t.Errorf("Run: %d: got %v, want %v", testN+1, signature.detected(), test.detected)
+		}
+		signatures = append(signatures, signature)
+	}
+
+	// Verdicts only depend on the streams recorded, whatever the order and number
+	// of queries
+	var forward []bool
+	for _, signature := range signatures {
+		forward = append(forward, signature.detected())
+	}
+	for i := len(signatures) - 1; i >= 0; i-- {
+		if detected := signatures[i].detected(); detected != forward[i] {
+			t.Errorf("Run: %d: got %v, want %v", i+1, detected, forward[i])
+		}
+	}
+	if counts := rates.counts["10.0.0.0/24"].Value.(*echPrefix).counts; counts != [2]echCount{{3, 2}, {4, 3}} {
+		t.Fatalf("Expected %v but got %v", [2]echCount{{3, 2}, {4, 3}}, counts)
+	}
+
+	// Past the maximum number of prefixes, the least recently recorded is dropped
+	rates = newECHRates(&config.ECHConfig{MinStreams: 1, RateThreshold: 0.5, PrefixLen4: 24, PrefixLen6: 48, MaxPrefixes: 2})
+	for _, prefix := range []string{"10.0.0.0/24", "10.0.1.0/24", "10.0.0.0/24", "10.0.2.0/24"} {
+		rates.add(prefix, true, true)
+		rates.add(prefix, false, false)
+	}
+	for prefix, expected := range map[string]bool{"10.0.0.0/24": true, "10.0.1.0/24": false, "10.0.2.0/24": true} {
+		if exceeded := rates.exceeded(prefix); exceeded != expected {
+			t.Fatalf("%s: Expected %v but got %v", prefix, expected, exceeded)
+		}
+	}
+	if rates.lru.Len() != 2 || len(rates.counts) != 2 {
+		t.Fatalf("Expected %v but got %v", 2, rates.lru.Len())
+	}
+}
@@ -0,0 +1,396 @@
+package discovery
+
+import (
+	"bufio"
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"tripwire/pkg/collector"
+	"tripwire/pkg/config"
+	"tripwire/pkg/decode"
+
+	"github.com/Kkevsterrr/gopacket"
+	"github.com/Kkevsterrr/gopacket/layers"
+	"github.com/Kkevsterrr/gopacket/reassembly"
+)
+
+// noResponse is the canonical sequence of a stream that saw no packets after
+// the client request
+const noResponse = "<none>"
+
+// Aggregator counts the distinct post-request packet sequences of streams,
+// grouped by client ASN or prefix, in order to surface unusual teardown
+// patterns that are not yet covered by a signature. Counts are kept for the
+// most recently seen groups, and reported and started anew every interval.
+// It is safe for concurrent use.
+type Aggregator struct {
+	prefixLen4, prefixLen6 int
+	maxLength              int
+	minCount               int
+	top                    int
+	maxGroups              int
+	interval               time.Duration
+	asns                   *asnTable
+
+	sync.Mutex
+	start  time.Time                // when counting started, zero until the first report
+	total  int                      // streams of the groups kept
+	counts map[string]int           // sequence -> streams of the groups kept
+	groups map[string]*list.Element // group -> element of lru
+	lru    *list.List               // *groupCounts, most recently seen first
+}
+
+// groupCounts counts the sequences of the streams of a client group
+type groupCounts struct {
+	group     string
+	total     int
+	sequences map[string]int
+}
+
+// Pattern is a teardown sequence reported for a client group
+type Pattern struct {
+	Group       string  `json:"group"`
+	Sequence    string  `json:"sequence"`
+	Count       int     `json:"count"`
+	GroupTotal  int     `json:"group_total"`
+	GlobalCount int     `json:"global_count"`
+	Lift        float64 `json:"lift"`
+}
+
+func NewAggregator(cfg config.DiscoveryConfig) (*Aggregator, error) {
+	a := &Aggregator{
+		prefixLen4: cfg.PrefixLen4,
+		prefixLen6: cfg.PrefixLen6,
+		maxLength:  cfg.MaxLength,
+		minCount:   cfg.MinCount,
+		top:        cfg.Top,
+		maxGroups:  cfg.MaxGroups,
+		interval:   cfg.Interval,
+	}
+	a.reset()
+	if cfg.ASNFile != "" {
+		f, err := os.Open(cfg.ASNFile)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		if a.asns, err = readASNTable(f); err != nil {
+			return nil, fmt.Errorf("[Config] Invalid ASN database %s: %v", cfg.ASNFile, err)
+		}
+	}
+	return a, nil
+}
+
+// reset drops all the counts
+func (a *Aggregator) reset() {
+	a.total = 0
+	a.counts = make(map[string]int)
+	a.groups = make(map[string]*list.Element)
+	a.lru = list.New()
+}
+
+// NewRecorder returns a recorder for a single stream
+func (a *Aggregator) NewRecorder() *Recorder {
+	return &Recorder{maxLength: a.maxLength}
+}
+
+// Add records the sequence of a finished stream whose client is the source of net.
+// Streams without a client request are ignored. Past the maximum number of
+// groups, the counts of the least recently seen group are dropped.
+func (a *Aggregator) Add(net gopacket.Flow, r *Recorder) {
+	if !r.request {
+		return
+	}
+	group := a.group(net.Src())
+	sequence := r.String()
+
+	a.Lock()
+	defer a.Unlock()
+	element, ok := a.groups[group]
+	if ok {
+		a.lru.MoveToFront(element)
+	} else {
+		element = a.lru.PushFront(&groupCounts{group: group, sequences: make(map[string]int)})
+		a.groups[group] = element
+		for a.maxGroups > 0 && a.lru.Len() > a.maxGroups {
+			a.drop(a.lru.Remove(a.lru.Back()).(*groupCounts))
+		}
+	}
+	g := element.Value.(*groupCounts)
+	g.total++
+	g.sequences[sequence]++
+	a.total++
+	a.counts[sequence]++
+}
+
+// drop removes the streams of a group from the global counts
+func (a *Aggregator) drop(g *groupCounts) {
+	delete(a.groups, g.group)
+	a.total -= g.total
+	for sequence, count := range g.sequences {
+		if a.counts[sequence] -= count; a.counts[sequence] == 0 {
+			delete(a.counts, sequence)
+		}
+	}
+}
+
+// group returns the ASN of the client address if known, or its truncated prefix
+func (a *Aggregator) group(client gopacket.Endpoint) string {
+	ip := net.IP(client.Raw())
+	if a.asns != nil {
+		if asn, ok := a.asns.lookup(ip); ok {
+			return fmt.Sprintf("AS%d", asn)
+		}
+	}
+	return decode.ClientPrefix(client, a.prefixLen4, a.prefixLen6)
+}
+
+// Top returns the most unusual patterns, ranked by their lift: how much more
+// frequent a sequence is within a client group than across all streams.
+func (a *Aggregator) Top() []Pattern {
+	a.Lock()
+	defer a.Unlock()
+	return a.topPatterns()
+}
+
+func (a *Aggregator) topPatterns() []Pattern {
+	var patterns []Pattern
+	for element := a.lru.Front(); element != nil; element = element.Next() {
+		g := element.Value.(*groupCounts)
+		for sequence, count := range g.sequences {
+			if count < a.minCount {
+				continue
+			}
+			globalCount := a.counts[sequence]
+			patterns = append(patterns, Pattern{
+				Group:       g.group,
+				Sequence:    sequence,
+				Count:       count,
+				GroupTotal:  g.total,
+				GlobalCount: globalCount,
+				Lift:        (float64(count) / float64(g.total)) / (float64(globalCount) / float64(a.total)),
+			})
+		}
+	}
+	sort.Slice(patterns, func(i, j int) bool {
+		if patterns[i].Lift != patterns[j].Lift {
+			return patterns[i].Lift > patterns[j].Lift
+		}
+		if patterns[i].Count != patterns[j].Count {
+			return patterns[i].Count > patterns[j].Count
+		}
+		if patterns[i].Group != patterns[j].Group {
+			return patterns[i].Group < patterns[j].Group
+		}
+		return patterns[i].Sequence < patterns[j].Sequence
+	})
+	if len(patterns) > a.top {
+		patterns = patterns[:a.top]
+	}
+	return patterns
+}
+
+// Report writes the top patterns to w and starts counting anew, once the
+// interval elapsed since counting started, so that long-running captures
+// report patterns as they go. It is called with the time of every flush.
+// Without an interval, patterns are only written at exit.
+func (a *Aggregator) Report(now time.Time, w io.Writer, outform string) error {
+	if a.interval <= 0 {
+		return nil
+	}
+	a.Lock()
+	if a.start.IsZero() {
+		a.start = now
+	}
+	if now.Sub(a.start) < a.interval {
+		a.Unlock()
+		return nil
+	}
+	patterns := a.topPatterns()
+	a.reset()
+	a.start = now
+	a.Unlock()
+	return writePatterns(w, outform, patterns)
+}
+
+// Write writes the top patterns to w, one per line, as JSON for the "json" and
+// "features" output forms, which are JSON lines, or as text
+func (a *Aggregator) Write(w io.Writer, outform string) error {
+	return writePatterns(w, outform, a.Top())
+}
+
+func writePatterns(w io.Writer, outform string, patterns []Pattern) error {
+	for _, pattern := range patterns {
+		switch outform {
+		case "json", "features":
+			bytes, err := json.Marshal(struct {
+				Discovery Pattern `json:"discovery"`
+			}{pattern})
+			if err != nil {
+				return err
+			}
+			fmt.Fprintln(w, string(bytes))
+		default:
+			fmt.Fprintf(w, "Discovery: %s [%s] %d/%d streams (%d global, lift %.2f)\n",
+				pattern.Group, pattern.Sequence, pattern.Count, pattern.GroupTotal, pattern.GlobalCount, pattern.Lift)
+		}
+	}
+	return nil
+}
+
+// Recorder canonicalizes the packets of a stream that follow the first client
+// request. Each packet is encoded as direction, flags, window bucket and TTL
+// delta from the first packet seen in the same direction, e.g. "c:RA:w16:t+3".
+type Recorder struct {
+	maxLength int
+	request   bool
+	ttl       [2]int
+	ttlSeen   [2]bool
+	elements  []string
+}
+
+func (r *Recorder) ProcessPacket(packet *decode.Packet, tcp *layers.TCP, dir reassembly.TCPFlowDirection) {
+	side := 0
+	if dir == reassembly.TCPDirServerToClient {
+		side = 1
+	}
+	ttl, ok := packetTTL(packet)
+	if ok && !r.ttlSeen[side] {
+		r.ttl[side], r.ttlSeen[side] = ttl, true
+	}
+
+	if !r.request {
+		// The sequence starts after the first client request
+		r.request = dir == reassembly.TCPDirClientToServer && len(tcp.Payload) > 0
+		return
+	}
+	if len(r.elements) >= r.maxLength {
+		return
+	}
+
+	var b strings.Builder
+	if side == 0 {
+		b.WriteString("c:")
+	} else {
+		b.WriteString("s:")
+	}
+	b.WriteString(collector.FlagString(tcp))
+	b.WriteString(":")
+	b.WriteString(windowBucket(tcp.Window))
+	if ok {
+		fmt.Fprintf(&b, ":t%+d", ttl-r.ttl[side])
+	}
+	r.elements = append(r.elements, b.String())
+}
+
+func (r *Recorder) String() string {
+	if len(r.elements) == 0 {
+		return noResponse
+	}
+	return strings.Join(r.elements, " ")
+}
+
+// windowBucket keeps small windows, which injectors tend to hard-code, exact
+// and buckets larger ones by power of two
+func windowBucket(window uint16) string {
+	if window <= 64 {
+		return fmt.Sprintf("w%d", window)
+	}
+	bucket := uint16(1)
+	for window >>= 1; window > 0; window >>= 1 {
+		bucket <<= 1
+	}
+	return fmt.Sprintf("w%d+", bucket)
+}
+
+func packetTTL(packet *decode.Packet) (int, bool) {
+	switch {
+	case packet == nil:
+		return 0, false
+	case packet.IPv4 != nil:
+		return int(packet.IPv4.TTL), true
+	case packet.IPv6 != nil:
+		return int(packet.IPv6.HopLimit), true
+	}
+	return 0, false
+}
+
+// asnTable maps IP prefixes to ASNs using longest-prefix matching
+type asnTable struct {
+	v4, v6 prefixTable
+}
+
+type prefixTable struct {
+	prefixes map[int]map[string]uint32 // prefix length -> masked IP -> ASN
+	lengths  []int                     // prefix lengths present, longest first
+}
+
+// readASNTable reads a pyasn-style database of "prefix<whitespace>asn" lines
+func readASNTable(r io.Reader) (*asnTable, error) {
+	var t asnTable
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], ";") || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("line %d: expected prefix and ASN", line)
+		}
+		_, ipNet, err := net.ParseCIDR(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		asn, err := strconv.ParseUint(fields[1], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		ones, _ := ipNet.Mask.Size()
+		if ip4 := ipNet.IP.To4(); ip4 != nil {
+			t.v4.add(ip4, ones, uint32(asn))
+		} else {
+			t.v6.add(ipNet.IP, ones, uint32(asn))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+func (t *asnTable) lookup(ip net.IP) (uint32, bool) {
+	if ip4 := ip.To4(); ip4 != nil {
+		return t.v4.lookup(ip4)
+	}
+	return t.v6.lookup(ip)
+}
+
+func (t *prefixTable) add(ip net.IP, ones int, asn uint32) {
+	if t.prefixes == nil {
+		t.prefixes = make(map[int]map[string]uint32)
+	}
+	if t.prefixes[ones] == nil {
+		t.prefixes[ones] = make(map[string]uint32)
+		t.lengths = append(t.lengths, ones)
+		sort.Sort(sort.Reverse(sort.IntSlice(t.lengths)))
+	}
+	t.prefixes[ones][string(ip)] = asn
+}
+
+func (t *prefixTable) lookup(ip net.IP) (uint32, bool) {
+	for _, ones := range t.lengths {
+		if asn, ok := t.prefixes[ones][string(ip.Mask(net.CIDRMask(ones, 8*len(ip))))]; ok {
+			return asn, true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,153 @@
+package discovery
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+	"tripwire/pkg/config"
+
+	"github.com/Kkevsterrr/gopacket"
+	"github.com/Kkevsterrr/gopacket/layers"
+	"github.com/Kkevsterrr/gopacket/reassembly"
+)
+
+func TestUnitRecorder(t *testing.T) {
+	var tests = []struct {
+		packets []struct {
+			dir reassembly.TCPFlowDirection
+			tcp layers.TCP
+		}
+		sequence string
+	}{
+		{ // No request, no sequence
+			packets: []struct {
+				dir reassembly.TCPFlowDirection
+				tcp layers.TCP
+			}{
+				{dir: reassembly.TCPDirClientToServer, tcp: layers.TCP{SYN: true, Window: 64240}},
+				{dir: reassembly.TCPDirServerToClient, tcp: layers.TCP{SYN: true, ACK: true, Window: 65535}},
+			},
+			sequence: noResponse,
+		},
+		{ // Request followed by an Airtel-style RST
+			packets: []struct {
+				dir reassembly.TCPFlowDirection
+				tcp layers.TCP
+			}{
+				{dir: reassembly.TCPDirClientToServer, tcp: layers.TCP{SYN: true, Window: 64240}},
+				{dir: reassembly.TCPDirServerToClient, tcp: layers.TCP{SYN: true, ACK: true, Window: 65535}},
+				{dir: reassembly.TCPDirClientToServer, tcp: layers.TCP{ACK: true, Window: 502}},
+				{dir: reassembly.TCPDirClientToServer,
+					tcp: layers.TCP{PSH: true, ACK: true, Window: 502, BaseLayer: layers.BaseLayer{Payload: []byte{1}}}},
+				{dir: reassembly.TCPDirServerToClient, tcp: layers.TCP{RST: true, ACK: true, Window: 16}},
+				{dir: reassembly.TCPDirServerToClient, tcp: layers.TCP{RST: true, Window: 0}},
+			},
+			sequence: "s:RA:w16 s:R:w0",
+		},
+	}
+
+	for i, test := range tests {
+		r := &Recorder{maxLength: 8}
+		for _, packet := range test.packets {
+			r.ProcessPacket(nil, &packet.tcp, packet.dir)
+		}
+		if r.String() != test.sequence {
+			t.Errorf("test %d: got %q, want %q", i, r.String(), test.sequence)
+		}
+	}
+}
+
+func TestUnitWindowBucket(t *testing.T) {
+	var tests = []struct {
+		window uint16
+		bucket string
+	}{
+		{window: 0, bucket: "w0"},
+		{window: 16, bucket: "w16"},
+		{window: 64, bucket: "w64"},
+		{window: 65, bucket: "w64+"},
+		{window: 502, bucket: "w256+"},
+		{window: 65535, bucket: "w32768+"},
+	}
+
+	for _, test := range tests {
+		if bucket := windowBucket(test.window); bucket != test.bucket {
+			t.Errorf("window %d: got %v, want %v", test.window, bucket, test.bucket)
+		}
+	}
+}
+
+func TestUnitAggregator(t *testing.T) {
+	a, err := NewAggregator(config.DiscoveryConfig{PrefixLen4: 24, PrefixLen6: 48, MaxLength: 8, MinCount: 2, Top: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.asns, err = readASNTable(strings.NewReader("; comment\n10.0.0.0/8\t64500\n10.1.0.0/16\t64501\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	add := func(client net.IP, sequence ...string) {
+		netFlow, _ := gopacket.FlowFromEndpoints(layers.NewIPEndpoint(client), layers.NewIPEndpoint(net.IP{5, 6, 7, 8}))
+		a.Add(netFlow, &Recorder{request: true, elements: sequence})
+	}
+	// A normal teardown everywhere, and an unusual one concentrated in AS64501
+	for i := 0; i < 4; i++ {
+		add(net.IP{10, 2, 0, byte(i)}, "s:FA:w256+", "c:FA:w256+")
+		add(net.IP{192, 0, 2, byte(i)}, "s:FA:w256+", "c:FA:w256+")
+	}
+	add(net.IP{10, 1, 0, 1}, "s:RA:w16")
+	add(net.IP{10, 1, 0, 2}, "s:RA:w16")
+	add(net.IP{10, 1, 0, 3}, "s:FA:w256+", "c:FA:w256+")
+
+	top := a.Top()
+	if len(top) != 1 {
+		t.Fatalf("Expected %v but got %v", 1, len(top))
+	}
+	if top[0].Group != "AS64501" || top[0].Sequence != "s:RA:w16" || top[0].Count != 2 {
+		t.Fatalf("Expected %v but got %+v", "AS64501 [s:RA:w16] x2", top[0])
+	}
+
+	if group := a.group(layers.NewIPEndpoint(net.IP{192, 0, 2, 77})); group != "192.0.2.0/24" {
+		t.Fatalf("Expected %v but got %v", "192.0.2.0/24", group)
+	}
+	if group := a.group(layers.NewIPEndpoint(net.IP{10, 9, 9, 9})); group != "AS64500" {
+		t.Fatalf("Expected %v but got %v", "AS64500", group)
+	}
+
+	// Past the maximum number of groups, the streams of the least recently seen
+	// one are no longer counted
+	a.maxGroups = 2
+	add(net.IP{192, 0, 2, 9}, "s:FA:w256+", "c:FA:w256+")
+	add(net.IP{198, 51, 100, 1}, "s:RA:w16")
+	if a.lru.Len() != 2 || len(a.groups) != 2 {
+		t.Fatalf("Expected %v but got %v", 2, a.lru.Len())
+	}
+	if _, ok := a.groups["AS64501"]; ok {
+		t.Fatalf("Expected %v but got %v", false, ok)
+	}
+	if a.total != 6 || a.counts["s:RA:w16"] != 1 || a.counts["s:FA:w256+ c:FA:w256+"] != 5 {
+		t.Fatalf("Expected %v but got %v %v", 6, a.total, a.counts)
+	}
+
+	// Patterns are reported and counted anew once the interval elapsed
+	a.interval = time.Hour
+	var b strings.Builder
+	start := time.Unix(0, 0)
+	for _, now := range []time.Time{start, start.Add(time.Minute)} {
+		if err := a.Report(now, &b, "txt"); err != nil || b.Len() != 0 {
+			t.Fatalf("Expected %v but got %v %v", "", b.String(), err)
+		}
+	}
+	if err := a.Report(start.Add(time.Hour), &b, "txt"); err != nil {
+		t.Fatal(err)
+	}
+	expected := "Discovery: 192.0.2.0/24 [s:FA:w256+ c:FA:w256+] 5/5 streams (5 global, lift 1.20)\n"
+	if b.String() != expected {
+		t.Fatalf("Expected %v but got %v", expected, b.String())
+	}
+	if a.total != 0 || len(a.counts) != 0 || a.lru.Len() != 0 || len(a.Top()) != 0 {
+		t.Fatalf("Expected %v but got %v", 0, a.total)
+	}
+}
@@ -0,0 +1,249 @@
+package features
+
+import (
+	"math"
+	"time"
+	"tripwire/pkg/decode"
+
+	"github.com/Kkevsterrr/gopacket"
+	"github.com/Kkevsterrr/gopacket/layers"
+	"github.com/Kkevsterrr/gopacket/reassembly"
+)
+
+// Features is the fixed-schema feature vector of a single stream. Every field
+// is always present in the output; values that could not be observed are -1.
+type Features struct {
+	DurationUs    int64 `json:"duration_us"`
+	RSTAfterPSHUs int64 `json:"rst_after_psh_us"` // time from the first client payload to the first RST
+
+	Client Direction `json:"client"`
+	Server Direction `json:"server"`
+}
+
+// Direction holds the features of the packets sent in one direction
+type Direction struct {
+	Packets      int     `json:"packets"`
+	PayloadBytes int     `json:"payload_bytes"`
+	Flags        Flags   `json:"flags"`
+	IATMeanUs    float64 `json:"iat_mean_us"`
+	IATStdUs     float64 `json:"iat_std_us"`
+	IATMinUs     int64   `json:"iat_min_us"`
+	IATMaxUs     int64   `json:"iat_max_us"`
+	TTLFirst     int     `json:"ttl_first"`
+	TTLDeltaMax  int     `json:"ttl_delta_max"`  // largest deviation from the first TTL
+	IPIDDeltaMax int     `json:"ipid_delta_max"` // largest step between consecutive IP IDs
+	WindowMin    int     `json:"window_min"`
+	WindowMax    int     `json:"window_max"`
+	WindowMean   float64 `json:"window_mean"`
+	WindowZero   int     `json:"window_zero"`
+}
+
+// Flags is a histogram of the TCP flags set
+type Flags struct {
+	FIN int `json:"fin"`
+	SYN int `json:"syn"`
+	RST int `json:"rst"`
+	PSH int `json:"psh"`
+	ACK int `json:"ack"`
+	URG int `json:"urg"`
+	ECE int `json:"ece"`
+	CWR int `json:"cwr"`
+	NS  int `json:"ns"`
+}
+
+// Extractor computes the features of a stream packet by packet
+type Extractor struct {
+	first, firstPSH, firstRST time.Time
+	last                      time.Time
+	dirs                      [2]direction
+}
+
+// direction holds the running state of one direction
+type direction struct {
+	packets, payloadBytes int
+	flags                 Flags
+
+	lastSeen               time.Time
+	iatCount               int
+	iatSum, iatSumSq       float64
+	iatMin, iatMax         int64
+	ttlFirst, ttlDeltaMax  int
+	ttlSeen                bool
+	ipidLast, ipidDeltaMax int
+	ipidSeen               bool
+	windowMin, windowMax   int
+	windowSum              int
+	windowZero             int
+}
+
+func NewExtractor() *Extractor {
+	return &Extractor{}
+}
+
+func (e *Extractor) ProcessPacket(packet *decode.Packet, tcp *layers.TCP, ci gopacket.CaptureInfo, dir reassembly.TCPFlowDirection) {
+	d := &e.dirs[0]
+	if dir == reassembly.TCPDirServerToClient {
+		d = &e.dirs[1]
+	}
+	ts := ci.Timestamp
+
+	if e.first.IsZero() {
+		e.first = ts
+	}
+	e.last = ts
+	if e.firstPSH.IsZero() && dir == reassembly.TCPDirClientToServer && len(tcp.Payload) > 0 {
+		e.firstPSH = ts
+	}
+	if e.firstRST.IsZero() && tcp.RST {
+		e.firstRST = ts
+	}
+
+	// Inter-arrival times
+	if d.packets > 0 {
+		iat := ts.Sub(d.lastSeen).Microseconds()
+		if d.iatCount == 0 || iat < d.iatMin {
+			d.iatMin = iat
+		}
+		if d.iatCount == 0 || iat > d.iatMax {
+			d.iatMax = iat
+		}
+		d.iatCount++
+		d.iatSum += float64(iat)
+		d.iatSumSq += float64(iat) * float64(iat)
+	}
+	d.lastSeen = ts
+
+	// IP header
+	if ttl, ipid, ok := ipHeader(packet); ok {
+		if !d.ttlSeen {
+			d.ttlFirst, d.ttlSeen = ttl, true
+		} else if delta := abs(ttl - d.ttlFirst); delta > d.ttlDeltaMax {
+			d.ttlDeltaMax = delta
+		}
+		if ipid >= 0 {
+			if d.ipidSeen {
+				if delta := abs(ipid - d.ipidLast); delta > d.ipidDeltaMax {
+					d.ipidDeltaMax = delta
+				}
+			}
+			d.ipidLast, d.ipidSeen = ipid, true
+		}
+	}
+
+	// TCP header
+	window := int(tcp.Window)
+	if d.packets == 0 || window < d.windowMin {
+		d.windowMin = window
+	}
+	if window > d.windowMax {
+		d.windowMax = window
+	}
+	if window == 0 {
+		d.windowZero++
+	}
+	d.windowSum += window
+	d.flags.add(tcp)
+
+	d.packets++
+	d.payloadBytes += len(tcp.Payload)
+}
+
+// Features returns the feature vector of the packets processed so far
+func (e *Extractor) Features() *Features {
+	f := &Features{
+		DurationUs:    e.last.Sub(e.first).Microseconds(),
+		RSTAfterPSHUs: -1,
+		Client:        e.dirs[0].features(),
+		Server:        e.dirs[1].features(),
+	}
+	if !e.firstPSH.IsZero() && !e.firstRST.IsZero() {
+		f.RSTAfterPSHUs = e.firstRST.Sub(e.firstPSH).Microseconds()
+	}
+	return f
+}
+
+func (d *direction) features() Direction {
+	f := Direction{
+		Packets:      d.packets,
+		PayloadBytes: d.payloadBytes,
+		Flags:        d.flags,
+		IATMeanUs:    -1,
+		IATStdUs:     -1,
+		IATMinUs:     -1,
+		IATMaxUs:     -1,
+		TTLFirst:     -1,
+		TTLDeltaMax:  -1,
+		IPIDDeltaMax: -1,
+		WindowMin:    -1,
+		WindowMax:    -1,
+		WindowMean:   -1,
+		WindowZero:   d.windowZero,
+	}
+	if d.iatCount > 0 {
+		mean := d.iatSum / float64(d.iatCount)
+		f.IATMeanUs = mean
+		f.IATStdUs = math.Sqrt(math.Max(d.iatSumSq/float64(d.iatCount)-mean*mean, 0))
+		f.IATMinUs, f.IATMaxUs = d.iatMin, d.iatMax
+	}
+	if d.packets > 0 {
+		f.WindowMin, f.WindowMax = d.windowMin, d.windowMax
+		f.WindowMean = float64(d.windowSum) / float64(d.packets)
+	}
+	if d.ttlSeen {
+		f.TTLFirst, f.TTLDeltaMax = d.ttlFirst, d.ttlDeltaMax
+	}
+	if d.ipidSeen {
+		f.IPIDDeltaMax = d.ipidDeltaMax
+	}
+	return f
+}
+
+func (f *Flags) add(tcp *layers.TCP) {
+	if tcp.FIN {
+		f.FIN++
+	}
+	if tcp.SYN {
+		f.SYN++
+	}
+	if tcp.RST {
+		f.RST++
+	}
+	if tcp.PSH {
+		f.PSH++
+	}
+	if tcp.ACK {
+		f.ACK++
+	}
+	if tcp.URG {
+		f.URG++
+	}
+	if tcp.ECE {
+		f.ECE++
+	}
+	if tcp.CWR {
+		f.CWR++
+	}
+	if tcp.NS {
+		f.NS++
+	}
+}
+
+// ipHeader returns the TTL and IP ID of a packet. The IP ID of IPv6 packets is -1.
+func ipHeader(packet *decode.Packet) (ttl, ipid int, ok bool) {
+	switch {
+	case packet == nil:
+		return 0, 0, false
+	case packet.IPv4 != nil:
+		return int(packet.IPv4.TTL), int(packet.IPv4.Id), true
+	case packet.IPv6 != nil:
+		return int(packet.IPv6.HopLimit), -1, true
+	}
+	return 0, 0, false
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
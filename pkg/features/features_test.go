@@ -0,0 +1,54 @@
+package features
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Kkevsterrr/gopacket"
+	"github.com/Kkevsterrr/gopacket/layers"
+	"github.com/Kkevsterrr/gopacket/reassembly"
+)
+
+func TestUnitExtractor(t *testing.T) {
+	timeNow := time.Now()
+	packets := []struct {
+		tcp layers.TCP
+		dir reassembly.TCPFlowDirection
+		ms  int
+	}{
+		{tcp: layers.TCP{SYN: true, Window: 64240}, dir: reassembly.TCPDirClientToServer, ms: 0},
+		{tcp: layers.TCP{SYN: true, ACK: true, Window: 65535}, dir: reassembly.TCPDirServerToClient, ms: 10},
+		{tcp: layers.TCP{ACK: true, Window: 502}, dir: reassembly.TCPDirClientToServer, ms: 20},
+		{tcp: layers.TCP{PSH: true, ACK: true, Window: 502, BaseLayer: layers.BaseLayer{Payload: make([]byte, 100)}},
+			dir: reassembly.TCPDirClientToServer, ms: 30},
+		{tcp: layers.TCP{RST: true, ACK: true, Window: 16}, dir: reassembly.TCPDirServerToClient, ms: 32},
+	}
+
+	e := NewExtractor()
+	if f := e.Features(); f.RSTAfterPSHUs != -1 || f.Client.IATMeanUs != -1 || f.Server.WindowMin != -1 {
+		t.Fatalf("Expected unobserved features to be -1 but got %+v", f)
+	}
+	for _, packet := range packets {
+		e.ProcessPacket(nil, &packet.tcp, gopacket.CaptureInfo{Timestamp: timeNow.Add(time.Duration(packet.ms) * time.Millisecond)}, packet.dir)
+	}
+	f := e.Features()
+
+	if f.DurationUs != 32000 {
+		t.Errorf("duration: got %v, want %v", f.DurationUs, 32000)
+	}
+	if f.RSTAfterPSHUs != 2000 {
+		t.Errorf("rst after psh: got %v, want %v", f.RSTAfterPSHUs, 2000)
+	}
+	if f.Client.Packets != 3 || f.Client.PayloadBytes != 100 || f.Client.Flags.ACK != 2 || f.Client.Flags.PSH != 1 {
+		t.Errorf("client counts: got %+v", f.Client)
+	}
+	if f.Client.IATMinUs != 10000 || f.Client.IATMaxUs != 20000 || f.Client.IATMeanUs != 15000 {
+		t.Errorf("client inter-arrival: got %v/%v/%v", f.Client.IATMinUs, f.Client.IATMeanUs, f.Client.IATMaxUs)
+	}
+	if f.Server.WindowMin != 16 || f.Server.WindowMax != 65535 || f.Server.Flags.RST != 1 {
+		t.Errorf("server window: got %+v", f.Server)
+	}
+	if f.Server.TTLFirst != -1 || f.Server.IPIDDeltaMax != -1 {
+		t.Errorf("server IP header: got %v/%v, want -1/-1", f.Server.TTLFirst, f.Server.IPIDDeltaMax)
+	}
+}
@@ -2,6 +2,7 @@ package logger
 
 import (
 	"io"
+	"io/ioutil"
 	"log"
 	"os"
 )
@@ -11,3 +12,9 @@ var (
 	Info         *log.Logger = log.New(os.Stderr, "INFO ", 0)
 	StreamWriter io.Writer   = os.Stdout
 )
+
+// DebugEnabled returns whether debug logs are written anywhere, so that callers
+// on the hot path can skip formatting them otherwise
+func DebugEnabled() bool {
+	return Debug.Writer() != ioutil.Discard
+}
@@ -9,8 +9,10 @@ import (
 	"runtime"
 	"strings"
 
+	"tripwire/pkg/decode"
 	"tripwire/pkg/logger"
 	"tripwire/pkg/parser"
+	"tripwire/pkg/sampler"
 	"tripwire/pkg/tcpstream"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -35,7 +37,12 @@ func Start(server *http.Server, metricsListener net.Listener) {
 	buildInfo.WithLabelValues(Version, GoVersion).Set(1)
 
 	registry := []prometheus.Collector{
-		buildInfo, parser.PacketsCount, tcpstream.StreamsCount,
+		buildInfo, parser.PacketsCount, parser.SampledOutPacketsCount, parser.FragmentsCount, parser.DefragDatagramsCount, parser.WorkerPacketsCount, parser.WorkerDroppedCount, parser.WorkerQueueLength,
+		parser.WorkerPagesUsed, parser.WorkerPagesAllocated,
+		parser.CapturePacketsCount, parser.CaptureDroppedCount, parser.CaptureIfDroppedCount, parser.CaptureQueueFreezesCount,
+		tcpstream.StreamsCount, tcpstream.StreamOutcomesCount, tcpstream.StreamEvictionsCount, tcpstream.StreamsActive,
+		tcpstream.ReassemblyPacketsCount, tcpstream.MissingBytesCount,
+		sampler.SampledStreamsCount,
 	}
 
 	for i, coll := range registry {
@@ -94,6 +101,22 @@ func Print(labels []string) {
 
 	logger.Info.Printf("global_packets: %d tcp, %d other", tcpPackets, otherPackets)
 
+	// Packets lost before reaching the parser or its workers, on live captures
+	if received := sum(parser.CapturePacketsCount); received > 0 {
+		logger.Info.Printf("global_capture: %d received, %d dropped, %d if_dropped, %d queue_dropped",
+			received, sum(parser.CaptureDroppedCount), sum(parser.CaptureIfDroppedCount), sum(parser.WorkerDroppedCount))
+	}
+	// Fragmented datagrams, if any were read
+	if fragments := sum(parser.FragmentsCount); fragments > 0 {
+		logger.Info.Printf("global_defrag: %d fragments, %d reassembled, %d timeout, %d evicted, %d invalid, %d overlap",
+			fragments, value(parser.DefragDatagramsCount, "reassembled"), value(parser.DefragDatagramsCount, decode.DropTimeout),
+			value(parser.DefragDatagramsCount, decode.DropEvicted), value(parser.DefragDatagramsCount, decode.DropInvalid),
+			value(parser.DefragDatagramsCount, decode.DropOverlap))
+	}
+	logger.Info.Printf("global_reassembly: %d out_of_order, %d overlap, %d missing_bytes",
+		value(tcpstream.ReassemblyPacketsCount, "out_of_order"), value(tcpstream.ReassemblyPacketsCount, "overlap"),
+		sum(tcpstream.MissingBytesCount))
+
 	labels = append([]string{"global_streams"}, labels...)
 	for _, label := range labels {
 		if counter, err = tcpstream.StreamsCount.GetMetricWithLabelValues(label, "false"); err != nil {
@@ -113,3 +136,34 @@ func Print(labels []string) {
 		logger.Info.Printf("%s: %d total, %d disrupted", label, streamsCount+disruptedStreamsCount, disruptedStreamsCount)
 	}
 }
+
+// sum returns the sum of the counters of a vector over all label values
+func sum(vec *prometheus.CounterVec) int {
+	metrics := make(chan prometheus.Metric)
+	go func() {
+		vec.Collect(metrics)
+		close(metrics)
+	}()
+	var total float64
+	for metric := range metrics {
+		var m dto.Metric
+		if err := metric.Write(&m); err != nil {
+			log.Fatal(err)
+		}
+		total += m.Counter.GetValue()
+	}
+	return int(total)
+}
+
+// value returns the value of the counter of a vector with the given label values
+func value(vec *prometheus.CounterVec, labels ...string) int {
+	counter, err := vec.GetMetricWithLabelValues(labels...)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var m dto.Metric
+	if err = counter.Write(&m); err != nil {
+		log.Fatal(err)
+	}
+	return int(m.Counter.GetValue())
+}
@@ -0,0 +1,139 @@
+//go:build linux
+// +build linux
+
+package parser
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"tripwire/pkg/config"
+	"tripwire/pkg/logger"
+
+	"github.com/Kkevsterrr/gopacket/afpacket"
+	"github.com/Kkevsterrr/gopacket/layers"
+	"github.com/Kkevsterrr/gopacket/pcap"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/bpf"
+)
+
+var fanoutModes = map[string]afpacket.FanoutType{
+	"hash":     afpacket.FanoutHash,
+	"lb":       afpacket.FanoutLoadBalance,
+	"cpu":      afpacket.FanoutCPU,
+	"rollover": afpacket.FanoutRollover,
+	"random":   afpacket.FanoutRandom,
+	"qm":       afpacket.FanoutQueueMapping,
+}
+
+// afpacketSource reads an interface through a TPACKET_V3 ring buffer
+type afpacketSource struct {
+	*afpacket.TPacket
+	name string
+
+	// Kernel statistics already exported
+	packets, drops, freezes uint32
+
+	packetsCount, droppedCount, queueFreezesCount prometheus.Counter
+}
+
+// openAFPacket opens the configured number of AF_PACKET sockets on iface. When
+// there are several of them, or a fanout group is set, the sockets join the
+// fanout group, spreading packets between them and the sockets of any other
+// process in the group. The default hash mode keeps both directions of a flow
+// on the same socket.
+func openAFPacket(iface, filter string, snaplen int, timeout time.Duration, cfg config.AFPacketConfig) ([]source, error) {
+	mode, ok := fanoutModes[cfg.FanoutMode]
+	if !ok {
+		return nil, fmt.Errorf("[Config] Unknown fanout mode %q", cfg.FanoutMode)
+	}
+	if cfg.Sockets < 1 || cfg.BufferMB < 1 {
+		return nil, fmt.Errorf("[Config] Invalid afpacket sockets %d or buffer size %d", cfg.Sockets, cfg.BufferMB)
+	}
+	if cfg.FanoutGroup < 0 || cfg.FanoutGroup > 0xffff {
+		return nil, fmt.Errorf("[Config] Invalid fanout group %d", cfg.FanoutGroup)
+	}
+	group := uint16(cfg.FanoutGroup)
+	if group == 0 {
+		group = uint16(os.Getpid())
+	}
+
+	// Filters are compiled by libpcap for the Ethernet frames read by the sockets
+	var program []bpf.RawInstruction
+	if filter != "" {
+		if snaplen <= 0 {
+			snaplen = 262144
+		}
+		instructions, err := pcap.CompileBPFFilter(layers.LinkTypeEthernet, snaplen, filter)
+		if err != nil {
+			return nil, err
+		}
+		for _, ins := range instructions {
+			program = append(program, bpf.RawInstruction{Op: ins.Code, Jt: ins.Jt, Jf: ins.Jf, K: ins.K})
+		}
+	}
+
+	blocks := cfg.BufferMB << 20 / afpacket.DefaultBlockSize
+	if blocks < 1 {
+		blocks = 1
+	}
+	var sources []source
+	for i := 0; i < cfg.Sockets; i++ {
+		tpacket, err := afpacket.NewTPacket(
+			afpacket.OptInterface(iface),
+			afpacket.TPacketVersion3,
+			afpacket.OptNumBlocks(blocks),
+			afpacket.OptPollTimeout(timeout),
+		)
+		if err == nil && program != nil {
+			err = tpacket.SetBPF(program)
+		}
+		if err == nil && (cfg.Sockets > 1 || cfg.FanoutGroup != 0) {
+			err = tpacket.SetFanout(mode, group)
+		}
+		if err != nil {
+			if tpacket != nil {
+				tpacket.Close()
+			}
+			closeSources(sources)
+			return nil, err
+		}
+		label := prometheus.Labels{"source": iface + "/" + strconv.Itoa(i)}
+		sources = append(sources, &afpacketSource{
+			TPacket:           tpacket,
+			name:              iface,
+			packetsCount:      CapturePacketsCount.With(label),
+			droppedCount:      CaptureDroppedCount.With(label),
+			queueFreezesCount: CaptureQueueFreezesCount.With(label),
+		})
+	}
+	if cfg.Sockets > 1 || cfg.FanoutGroup != 0 {
+		logger.Info.Printf("Joined fanout group %d (%s) with %d sockets", group, cfg.FanoutMode, cfg.Sockets)
+	}
+	return sources, nil
+}
+
+// LinkType returns the link type of the frames read from raw AF_PACKET sockets
+func (s *afpacketSource) LinkType() layers.LinkType {
+	return layers.LinkTypeEthernet
+}
+
+func (s *afpacketSource) Name() string { return s.name }
+
+// updateStats adds the kernel counters of the socket since the last update to
+// the capture metrics
+func (s *afpacketSource) updateStats() {
+	_, stats, err := s.SocketStats()
+	if err != nil {
+		logger.Debug.Printf("Unable to read socket statistics: %v", err)
+		return
+	}
+	packets, drops, freezes := uint32(stats.Packets()), uint32(stats.Drops()), uint32(stats.QueueFreezes())
+	// The counters are 32-bit and wrap around, which the differences survive
+	s.packetsCount.Add(float64(packets - s.packets))
+	s.droppedCount.Add(float64(drops - s.drops))
+	s.queueFreezesCount.Add(float64(freezes - s.freezes))
+	s.packets, s.drops, s.freezes = packets, drops, freezes
+}
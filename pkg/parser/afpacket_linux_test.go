@@ -0,0 +1,158 @@
+//go:build linux
+// +build linux
+
+package parser
+
+import (
+	"fmt"
+	"net"
+	"os/exec"
+	"sync"
+	"testing"
+	"time"
+
+	"tripwire/pkg/config"
+	"tripwire/pkg/decode"
+
+	"github.com/Kkevsterrr/gopacket/afpacket"
+	"github.com/Kkevsterrr/gopacket/layers"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// vethPair creates a veth pair, removed at the end of the test, and returns the
+// names of its ends. The test is skipped without the privileges to do so.
+func vethPair(t *testing.T) (string, string) {
+	a, b := "twtest0", "twtest1"
+	if out, err := exec.Command("ip", "link", "add", a, "type", "veth", "peer", "name", b).CombinedOutput(); err != nil {
+		t.Skipf("Unable to create veth pair: %v: %s", err, out)
+	}
+	t.Cleanup(func() { _ = exec.Command("ip", "link", "del", a).Run() })
+	for _, name := range []string{a, b} {
+		if out, err := exec.Command("ip", "link", "set", name, "up").CombinedOutput(); err != nil {
+			t.Fatalf("Unable to set %s up: %v: %s", name, err, out)
+		}
+	}
+	return a, b
+}
+
+func TestUnitAFPacketFanout(t *testing.T) {
+	capture, peer := vethPair(t)
+
+	p := &parser{
+		ifaces:  []string{capture},
+		filter:  "tcp",
+		backend: "afpacket",
+		timeout: 100 * time.Millisecond,
+		afpacket: config.AFPacketConfig{
+			BufferMB:   4,
+			Sockets:    2,
+			FanoutMode: "hash",
+		},
+	}
+	sources, err := p.open(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeSources(sources)
+	if len(sources) != 2 {
+		t.Fatalf("Expected %v but got %v", 2, len(sources))
+	}
+
+	// Read the TCP packets of each socket, by flow
+	const flows, perFlow = 16, 8
+	var mutex sync.Mutex
+	received := make(map[layers.TCPPort]map[int]int) // flow -> socket -> packets
+	total := 0
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i, src := range sources {
+		wg.Add(1)
+		go func(i int, src source) {
+			defer wg.Done()
+			packet := decode.NewPacket(src.LinkType())
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				data, ci, err := src.ZeroCopyReadPacketData()
+				if err != nil {
+					continue
+				}
+				if packet.Decode(data, ci); packet.TCP == nil {
+					continue
+				}
+				// Flows are told apart by their client port
+				flow := packet.TCP.SrcPort
+				if flow == 443 {
+					flow = packet.TCP.DstPort
+				}
+				mutex.Lock()
+				if received[flow] == nil {
+					received[flow] = make(map[int]int)
+				}
+				received[flow][i]++
+				total++
+				mutex.Unlock()
+			}
+		}(i, src)
+	}
+
+	// Send both directions of each flow from the other end of the pair
+	writer, err := afpacket.NewTPacket(afpacket.OptInterface(peer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer writer.Close()
+	for i := 0; i < flows; i++ {
+		client := net.IPv4(10, 0, 0, byte(i+1)).String()
+		port := layers.TCPPort(40000 + i)
+		for j := 0; j < perFlow/2; j++ {
+			if err := writer.WritePacketData(tcpFrame(t, client, "192.0.2.1", port, 443)); err != nil {
+				t.Fatal(err)
+			}
+			if err := writer.WritePacketData(tcpFrame(t, "192.0.2.1", client, 443, port)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		mutex.Lock()
+		n := total
+		mutex.Unlock()
+		if n >= flows*perFlow || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	close(stop)
+	wg.Wait()
+
+	if total != flows*perFlow || len(received) != flows {
+		t.Fatalf("Expected %v packets of %v flows but got %v of %v", flows*perFlow, flows, total, len(received))
+	}
+	// Hash fanout keeps both directions of a flow on the same socket
+	for flow, sockets := range received {
+		if len(sockets) != 1 {
+			t.Fatalf("Expected flow %v on %v socket but got %v", flow, 1, sockets)
+		}
+	}
+
+	// Kernel counters are exported, and only once
+	updateStats(sources)
+	updateStats(sources)
+	var packets float64
+	for i := range sources {
+		var m dto.Metric
+		if err := CapturePacketsCount.WithLabelValues(fmt.Sprintf("%s/%d", capture, i)).Write(&m); err != nil {
+			t.Fatal(err)
+		}
+		packets += m.Counter.GetValue()
+	}
+	if packets < flows*perFlow {
+		t.Fatalf("Expected at least %v but got %v", flows*perFlow, packets)
+	}
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+// +build !linux
+
+package parser
+
+import (
+	"errors"
+	"time"
+
+	"tripwire/pkg/config"
+)
+
+// openAFPacket fails as AF_PACKET sockets only exist on Linux
+func openAFPacket(iface, filter string, snaplen int, timeout time.Duration, cfg config.AFPacketConfig) ([]source, error) {
+	return nil, errors.New("[Config] The afpacket backend is only available on Linux")
+}
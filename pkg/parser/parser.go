@@ -2,15 +2,20 @@ package parser
 
 import (
 	"errors"
+	"fmt"
+	"io"
+	"net"
 	"os"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"tripwire/pkg/config"
+	"tripwire/pkg/decode"
 	"tripwire/pkg/logger"
 
 	"github.com/Kkevsterrr/gopacket"
-	"github.com/Kkevsterrr/gopacket/layers"
-	"github.com/Kkevsterrr/gopacket/pcap"
 	"github.com/Kkevsterrr/gopacket/reassembly"
 	"github.com/prometheus/client_golang/prometheus"
 )
@@ -20,78 +25,231 @@ var (
 		Name: "tripwire_packets_count",
 		Help: "Number of packets observed.",
 	}, []string{"transport"})
+	SampledOutPacketsCount = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "tripwire_sampled_out_packets_count",
+		Help: "Number of TCP packets skipped because their flow was not sampled.",
+	})
+	FragmentsCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tripwire_ip_fragments_count",
+		Help: "Number of IP fragments read, by IP version.",
+	}, []string{"version"})
+	DefragDatagramsCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tripwire_defrag_datagrams_count",
+		Help: "Number of fragmented datagrams, by outcome: reassembled, or dropped on timeout, eviction, invalid or overlapping fragments.",
+	}, []string{"outcome"})
 )
 
 // packetContext Implements https://github.com/google/gopacket/blob/master/reassembly/tcpassembly.go#L602
 type packetContext struct {
 	CaptureInfo gopacket.CaptureInfo
+	packet      *decode.Packet
 }
 
 func (c *packetContext) GetCaptureInfo() gopacket.CaptureInfo {
 	return c.CaptureInfo
 }
 
+// Packet returns the decoded packet, which is only valid while it is being assembled
+func (c *packetContext) Packet() *decode.Packet {
+	return c.packet
+}
+
+// StreamFactory creates the streams reassembled by the parser
+type StreamFactory interface {
+	reassembly.StreamFactory
+	// Expire closes the streams that timed out at the given time
+	Expire(now time.Time) int
+	// Shutdown is called before the streams still open when the parser stops are closed
+	Shutdown()
+	// Evicted returns whether streams were evicted since the last call, and the
+	// time before which the connections of all of them were last seen
+	Evicted() (ended time.Time, evicted bool)
+}
+
 type parser struct {
-	// Packet assembler
-	assembler *reassembly.Assembler
+	// Packet assemblers, each fed the packets of a share of the flows
+	workers []*worker
 
-	// Gathering of packets
-	pcapFile string
-	iface    string
+	// Gathering of packets, from either pcap files or interfaces. Pcap files
+	// replayed in real time are handled as a live capture.
+	pcapFiles []string
+	ifaces    []string
+	offline   bool
+	replay    float64
 
 	// Interface options
-	snaplen int
+	snaplen  int
+	backend  string
+	timeout  time.Duration
+	afpacket config.AFPacketConfig
 
 	// Packet Filter
 	filter string
 
-	// Flush/Close streams every X packets
-	flush int
+	// Close timed out streams every interval
+	flushInterval time.Duration
+
+	// Called with the time of every flush, if not nil
+	onFlush func(now time.Time)
+
+	// Flows to assemble, all of them if nil
+	sampler *flowSampler
+
+	// Encapsulations removed before assembly, none if nil
+	tunnels *decode.Tunnels
+
+	// Bounds of the datagrams reassembled from fragments by each source
+	defrag decode.DefragLimits
 }
 
-func NewParser(cfg config.ParserConfig, streamFactory reassembly.StreamFactory) (*parser, error) {
+// NewParser returns a parser with the configured number of workers, each
+// assembling streams created by its own factory
+func NewParser(cfg config.ParserConfig, newStreamFactory func() StreamFactory) (*parser, error) {
 	// Validate config
-	if cfg.Input.PcapFile == "" && cfg.Input.Interface == "" {
+	ifaces, patterns := cfg.Input.AllInterfaces(), cfg.Input.AllPcapFiles()
+	if len(ifaces) == 0 && len(patterns) == 0 {
 		return nil, errors.New("[Config] No input source specified")
 	}
-	if cfg.Input.PcapFile != "" && cfg.Input.Interface != "" {
-		return nil, errors.New("[Config] Please specify only a single input source")
+	if len(ifaces) > 0 && len(patterns) > 0 {
+		return nil, errors.New("[Config] Please specify either interfaces or pcap files")
+	}
+	pcapFiles, err := expandPcapFiles(patterns)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Input.Replay < 0 || cfg.Input.Replay > 0 && len(pcapFiles) == 0 {
+		return nil, fmt.Errorf("[Config] Invalid replay speed %v, which only applies to pcap files", cfg.Input.Replay)
+	}
+	if cfg.Input.Backend != "pcap" && cfg.Input.Backend != "afpacket" {
+		return nil, fmt.Errorf("[Config] Unknown capture backend %q", cfg.Input.Backend)
+	}
+	if cfg.Workers < 1 {
+		return nil, fmt.Errorf("[Config] Invalid number of workers %d", cfg.Workers)
+	}
+	if cfg.QueueSize < 1 {
+		return nil, fmt.Errorf("[Config] Invalid queue size %d", cfg.QueueSize)
+	}
+	if cfg.Defrag.MaxDatagrams < 1 || cfg.Defrag.MaxFragments < 1 || cfg.Defrag.Timeout <= 0 {
+		return nil, fmt.Errorf("[Config] Invalid defrag limits %+v", cfg.Defrag)
+	}
+	sampler, err := newFlowSampler(cfg.TCP.Sampling)
+	if err != nil {
+		return nil, err
+	}
+	tunnels, err := newTunnels(cfg.Decapsulation)
+	if err != nil {
+		return nil, err
+	}
+	limits := cfg.TCP.Limits.PerWorker(cfg.Workers)
+	var workers []*worker
+	for i := 0; i < cfg.Workers; i++ {
+		workers = append(workers, newWorker(i, newStreamFactory(), cfg.TCP.Timeouts.Max(), cfg.QueueSize,
+			limits.MemoryBudgetMB<<20/pageSize))
 	}
-	streamPool := reassembly.NewStreamPool(streamFactory)
 	return &parser{
-		assembler: reassembly.NewAssembler(streamPool),
-		pcapFile:  cfg.Input.PcapFile,
-		iface:     cfg.Input.Interface,
-		filter:    cfg.Filter.BPF,
-		snaplen:   cfg.SnapLen,
-		flush:     cfg.Flush,
+		workers:       workers,
+		pcapFiles:     pcapFiles,
+		ifaces:        ifaces,
+		offline:       len(pcapFiles) > 0 && cfg.Input.Replay == 0,
+		replay:        cfg.Input.Replay,
+		filter:        cfg.Filter.BPF,
+		snaplen:       cfg.SnapLen,
+		backend:       cfg.Input.Backend,
+		timeout:       cfg.Input.Timeout,
+		afpacket:      cfg.Input.AFPacket,
+		flushInterval: cfg.FlushInterval,
+		sampler:       sampler,
+		tunnels:       tunnels,
+		defrag:        decode.DefragLimits(cfg.Defrag),
 	}, nil
 }
 
-func (p *parser) Run(signalChan chan os.Signal) error {
-	var handle *pcap.Handle
-	var err error
+// OnFlush sets a function called with the time of every flush, once the
+// workers were handed the flush, for work done periodically along with it
+func (p *parser) OnFlush(f func(now time.Time)) {
+	p.onFlush = f
+}
 
-	if p.pcapFile != "" {
-		logger.Info.Printf("Read from pcap: %q", p.pcapFile)
-		handle, err = pcap.OpenOffline(p.pcapFile)
-	} else {
-		logger.Info.Printf("Starting capture on interface %q with filter %v", p.iface, p.filter)
-		handle, err = pcap.OpenLive(p.iface, int32(p.snaplen), true, time.Second*10)
+// newTunnels returns the configured encapsulations, or nil if there are none
+func newTunnels(cfg config.DecapConfig) (*decode.Tunnels, error) {
+	if len(cfg.Tunnels) == 0 {
+		return nil, nil
+	}
+	tunnels := &decode.Tunnels{VXLANPort: cfg.VXLANPort, GenevePort: cfg.GenevePort}
+	for _, tunnel := range cfg.Tunnels {
+		switch strings.ToLower(tunnel) {
+		case "vlan":
+			tunnels.VLAN = true
+		case "mpls":
+			tunnels.MPLS = true
+		case "gre":
+			tunnels.GRE = true
+		case "erspan":
+			tunnels.ERSPAN = true
+		case "vxlan":
+			tunnels.VXLAN = true
+		case "geneve":
+			tunnels.Geneve = true
+		default:
+			return nil, fmt.Errorf("[Config] Unknown tunnel %q", tunnel)
+		}
 	}
+	return tunnels, nil
+}
+
+func (p *parser) Run(signalChan chan os.Signal) error {
+	stop := make(chan struct{})
+	sources, err := p.open(stop)
 	if err != nil {
 		return err
 	}
-	defer handle.Close()
 
-	// Filter packets given filter argument
-	if err = handle.SetBPFFilter(p.filter); err != nil {
-		return err
+	// Packets are read and decoded on a goroutine for each source, into packets
+	// recycled once assembled. Fragments are reassembled by each source, as those
+	// of a datagram are read from the same one. Sources are closed once their
+	// readers stopped.
+	pool := decode.NewPool(sources[0].LinkType(), p.tunnels)
+	packets := make(chan *decode.Packet, 64)
+	var readers sync.WaitGroup
+	for _, src := range sources {
+		readers.Add(1)
+		go func(src source) {
+			defer readers.Done()
+			read(src, pool, p.newDefragmenter(), packets, stop)
+		}(src)
 	}
+	go func() {
+		readers.Wait()
+		close(packets)
+	}()
+	defer func() {
+		close(stop)
+		for range packets {
+		}
+		updateStats(sources)
+		closeSources(sources)
+	}()
 
-	// Packet source setup
-	packetSource := gopacket.NewPacketSource(handle, handle.LinkType())
-	packets := packetSource.Packets()
+	// Live captures are flushed on the wall clock so that quiet links still
+	// get verdicts, while pcaps are flushed on the capture clock
+	var ticker <-chan time.Time
+	if !p.offline {
+		t := time.NewTicker(p.flushInterval)
+		defer t.Stop()
+		ticker = t.C
+	}
+	var lastFlush time.Time
+
+	// Workers run on their own goroutines, unless there is a single one which
+	// then assembles packets as they are read
+	var wg sync.WaitGroup
+	for _, w := range p.workers {
+		w.pool = pool
+		if len(p.workers) > 1 {
+			wg.Add(1)
+			go w.run(&wg)
+		}
+	}
 
 	done := false
 	var count int
@@ -102,40 +260,152 @@ func (p *parser) Run(signalChan chan os.Signal) error {
 			logger.Info.Println("SIGINT: abort")
 			done = true
 			break
-		case packet := <-packets:
-			// A nil packet indicates the end of a pcap file.
-			if packet == nil {
+		case now := <-ticker:
+			updateStats(sources)
+			p.flush(now, count)
+		case packet, ok := <-packets:
+			// A closed channel indicates the end of a pcap file.
+			if !ok {
 				logger.Info.Println("End of PCAP")
 				done = true
 				break
 			}
 
 			count += 1
-			tcpLayer := packet.Layer(layers.LayerTypeTCP)
-			if tcpLayer == nil {
+			if packet.TCP == nil {
 				// If TCP layer does not exist
 				PacketsCount.With(prometheus.Labels{"transport": "other"}).Inc()
+				pool.Put(packet)
 				continue
 			}
 			PacketsCount.With(prometheus.Labels{"transport": "tcp"}).Inc()
 
-			c := packetContext{
-				CaptureInfo: packet.Metadata().CaptureInfo,
+			// The packet belongs to its worker once dispatched
+			ref := packet.CaptureInfo.Timestamp
+			if p.sampler == nil || p.sampler.keep(packet) {
+				p.dispatch(job{packet: packet})
+			} else {
+				SampledOutPacketsCount.Inc()
+				pool.Put(packet)
 			}
 
-			p.assembler.AssembleWithContext(packet.NetworkLayer().NetworkFlow(), packet, tcpLayer.(*layers.TCP), &c)
-
 			// Time to flush or close connections
-			if count%p.flush == 0 {
-				// Time reference to use when flushing or closing connections
-				ref := packet.Metadata().CaptureInfo.Timestamp
-				flushed, closed := p.assembler.FlushCloseOlderThan(ref.Add(time.Minute * -2))
-				logger.Debug.Printf("Forced flush: %d flushed, %d closed, %d total", flushed, closed, count)
+			if ticker == nil {
+				if lastFlush.IsZero() {
+					lastFlush = ref
+				} else if ref.Sub(lastFlush) >= p.flushInterval {
+					lastFlush = ref
+					p.flush(ref, count)
+				}
 			}
 		}
 	}
 
-	closed := p.assembler.FlushAll()
-	logger.Debug.Printf("Final flush: %d closed, %d total", closed, count)
+	// Let workers drain their queues before closing the remaining streams
+	if len(p.workers) > 1 {
+		for _, w := range p.workers {
+			close(w.jobs)
+		}
+		wg.Wait()
+	}
+	for _, w := range p.workers {
+		w.close(count)
+	}
 	return nil
 }
+
+// dispatch hands a packet to the worker owning its flow. Flows are hashed
+// symmetrically so that both directions of a connection reach the same worker.
+// Packets are dropped if the worker falls behind a live capture, whereas reading
+// a pcap waits for it.
+func (p *parser) dispatch(j job) {
+	if len(p.workers) == 1 {
+		p.workers[0].process(j)
+		return
+	}
+	hash := j.packet.NetworkFlow().FastHash()*31 + j.packet.TCP.TransportFlow().FastHash()
+	w := p.workers[hash%uint64(len(p.workers))]
+	if p.offline {
+		w.jobs <- j
+	} else {
+		select {
+		case w.jobs <- j:
+		default:
+			w.dropped.Inc()
+			w.pool.Put(j.packet)
+		}
+	}
+	w.queueLength.Set(float64(len(w.jobs)))
+}
+
+// flush has every worker close the streams that timed out by now
+func (p *parser) flush(now time.Time, count int) {
+	for _, w := range p.workers {
+		if len(p.workers) == 1 {
+			w.process(job{now: now, count: count})
+		} else {
+			w.jobs <- job{now: now, count: count}
+		}
+	}
+	if p.onFlush != nil {
+		p.onFlush(now)
+	}
+}
+
+// newDefragmenter returns a defragmenter counting the datagrams it drops
+func (p *parser) newDefragmenter() *decode.Defragmenter {
+	return decode.NewDefragmenter(p.defrag, func(reason string) {
+		DefragDatagramsCount.With(prometheus.Labels{"outcome": reason}).Inc()
+	})
+}
+
+// read decodes the packets of src until it is exhausted or stop is closed.
+// Packets are read without copying and copied once into a pooled packet, so that
+// reading does not allocate. Fragments are only handed over once reassembled.
+func read(src source, pool *decode.Pool, defrag *decode.Defragmenter, packets chan<- *decode.Packet, stop <-chan struct{}) {
+	for {
+		data, ci, err := src.ZeroCopyReadPacketData()
+		if err == nil {
+			packet := pool.Get()
+			packet.Source = src.Name()
+			packet.SetLinkType(src.LinkType())
+			// Packets failing to decode have no TCP layer and are counted as such
+			_ = packet.DecodeCopy(data, ci)
+			if packet.IsFragment() {
+				version := "4"
+				if packet.IPv6 != nil {
+					version = "6"
+				}
+				FragmentsCount.With(prometheus.Labels{"version": version}).Inc()
+				if !defrag.Defrag(packet) {
+					pool.Put(packet)
+					continue
+				}
+				DefragDatagramsCount.With(prometheus.Labels{"outcome": "reassembled"}).Inc()
+			}
+			select {
+			case packets <- packet:
+			case <-stop:
+				return
+			}
+			continue
+		}
+
+		// Errors are handled as gopacket.PacketSource does
+		if err == io.EOF || err == io.ErrUnexpectedEOF ||
+			err == io.ErrNoProgress || err == io.ErrClosedPipe || err == io.ErrShortBuffer ||
+			err == syscall.EBADF ||
+			strings.Contains(err.Error(), "use of closed file") {
+			return
+		}
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		if nerr, ok := err.(net.Error); ok && nerr.Temporary() || err == syscall.EAGAIN {
+			continue
+		}
+		time.Sleep(time.Millisecond * time.Duration(5))
+	}
+}
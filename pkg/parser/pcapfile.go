@@ -0,0 +1,259 @@
+package parser
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+
+	"github.com/Kkevsterrr/gopacket"
+	"github.com/Kkevsterrr/gopacket/layers"
+	"github.com/Kkevsterrr/gopacket/pcap"
+	"github.com/Kkevsterrr/gopacket/pcapgo"
+
+	"tripwire/pkg/decode"
+)
+
+// Magic bytes at the start of the supported capture and compression formats
+var (
+	gzipMagic   = []byte{0x1f, 0x8b}
+	zstdMagic   = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	xzMagic     = []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}
+	pcapngMagic = []byte{0x0a, 0x0d, 0x0d, 0x0a}
+	pcapMagics  = [][]byte{
+		{0xa1, 0xb2, 0xc3, 0xd4}, {0xd4, 0xc3, 0xb2, 0xa1}, // microseconds
+		{0xa1, 0xb2, 0x3c, 0x4d}, {0x4d, 0x3c, 0xb2, 0xa1}, // nanoseconds
+	}
+)
+
+// Snapshot length filters of capture files are compiled for
+const fileSnaplen = 262144
+
+// Length of Linux cooked capture v2 headers
+const sll2HeaderLen = 20
+
+// packetReader reads packets from a capture file
+type packetReader interface {
+	ZeroCopyReadPacketData() (data []byte, ci gopacket.CaptureInfo, err error)
+	LinkType() layers.LinkType
+}
+
+// captureFile reads a pcap or pcapng file, optionally compressed with gzip, zstd
+// or xz, whose format is told by its magic bytes so that standard input works
+// as well. The interfaces of a pcapng file may have different link types.
+type captureFile struct {
+	file   *os.File
+	closer io.Closer // decompressor, if any
+	reader packetReader
+	ng     bool
+
+	filter   string
+	filters  map[layers.LinkType]*pcap.BPF // filter compiled for each link type
+	linkType layers.LinkType               // link type of the last packet read
+}
+
+// openCaptureFile opens a capture file, or standard input if name is "-"
+func openCaptureFile(name, filter string) (*captureFile, error) {
+	f := &captureFile{file: os.Stdin, filter: filter, filters: make(map[layers.LinkType]*pcap.BPF)}
+	if name != "-" {
+		file, err := os.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		f.file = file
+	}
+	if err := f.open(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// open detects the compression and the format of the file and sets up its reader
+func (f *captureFile) open() error {
+	r := bufio.NewReader(f.file)
+	magic, _ := r.Peek(6)
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return err
+		}
+		f.closer = gz
+		r = bufio.NewReader(gz)
+	case bytes.HasPrefix(magic, zstdMagic):
+		cmd, err := decompress(r, "zstd", "-dcq")
+		if err != nil {
+			return err
+		}
+		f.closer = cmd
+		r = bufio.NewReader(cmd)
+	case bytes.HasPrefix(magic, xzMagic):
+		cmd, err := decompress(r, "xz", "-dcq")
+		if err != nil {
+			return err
+		}
+		f.closer = cmd
+		r = bufio.NewReader(cmd)
+	}
+
+	magic, _ = r.Peek(4)
+	if bytes.Equal(magic, pcapngMagic) {
+		options := pcapgo.DefaultNgReaderOptions
+		options.WantMixedLinkType = true
+		ng, err := pcapgo.NewNgReader(r, options)
+		if err != nil {
+			return err
+		}
+		f.reader, f.ng, f.linkType = ng, true, ng.LinkType()
+		_, err = f.compile()
+		return err
+	}
+	for _, pcapMagic := range pcapMagics {
+		if bytes.Equal(magic, pcapMagic) {
+			reader, err := pcapgo.NewReader(r)
+			if err != nil {
+				return err
+			}
+			f.reader, f.linkType = reader, reader.LinkType()
+			_, err = f.compile()
+			return err
+		}
+	}
+	return errors.New("Unknown capture file format")
+}
+
+// ZeroCopyReadPacketData reads the next packet matching the filter
+func (f *captureFile) ZeroCopyReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	for {
+		data, ci, err := f.reader.ZeroCopyReadPacketData()
+		if err != nil {
+			return data, ci, err
+		}
+		if f.ng && len(ci.AncillaryData) > 0 {
+			if linkType, ok := ci.AncillaryData[0].(layers.LinkType); ok {
+				f.linkType = linkType
+			}
+		}
+		bpf, err := f.compile()
+		if err != nil {
+			return nil, ci, err
+		}
+		if bpf == nil || f.matches(bpf, ci, data) {
+			return data, ci, nil
+		}
+	}
+}
+
+// compile returns the filter compiled for the link type of the last packet read,
+// or nil without filter
+func (f *captureFile) compile() (*pcap.BPF, error) {
+	if f.filter == "" {
+		return nil, nil
+	}
+	if bpf, ok := f.filters[f.linkType]; ok {
+		return bpf, nil
+	}
+	linkType := f.linkType
+	if linkType == decode.LinkTypeLinuxSLL2 {
+		linkType = layers.LinkTypeRaw
+	}
+	bpf, err := pcap.NewBPF(linkType, fileSnaplen, f.filter)
+	if err != nil {
+		return nil, err
+	}
+	f.filters[f.linkType] = bpf
+	return bpf, nil
+}
+
+// matches returns whether the filter matches a packet of the link type of the
+// last packet read. libpcap is only given 8-bit link types, which do not hold
+// Linux cooked v2, so filters run on the IP packets of those frames instead.
+func (f *captureFile) matches(bpf *pcap.BPF, ci gopacket.CaptureInfo, data []byte) bool {
+	if f.linkType == decode.LinkTypeLinuxSLL2 {
+		if len(data) < sll2HeaderLen {
+			return false
+		}
+		switch layers.EthernetType(binary.BigEndian.Uint16(data)) {
+		case layers.EthernetTypeIPv4, layers.EthernetTypeIPv6:
+		default:
+			return false
+		}
+		data = data[sll2HeaderLen:]
+		ci.CaptureLength, ci.Length = len(data), ci.Length-sll2HeaderLen
+	}
+	return bpf.Matches(ci, data)
+}
+
+// LinkType returns the link type of the last packet read
+func (f *captureFile) LinkType() layers.LinkType { return f.linkType }
+
+func (f *captureFile) Close() {
+	if f.closer != nil {
+		f.closer.Close()
+	}
+	if f.file != os.Stdin {
+		f.file.Close()
+	}
+}
+
+// command is the output of a decompression command
+type command struct {
+	cmd    *exec.Cmd
+	stdout io.ReadCloser
+	done   bool // whether or not the command was waited for
+}
+
+// decompress pipes r through an external decompression command. Formats
+// without a decoder in the standard library are left to the usual tools.
+func decompress(r io.Reader, name string, args ...string) (*command, error) {
+	c := &command{cmd: exec.Command(name, args...)}
+	// The input is copied here rather than by the command, so that waiting for a
+	// killed command does not wait for input that may never come on stdin
+	stdin, input, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	defer stdin.Close()
+	c.cmd.Stdin = stdin
+	if c.stdout, err = c.cmd.StdoutPipe(); err != nil {
+		input.Close()
+		return nil, err
+	}
+	if err = c.cmd.Start(); err != nil {
+		input.Close()
+		return nil, fmt.Errorf("Unable to run %s to decompress: %v", name, err)
+	}
+	go func() {
+		_, _ = io.Copy(input, r)
+		input.Close()
+	}()
+	return c, nil
+}
+
+// Read reads the decompressed data. Data the command failed to decompress ends
+// it early.
+func (c *command) Read(p []byte) (int, error) {
+	n, err := c.stdout.Read(p)
+	if err == io.EOF && !c.done {
+		c.done = true
+		if c.cmd.Wait() != nil {
+			return n, io.ErrUnexpectedEOF
+		}
+	}
+	return n, err
+}
+
+func (c *command) Close() error {
+	if !c.done {
+		c.done = true
+		_ = c.cmd.Process.Kill()
+		_ = c.cmd.Wait()
+	}
+	return nil
+}
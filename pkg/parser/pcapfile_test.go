@@ -0,0 +1,121 @@
+package parser
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/Kkevsterrr/gopacket"
+	"github.com/Kkevsterrr/gopacket/layers"
+	"github.com/Kkevsterrr/gopacket/pcapgo"
+)
+
+// pcapngCapture returns a pcapng capture of two interfaces with different link
+// types, Ethernet and raw IP, each with packets to and from ports 80 and 443
+func pcapngCapture(t *testing.T) []byte {
+	var buf bytes.Buffer
+	w, err := pcapgo.NewNgWriter(&buf, layers.LinkTypeEthernet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw := pcapgo.DefaultNgInterface
+	raw.LinkType = layers.LinkTypeRaw
+	if _, err := w.AddInterface(raw); err != nil {
+		t.Fatal(err)
+	}
+	for iface, header := range []int{0, 14} {
+		for _, port := range []layers.TCPPort{80, 443, 80} {
+			data := tcpFrame(t, "10.0.0.1", "192.0.2.1", 40000, port)[header:]
+			ci := gopacket.CaptureInfo{Timestamp: time.Unix(1, 0), CaptureLength: len(data), Length: len(data), InterfaceIndex: iface}
+			if err := w.WritePacket(ci, data); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestUnitCaptureFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tripwire")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	capture := pcapngCapture(t)
+
+	var gz bytes.Buffer
+	w := gzip.NewWriter(&gz)
+	if _, err := w.Write(capture); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	files := map[string][]byte{
+		"capture.pcapng":      capture,
+		"capture.pcapng.gz":   gz.Bytes(),
+		"truncated.pcapng.gz": gz.Bytes()[:gz.Len()/2],
+	}
+	// Formats decompressed by external tools are tested where they are installed
+	for name, tool := range map[string]string{"capture.pcapng.zst": "zstd", "capture.pcapng.xz": "xz"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			continue
+		}
+		cmd := exec.Command(tool, "-c")
+		cmd.Stdin = bytes.NewReader(capture)
+		out, err := cmd.Output()
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[name] = out
+	}
+
+	for name, data := range files {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		f, err := openCaptureFile(path, "tcp and port 80")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var linkTypes []layers.LinkType
+		for {
+			_, _, err := f.ZeroCopyReadPacketData()
+			if err != nil {
+				if name == "truncated.pcapng.gz" {
+					if err != io.ErrUnexpectedEOF {
+						t.Fatalf("Expected %v but got %v", io.ErrUnexpectedEOF, err)
+					}
+				} else if err != io.EOF {
+					t.Fatalf("Expected %v but got %v for %s", io.EOF, err, name)
+				}
+				break
+			}
+			linkTypes = append(linkTypes, f.LinkType())
+		}
+		f.Close()
+
+		// Packets to port 443 are filtered out, whatever the link type
+		expected := []layers.LinkType{layers.LinkTypeEthernet, layers.LinkTypeEthernet, layers.LinkTypeRaw, layers.LinkTypeRaw}
+		if name != "truncated.pcapng.gz" && !reflect.DeepEqual(linkTypes, expected) {
+			t.Fatalf("Expected %v but got %v for %s", expected, linkTypes, name)
+		}
+	}
+
+	path := filepath.Join(dir, "capture.txt")
+	if err := ioutil.WriteFile(path, []byte("not a capture"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := openCaptureFile(path, ""); err == nil {
+		t.Fatalf("Expected error but got %v", err)
+	}
+}
@@ -0,0 +1,84 @@
+package parser
+
+import (
+	"bytes"
+	"fmt"
+
+	"tripwire/pkg/config"
+	"tripwire/pkg/decode"
+)
+
+// flowSampler keeps one in oneIn flows. Flows are selected by a hash of their
+// symmetric 5-tuple, or of their client prefix, so that both directions of a
+// connection, and the same connections on every run, are kept.
+type flowSampler struct {
+	oneIn                  uint64
+	perPrefix              bool
+	prefixLen4, prefixLen6 int
+}
+
+// newFlowSampler returns a sampler for the configured flow sampling, or nil if
+// every flow is kept
+func newFlowSampler(cfg config.FlowSampling) (*flowSampler, error) {
+	if cfg.OneIn < 0 {
+		return nil, fmt.Errorf("[Config] Invalid flow sampling rate %d", cfg.OneIn)
+	}
+	if cfg.PerPrefix && (cfg.PrefixLen4 < 0 || cfg.PrefixLen4 > 32 || cfg.PrefixLen6 < 0 || cfg.PrefixLen6 > 128) {
+		return nil, fmt.Errorf("[Config] Invalid flow sampling prefix lengths %d and %d", cfg.PrefixLen4, cfg.PrefixLen6)
+	}
+	if cfg.Rate() == 1 {
+		return nil, nil
+	}
+	return &flowSampler{
+		oneIn:      uint64(cfg.Rate()),
+		perPrefix:  cfg.PerPrefix,
+		prefixLen4: cfg.PrefixLen4,
+		prefixLen6: cfg.PrefixLen6,
+	}, nil
+}
+
+// keep returns whether the flow of a TCP packet is sampled
+func (s *flowSampler) keep(packet *decode.Packet) bool {
+	var hash uint64
+	if s.perPrefix {
+		hash = s.prefixHash(packet)
+	} else {
+		hash = packet.NetworkFlow().FastHash()*31 + packet.TCP.TransportFlow().FastHash()
+	}
+	return decode.MixHash(hash)%s.oneIn == 0
+}
+
+// prefixHash hashes the prefix of the client, taken to be the endpoint with the
+// higher, ephemeral, port, which holds for both directions of a connection
+// whether or not its handshake was seen. Between equal ports, the lower address
+// is taken.
+func (s *flowSampler) prefixHash(packet *decode.Packet) uint64 {
+	var client, server []byte
+	switch {
+	case packet.IPv4 != nil:
+		client, server = packet.IPv4.SrcIP.To4(), packet.IPv4.DstIP.To4()
+	case packet.IPv6 != nil:
+		client, server = packet.IPv6.SrcIP, packet.IPv6.DstIP
+	}
+	if src, dst := packet.TCP.SrcPort, packet.TCP.DstPort; dst > src || dst == src && bytes.Compare(server, client) < 0 {
+		client = server
+	}
+	ones := s.prefixLen6
+	if packet.IPv4 != nil {
+		ones = s.prefixLen4
+	}
+	// FNV-1a of the masked address
+	hash := uint64(14695981039346656037)
+	for i, b := range client {
+		switch {
+		case ones >= 8*(i+1):
+		case ones <= 8*i:
+			b = 0
+		default:
+			b &= ^byte(0xff >> uint(ones-8*i))
+		}
+		hash ^= uint64(b)
+		hash *= 1099511628211
+	}
+	return hash
+}
@@ -0,0 +1,84 @@
+package parser
+
+import (
+	"net"
+	"testing"
+
+	"tripwire/pkg/config"
+	"tripwire/pkg/decode"
+
+	"github.com/Kkevsterrr/gopacket"
+	"github.com/Kkevsterrr/gopacket/layers"
+)
+
+// tcpFrame returns an Ethernet frame carrying a TCP segment between the given endpoints
+func tcpFrame(t *testing.T, src, dst string, sport, dport layers.TCPPort) []byte {
+	eth := &layers.Ethernet{SrcMAC: make(net.HardwareAddr, 6), DstMAC: make(net.HardwareAddr, 6), EthernetType: layers.EthernetTypeIPv4}
+	ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolTCP, SrcIP: net.ParseIP(src), DstIP: net.ParseIP(dst)}
+	tcp := &layers.TCP{SrcPort: sport, DstPort: dport, ACK: true}
+	if err := tcp.SetNetworkLayerForChecksum(ip); err != nil {
+		t.Fatal(err)
+	}
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, eth, ip, tcp); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// tcpPacket returns a decoded TCP packet between the given endpoints
+func tcpPacket(t *testing.T, src, dst string, sport, dport layers.TCPPort) *decode.Packet {
+	packet := decode.NewPacket(layers.LinkTypeEthernet)
+	if err := packet.DecodeCopy(tcpFrame(t, src, dst, sport, dport), gopacket.CaptureInfo{}); err != nil || packet.TCP == nil {
+		t.Fatalf("Expected TCP packet but got %v", err)
+	}
+	return packet
+}
+
+func TestUnitFlowSampler(t *testing.T) {
+	tests := []struct {
+		sampling config.FlowSampling
+		sameKey  bool // whether flows of the same client prefix share their verdict
+	}{
+		{sampling: config.FlowSampling{OneIn: 4}},
+		{sampling: config.FlowSampling{OneIn: 4, PerPrefix: true, PrefixLen4: 24, PrefixLen6: 48}, sameKey: true},
+	}
+
+	for _, test := range tests {
+		s, err := newFlowSampler(test.sampling)
+		if err != nil {
+			t.Fatal(err)
+		}
+		kept, flows := 0, 0
+		for i := 0; i < 1000; i++ {
+			client := net.IPv4(10, byte(i>>8), byte(i), 1).String()
+			port := layers.TCPPort(40000 + i)
+			keep := s.keep(tcpPacket(t, client, "192.0.2.1", port, 443))
+			// Both directions of a connection are kept together
+			if reverse := s.keep(tcpPacket(t, "192.0.2.1", client, 443, port)); reverse != keep {
+				t.Fatalf("Expected %v but got %v for the reverse of flow %d", keep, reverse, i)
+			}
+			if test.sameKey {
+				neighbour := net.IPv4(10, byte(i>>8), byte(i), 200).String()
+				if other := s.keep(tcpPacket(t, neighbour, "198.51.100.7", 50000, 80)); other != keep {
+					t.Fatalf("Expected %v but got %v for client prefix %d", keep, other, i)
+				}
+			}
+			if keep {
+				kept++
+			}
+			flows++
+		}
+		if kept < flows/4-50 || kept > flows/4+50 {
+			t.Fatalf("Expected about %v but got %v", flows/4, kept)
+		}
+	}
+
+	if s, err := newFlowSampler(config.FlowSampling{OneIn: 1}); s != nil || err != nil {
+		t.Fatalf("Expected %v but got %v", nil, s)
+	}
+	if _, err := newFlowSampler(config.FlowSampling{OneIn: -1}); err == nil {
+		t.Fatalf("Expected error but got %v", err)
+	}
+}
@@ -0,0 +1,310 @@
+package parser
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"tripwire/pkg/logger"
+
+	"github.com/Kkevsterrr/gopacket"
+	"github.com/Kkevsterrr/gopacket/layers"
+	"github.com/Kkevsterrr/gopacket/pcap"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	CapturePacketsCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tripwire_capture_packets_count",
+		Help: "Number of packets received by the kernel for each live capture source.",
+	}, []string{"source"})
+	CaptureDroppedCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tripwire_capture_dropped_count",
+		Help: "Number of packets dropped by the kernel because the buffer of a live capture source was full.",
+	}, []string{"source"})
+	CaptureIfDroppedCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tripwire_capture_if_dropped_count",
+		Help: "Number of packets dropped by the network interface or its driver, for each live capture source.",
+	}, []string{"source"})
+	CaptureQueueFreezesCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tripwire_capture_queue_freezes_count",
+		Help: "Number of times the ring buffer of an AF_PACKET capture source filled up.",
+	}, []string{"source"})
+)
+
+// source is a capture the parser reads packets from. Its link type and name
+// are those of the last packet read.
+type source interface {
+	ZeroCopyReadPacketData() (data []byte, ci gopacket.CaptureInfo, err error)
+	LinkType() layers.LinkType
+	Name() string
+	Close()
+}
+
+// statsSource is implemented by sources keeping kernel statistics, which are
+// exported as metrics by updateStats
+type statsSource interface {
+	updateStats()
+}
+
+// pcapSource is a live libpcap capture
+type pcapSource struct {
+	*pcap.Handle
+	name string
+
+	// Kernel statistics already exported
+	received, dropped, ifDropped uint32
+
+	receivedCount, droppedCount, ifDroppedCount prometheus.Counter
+}
+
+func (s *pcapSource) Name() string { return s.name }
+
+// updateStats adds the libpcap counters of the capture since the last update to
+// the capture metrics
+func (s *pcapSource) updateStats() {
+	stats, err := s.Stats()
+	if err != nil {
+		logger.Debug.Printf("Unable to read capture statistics: %v", err)
+		return
+	}
+	received, dropped, ifDropped := uint32(stats.PacketsReceived), uint32(stats.PacketsDropped), uint32(stats.PacketsIfDropped)
+	// The counters are 32-bit and wrap around, which the differences survive
+	s.receivedCount.Add(float64(received - s.received))
+	s.droppedCount.Add(float64(dropped - s.dropped))
+	s.ifDroppedCount.Add(float64(ifDropped - s.ifDropped))
+	s.received, s.dropped, s.ifDropped = received, dropped, ifDropped
+}
+
+// open opens the sources of the parser: the pcap files, read one after the
+// other as a single source, or every interface, each read from one source or
+// more sockets sharing it. Sources waiting to replay packets stop once stop is
+// closed.
+func (p *parser) open(stop <-chan struct{}) ([]source, error) {
+	if len(p.pcapFiles) > 0 {
+		src := &fileSource{files: p.pcapFiles, filter: p.filter}
+		if err := src.next(); err != nil {
+			return nil, err
+		}
+		if p.replay > 0 {
+			logger.Info.Printf("Replaying pcaps at %vx speed", p.replay)
+			return []source{&replaySource{source: src, speed: p.replay, stop: stop}}, nil
+		}
+		return []source{src}, nil
+	}
+
+	var sources []source
+	for _, iface := range p.ifaces {
+		logger.Info.Printf("Starting %s capture on interface %q with filter %v", p.backend, iface, p.filter)
+		var opened []source
+		var err error
+		switch p.backend {
+		case "pcap":
+			opened, err = openPcap(iface, p.filter, p.snaplen, p.timeout)
+		case "afpacket":
+			opened, err = openAFPacket(iface, p.filter, p.snaplen, p.timeout, p.afpacket)
+		default:
+			err = fmt.Errorf("[Config] Unknown capture backend %q", p.backend)
+		}
+		if err != nil {
+			closeSources(sources)
+			return nil, err
+		}
+		sources = append(sources, opened...)
+	}
+	return sources, nil
+}
+
+// openPcap opens a live libpcap capture on iface
+func openPcap(iface, filter string, snaplen int, timeout time.Duration) ([]source, error) {
+	handle, err := pcap.OpenLive(iface, int32(snaplen), true, timeout)
+	if err != nil {
+		return nil, err
+	}
+	if err = handle.SetBPFFilter(filter); err != nil {
+		handle.Close()
+		return nil, err
+	}
+	label := prometheus.Labels{"source": iface}
+	return []source{&pcapSource{
+		Handle:         handle,
+		name:           iface,
+		receivedCount:  CapturePacketsCount.With(label),
+		droppedCount:   CaptureDroppedCount.With(label),
+		ifDroppedCount: CaptureIfDroppedCount.With(label),
+	}}, nil
+}
+
+// fileSource reads capture files one after the other, as a single capture whose
+// clock runs across files
+type fileSource struct {
+	files  []string // files left to read
+	filter string
+
+	handle *captureFile
+	name   string // file being read
+	opened bool   // whether or not a file was opened yet
+}
+
+// next opens the next file that can be read, or returns the error of the first
+// file
+func (s *fileSource) next() error {
+	for len(s.files) > 0 {
+		s.name, s.files = s.files[0], s.files[1:]
+		logger.Info.Printf("Read from pcap: %q", s.name)
+		handle, err := openCaptureFile(s.name, s.filter)
+		if err == nil {
+			s.handle = handle
+			s.opened = true
+			return nil
+		}
+		if !s.opened {
+			return err
+		}
+		// A bad file among many is skipped
+		logger.Info.Printf("Unable to read pcap %q: %v", s.name, err)
+	}
+	return io.EOF
+}
+
+// ZeroCopyReadPacketData reads the next packet of the current file, moving on to
+// the next file at the end of the current one
+func (s *fileSource) ZeroCopyReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	for {
+		if s.handle == nil {
+			if err := s.next(); err != nil {
+				return nil, gopacket.CaptureInfo{}, err
+			}
+		}
+		data, ci, err := s.handle.ZeroCopyReadPacketData()
+		if err == nil {
+			return data, ci, nil
+		}
+		switch err {
+		case io.EOF:
+		case io.ErrUnexpectedEOF:
+			// Files of a capture still being written, or cut short, end early
+			logger.Info.Printf("Truncated pcap: %q", s.name)
+		default:
+			logger.Info.Printf("Unable to read pcap %q: %v", s.name, err)
+		}
+		s.handle.Close()
+		s.handle = nil
+	}
+}
+
+func (s *fileSource) LinkType() layers.LinkType { return s.handle.LinkType() }
+func (s *fileSource) Name() string              { return s.name }
+
+func (s *fileSource) Close() {
+	if s.handle != nil {
+		s.handle.Close()
+	}
+}
+
+// replaySource paces the packets of a source by their capture timestamps, at a
+// multiple of their speed. Packets are stamped with the time they are due at, as
+// a live capture would, so that streams time out on the wall clock.
+type replaySource struct {
+	source
+	speed float64
+	stop  <-chan struct{}
+
+	first time.Time // capture time of the first packet
+	start time.Time // time the first packet was replayed at
+	last  time.Time // time the last packet was replayed at
+}
+
+// ZeroCopyReadPacketData waits until the next packet is due and returns it,
+// or returns io.EOF once stop is closed
+func (s *replaySource) ZeroCopyReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	data, ci, err := s.source.ZeroCopyReadPacketData()
+	if err != nil {
+		return data, ci, err
+	}
+	if s.start.IsZero() {
+		s.first, s.start = ci.Timestamp, time.Now()
+	}
+	due := s.start.Add(time.Duration(float64(ci.Timestamp.Sub(s.first)) / s.speed))
+	if wait := time.Until(due); wait > 0 {
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-s.stop:
+			timer.Stop()
+			return nil, ci, io.EOF
+		}
+	}
+	// Time does not go back on packets captured out of order, or across files
+	if due.Before(s.last) {
+		due = s.last
+	}
+	s.last = due
+	ci.Timestamp = due
+	return data, ci, nil
+}
+
+// expandPcapFiles returns the files matched by a list of files, glob patterns
+// and directories, whose files are read in lexical order. Standard input is
+// named "-".
+func expandPcapFiles(patterns []string) ([]string, error) {
+	var files []string
+	for _, pattern := range patterns {
+		if pattern == "-" {
+			files = append(files, pattern)
+			continue
+		}
+		if info, err := os.Stat(pattern); err == nil {
+			if !info.IsDir() {
+				files = append(files, pattern)
+				continue
+			}
+			entries, err := ioutil.ReadDir(pattern)
+			if err != nil {
+				return nil, err
+			}
+			for _, entry := range entries {
+				if entry.Mode().IsRegular() && !strings.HasPrefix(entry.Name(), ".") {
+					files = append(files, filepath.Join(pattern, entry.Name()))
+				}
+			}
+			continue
+		}
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("[Config] Invalid pcap pattern %q: %v", pattern, err)
+		}
+		// As in shells, wildcards do not match hidden files
+		hidden := strings.HasPrefix(filepath.Base(pattern), ".")
+		n := len(files)
+		for _, match := range matches {
+			if hidden || !strings.HasPrefix(filepath.Base(match), ".") {
+				files = append(files, match)
+			}
+		}
+		if len(files) == n {
+			return nil, fmt.Errorf("[Config] No pcap file matches %q", pattern)
+		}
+	}
+	return files, nil
+}
+
+// closeSources closes sources once nothing reads them anymore
+func closeSources(sources []source) {
+	for _, src := range sources {
+		src.Close()
+	}
+}
+
+// updateStats exports the statistics of the sources keeping them
+func updateStats(sources []source) {
+	for _, src := range sources {
+		if s, ok := src.(statsSource); ok {
+			s.updateStats()
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package parser
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/Kkevsterrr/gopacket"
+	"github.com/Kkevsterrr/gopacket/layers"
+)
+
+func TestUnitExpandPcapFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tripwire")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"b.pcap", "a.pcap", "c.pcap.gz", ".hidden.pcap", "sub/d.pcap"} {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	join := func(names ...string) []string {
+		var paths []string
+		for _, name := range names {
+			paths = append(paths, filepath.Join(dir, name))
+		}
+		return paths
+	}
+
+	tests := []struct {
+		patterns []string
+		expected []string
+	}{
+		{patterns: join("b.pcap"), expected: join("b.pcap")},
+		{patterns: join("*.pcap"), expected: join("a.pcap", "b.pcap")},
+		{patterns: []string{dir}, expected: join("a.pcap", "b.pcap", "c.pcap.gz")},
+		{patterns: append(join("sub"), "-"), expected: append(join("sub/d.pcap"), "-")},
+	}
+	for _, test := range tests {
+		files, err := expandPcapFiles(test.patterns)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(files, test.expected) {
+			t.Fatalf("Expected %v but got %v", test.expected, files)
+		}
+	}
+
+	if _, err := expandPcapFiles(join("*.pcapng")); err == nil {
+		t.Fatalf("Expected error but got %v", err)
+	}
+}
+
+// timedSource returns packets captured at the given offsets from the epoch
+type timedSource struct {
+	offsets []time.Duration
+}
+
+func (s *timedSource) ZeroCopyReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	if len(s.offsets) == 0 {
+		return nil, gopacket.CaptureInfo{}, io.EOF
+	}
+	ci := gopacket.CaptureInfo{Timestamp: time.Unix(0, 0).Add(s.offsets[0])}
+	s.offsets = s.offsets[1:]
+	return nil, ci, nil
+}
+
+func (s *timedSource) LinkType() layers.LinkType { return layers.LinkTypeEthernet }
+func (s *timedSource) Name() string              { return "timed" }
+func (s *timedSource) Close()                    {}
+
+func TestUnitReplaySource(t *testing.T) {
+	// Packets are paced at ten times their speed, and time does not go back
+	offsets := []time.Duration{0, 200 * time.Millisecond, 100 * time.Millisecond, 500 * time.Millisecond}
+	expected := []time.Duration{0, 20 * time.Millisecond, 20 * time.Millisecond, 50 * time.Millisecond}
+	src := &replaySource{source: &timedSource{offsets: offsets}, speed: 10}
+	start := time.Now()
+	var first time.Time
+	for i := range offsets {
+		_, ci, err := src.ZeroCopyReadPacketData()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i == 0 {
+			first = ci.Timestamp
+		}
+		if offset := ci.Timestamp.Sub(first); offset != expected[i] {
+			t.Fatalf("Expected %v but got %v", expected[i], offset)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond || elapsed > 500*time.Millisecond {
+		t.Fatalf("Expected about %v but got %v", 50*time.Millisecond, elapsed)
+	}
+	if _, _, err := src.ZeroCopyReadPacketData(); err != io.EOF {
+		t.Fatalf("Expected %v but got %v", io.EOF, err)
+	}
+
+	// Waiting for a packet ends once the parser stops
+	stop := make(chan struct{})
+	src = &replaySource{source: &timedSource{offsets: []time.Duration{0, time.Hour}}, speed: 1, stop: stop}
+	if _, _, err := src.ZeroCopyReadPacketData(); err != nil {
+		t.Fatal(err)
+	}
+	time.AfterFunc(10*time.Millisecond, func() { close(stop) })
+	if _, _, err := src.ZeroCopyReadPacketData(); err != io.EOF {
+		t.Fatalf("Expected %v but got %v", io.EOF, err)
+	}
+}
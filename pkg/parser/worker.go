@@ -0,0 +1,143 @@
+package parser
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"tripwire/pkg/decode"
+	"tripwire/pkg/logger"
+
+	"github.com/Kkevsterrr/gopacket/reassembly"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	WorkerPacketsCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tripwire_worker_packets_count",
+		Help: "Number of TCP packets assembled by each worker.",
+	}, []string{"worker"})
+	WorkerDroppedCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tripwire_worker_dropped_count",
+		Help: "Number of packets dropped because the queue of a worker was full.",
+	}, []string{"worker"})
+	WorkerQueueLength = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "tripwire_worker_queue_length",
+		Help: "Number of packets waiting in the queue of each worker.",
+	}, []string{"worker"})
+	WorkerPagesUsed = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "tripwire_worker_pages_used",
+		Help: "Number of pages buffering out of order segments in the assembler of each worker.",
+	}, []string{"worker"})
+	WorkerPagesAllocated = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "tripwire_worker_pages_allocated",
+		Help: "Number of pages allocated by the assembler of each worker, used or not.",
+	}, []string{"worker"})
+)
+
+// pageSize is the size of the pages in which the assembler buffers out of order
+// segments (reassembly.pageBytes)
+const pageSize = 1900
+
+// job is a packet to assemble, or a flush of the streams timed out at now if
+// packet is nil
+type job struct {
+	packet *decode.Packet
+	now    time.Time
+	count  int // number of packets read so far
+}
+
+// worker assembles the streams of its share of the flows. Each worker owns its
+// assembler and stream factory, so a stream is only ever handled by one goroutine.
+type worker struct {
+	assembler     *reassembly.Assembler
+	streamFactory StreamFactory
+	maxTimeout    time.Duration
+	jobs          chan job
+	pool          *decode.Pool // where assembled packets are recycled
+
+	packets        prometheus.Counter
+	dropped        prometheus.Counter
+	queueLength    prometheus.Gauge
+	pagesUsed      prometheus.Gauge
+	pagesAllocated prometheus.Gauge
+}
+
+func newWorker(id int, streamFactory StreamFactory, maxTimeout time.Duration, queueSize int, maxPages int) *worker {
+	label := prometheus.Labels{"worker": strconv.Itoa(id)}
+	assembler := reassembly.NewAssembler(reassembly.NewStreamPool(streamFactory))
+	// Past the budget, the assembler gives up on the gaps of the connection at hand
+	assembler.MaxBufferedPagesTotal = maxPages
+	return &worker{
+		assembler:      assembler,
+		streamFactory:  streamFactory,
+		maxTimeout:     maxTimeout,
+		jobs:           make(chan job, queueSize),
+		packets:        WorkerPacketsCount.With(label),
+		dropped:        WorkerDroppedCount.With(label),
+		queueLength:    WorkerQueueLength.With(label),
+		pagesUsed:      WorkerPagesUsed.With(label),
+		pagesAllocated: WorkerPagesAllocated.With(label),
+	}
+}
+
+// run processes jobs until the queue is closed
+func (w *worker) run(wg *sync.WaitGroup) {
+	defer wg.Done()
+	for j := range w.jobs {
+		w.queueLength.Set(float64(len(w.jobs)))
+		w.process(j)
+	}
+}
+
+func (w *worker) process(j job) {
+	if j.packet == nil {
+		w.flush(j.now, j.count)
+		return
+	}
+	w.packets.Inc()
+	// The assembler keeps the context of out of order packets, so it gets its own
+	// copy of the capture info
+	c := packetContext{
+		CaptureInfo: j.packet.CaptureInfo,
+		packet:      j.packet,
+	}
+	w.assembler.AssembleWithContext(j.packet.NetworkFlow(), nil, j.packet.TCP, &c)
+	w.pool.Put(j.packet)
+
+	// Remove the connections of evicted streams from the assembler, which cannot
+	// be done while it creates the stream that caused the eviction
+	if ended, evicted := w.streamFactory.Evicted(); evicted {
+		flushed, closed := w.assembler.FlushCloseOlderThan(ended)
+		logger.Debug.Printf("Eviction flush: %d flushed, %d closed", flushed, closed)
+	}
+}
+
+// flush closes the streams that timed out by now, and removes the connections
+// older than the longest timeout from the assembler
+func (w *worker) flush(now time.Time, count int) {
+	expired := w.streamFactory.Expire(now)
+	flushed, closed := w.assembler.FlushCloseOlderThan(now.Add(-w.maxTimeout))
+	logger.Debug.Printf("Forced flush: %d expired, %d flushed, %d closed, %d total", expired, flushed, closed, count)
+	w.updatePages()
+}
+
+// updatePages exports the page usage of the assembler, which only reports it
+// through Dump
+func (w *worker) updatePages() {
+	var used, size, free int
+	if _, err := fmt.Sscanf(w.assembler.Dump(), "pageCache: used: %d, size: %d, free: %d", &used, &size, &free); err != nil {
+		logger.Debug.Printf("Unable to read page usage: %v", err)
+		return
+	}
+	w.pagesUsed.Set(float64(used))
+	w.pagesAllocated.Set(float64(size))
+}
+
+// close closes all remaining streams once the worker has stopped
+func (w *worker) close(count int) {
+	w.streamFactory.Shutdown()
+	closed := w.assembler.FlushAll()
+	logger.Debug.Printf("Final flush: %d closed, %d total", closed, count)
+}
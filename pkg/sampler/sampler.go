@@ -0,0 +1,249 @@
+package sampler
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"tripwire/pkg/collector"
+	"tripwire/pkg/config"
+	"tripwire/pkg/decode"
+	"tripwire/pkg/detector"
+
+	"github.com/Kkevsterrr/gopacket"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	SampledStreamsCount = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "tripwire_sampled_streams_count",
+			Help: "Number of non-disrupted streams written as baseline samples.",
+		},
+		[]string{"detector"},
+	)
+)
+
+// hashBuckets is the resolution of rate sampling
+const hashBuckets = 1 << 20
+
+// Sampler selects non-disrupted streams to be written as a baseline, per
+// detector and optionally per client prefix. Rate sampling is decided by a
+// hash of the stream's flows, so the same streams are selected on every run;
+// reservoir sampling keeps a uniform sample of streams which is written every
+// interval and at exit. Reservoirs are kept for the most recently sampled
+// prefixes of each detector.
+// It is safe for concurrent use.
+type Sampler struct {
+	policies map[string]policy // detector label -> sampling policy
+
+	sync.Mutex
+	rng        *rand.Rand
+	reservoirs map[reservoirKey]*list.Element // -> element of the lru of the detector
+	lrus       map[string]*list.List          // detector label -> *reservoir, most recently sampled first
+	starts     map[string]time.Time           // detector label -> when its reservoirs were last written
+}
+
+type policy struct {
+	threshold              uint64 // rate sampling: hash buckets below threshold are sampled
+	reservoir              int
+	perPrefix              bool
+	prefixLen4, prefixLen6 int
+	maxPrefixes            int
+	interval               time.Duration
+}
+
+type reservoirKey struct {
+	detector, prefix string
+}
+
+type reservoir struct {
+	key     reservoirKey
+	seen    int
+	entries []entry
+}
+
+type entry struct {
+	detector  detector.Detector
+	collector collector.Collector
+	outcome   detector.Outcome
+}
+
+// NewSampler returns a sampler for the detectors configured with sampling, or
+// nil if there are none
+func NewSampler(cfgs []config.DetectorConfig) (*Sampler, error) {
+	policies := make(map[string]policy)
+	for _, cfg := range cfgs {
+		sampling := cfg.Sampling
+		if sampling == nil {
+			continue
+		}
+		if sampling.Rate < 0 || sampling.Rate > 1 {
+			return nil, fmt.Errorf("[Config] Invalid sampling rate %v for detector %s", sampling.Rate, cfg.Name)
+		}
+		if sampling.Reservoir < 0 {
+			return nil, fmt.Errorf("[Config] Invalid sampling reservoir %v for detector %s", sampling.Reservoir, cfg.Name)
+		}
+		if sampling.Rate > 0 && sampling.Reservoir > 0 {
+			return nil, errors.New("[Config] Please specify only one of sampling rate and reservoir for detector " + cfg.Name)
+		}
+		if sampling.Rate > 0 && sampling.PerPrefix {
+			return nil, errors.New("[Config] Per prefix sampling only applies to reservoirs, not rates, for detector " + cfg.Name)
+		}
+		policies[cfg.Name] = policy{
+			threshold:   uint64(sampling.Rate * hashBuckets),
+			reservoir:   sampling.Reservoir,
+			perPrefix:   sampling.PerPrefix,
+			prefixLen4:  sampling.PrefixLen4,
+			prefixLen6:  sampling.PrefixLen6,
+			maxPrefixes: sampling.MaxPrefixes,
+			interval:    sampling.Interval,
+		}
+	}
+	if len(policies) == 0 {
+		return nil, nil
+	}
+	return &Sampler{
+		policies:   policies,
+		rng:        rand.New(rand.NewSource(1)),
+		reservoirs: make(map[reservoirKey]*list.Element),
+		lrus:       make(map[string]*list.List),
+		starts:     make(map[string]time.Time),
+	}, nil
+}
+
+// Sample offers a non-disrupted stream to the sampler. It returns the detectors
+// whose rate sampling selected the stream, which should be written right away;
+// streams may additionally be retained by reservoirs until Expire or Flush.
+func (s *Sampler) Sample(net, transport gopacket.Flow, detectors []detector.Detector, c collector.Collector,
+	outcome detector.Outcome) []detector.Detector {
+	var sampled []detector.Detector
+	hash := decode.MixHash(net.FastHash()*31+transport.FastHash()) % hashBuckets
+	for _, det := range detectors {
+		p, ok := s.policies[det.Label()]
+		if !ok {
+			continue
+		}
+		if hash < p.threshold {
+			sampled = append(sampled, det)
+			SampledStreamsCount.With(prometheus.Labels{"detector": det.Label()}).Inc()
+		}
+		if p.reservoir > 0 {
+			key := reservoirKey{detector: det.Label()}
+			if p.perPrefix {
+				key.prefix = decode.ClientPrefix(net.Src(), p.prefixLen4, p.prefixLen6)
+			}
+			s.offer(key, p, entry{det, c, outcome})
+		}
+	}
+	return sampled
+}
+
+// offer adds an entry to a reservoir using Algorithm R. Past the maximum
+// number of prefixes of the detector, the reservoir of the least recently
+// sampled prefix is dropped.
+func (s *Sampler) offer(key reservoirKey, p policy, e entry) {
+	s.Lock()
+	defer s.Unlock()
+	element, ok := s.reservoirs[key]
+	if ok {
+		s.lrus[key.detector].MoveToFront(element)
+	} else {
+		lru := s.lrus[key.detector]
+		if lru == nil {
+			lru = list.New()
+			s.lrus[key.detector] = lru
+		}
+		element = lru.PushFront(&reservoir{key: key})
+		s.reservoirs[key] = element
+		for p.maxPrefixes > 0 && lru.Len() > p.maxPrefixes {
+			oldest := lru.Remove(lru.Back()).(*reservoir)
+			delete(s.reservoirs, oldest.key)
+		}
+	}
+	r := element.Value.(*reservoir)
+	r.seen++
+	if len(r.entries) < p.reservoir {
+		r.entries = append(r.entries, e)
+	} else if i := s.rng.Intn(r.seen); i < p.reservoir {
+		r.entries[i] = e
+	}
+}
+
+// Expire writes the streams retained by the reservoirs of the detectors whose
+// interval elapsed since they were last written, and empties them, so that
+// long-running captures write baseline samples as they go. It is called with
+// the time of every flush.
+func (s *Sampler) Expire(now time.Time, write func(detectors []detector.Detector, c collector.Collector, outcome detector.Outcome)) {
+	s.Lock()
+	expired := make(map[string]bool)
+	for label, p := range s.policies {
+		start, ok := s.starts[label]
+		if !ok {
+			s.starts[label] = now
+		} else if p.interval > 0 && now.Sub(start) >= p.interval {
+			s.starts[label] = now
+			expired[label] = true
+		}
+	}
+	s.Unlock()
+	if len(expired) > 0 {
+		s.flush(func(label string) bool { return expired[label] }, write)
+	}
+}
+
+// Flush writes the streams retained by reservoirs and empties them. A stream
+// kept by several detectors is written once.
+func (s *Sampler) Flush(write func(detectors []detector.Detector, c collector.Collector, outcome detector.Outcome)) {
+	s.flush(func(string) bool { return true }, write)
+}
+
+// flush writes the streams retained by the reservoirs of the selected detectors
+// and empties them
+func (s *Sampler) flush(selected func(label string) bool,
+	write func(detectors []detector.Detector, c collector.Collector, outcome detector.Outcome)) {
+	s.Lock()
+	var keys []reservoirKey
+	for key := range s.reservoirs {
+		if selected(key.detector) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].detector != keys[j].detector {
+			return keys[i].detector < keys[j].detector
+		}
+		return keys[i].prefix < keys[j].prefix
+	})
+
+	var collectors []collector.Collector
+	detectors := make(map[collector.Collector][]detector.Detector)
+	outcomes := make(map[collector.Collector]detector.Outcome)
+	for _, key := range keys {
+		for _, e := range s.reservoirs[key].Value.(*reservoir).entries {
+			if _, ok := detectors[e.collector]; !ok {
+				collectors = append(collectors, e.collector)
+				outcomes[e.collector] = e.outcome
+			}
+			detectors[e.collector] = append(detectors[e.collector], e.detector)
+		}
+		delete(s.reservoirs, key)
+	}
+	for label := range s.lrus {
+		if selected(label) {
+			delete(s.lrus, label)
+		}
+	}
+	s.Unlock()
+
+	for _, c := range collectors {
+		for _, det := range detectors[c] {
+			SampledStreamsCount.With(prometheus.Labels{"detector": det.Label()}).Inc()
+		}
+		write(detectors[c], c, outcomes[c])
+	}
+}
@@ -0,0 +1,189 @@
+package sampler
+
+import (
+	"net"
+	"testing"
+	"time"
+	"tripwire/pkg/collector"
+	"tripwire/pkg/config"
+	"tripwire/pkg/detector"
+
+	"github.com/Kkevsterrr/gopacket"
+	"github.com/Kkevsterrr/gopacket/layers"
+)
+
+func TestUnitSampler(t *testing.T) {
+	detectorConfigs := []config.DetectorConfig{
+		{Name: "http_80_rstacks", Signature: "RSTACKs", Protocol: "HTTP", Port: 80,
+			Sampling: &config.SamplingConfig{Rate: 1}},
+		{Name: "https_443_rstacks", Signature: "RSTACKs", Protocol: "HTTPS", Port: 443,
+			Sampling: &config.SamplingConfig{Reservoir: 2, PerPrefix: true, PrefixLen4: 24, PrefixLen6: 48}},
+		{Name: "http_8080_rstacks", Signature: "RSTACKs", Protocol: "HTTP", Port: 8080},
+	}
+	s, err := NewSampler(detectorConfigs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	detectors := make(map[string]detector.Detector)
+	for _, cfg := range detectorConfigs {
+		df, err := detector.NewDetectorFactory(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		detectors[cfg.Name] = df.NewDetector(gopacket.Flow{}, gopacket.Flow{}, nil)
+	}
+	cf, err := collector.NewCollectorFactory(config.CollectorConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stream := func(client net.IP, port uint16) (gopacket.Flow, gopacket.Flow) {
+		netFlow, _ := gopacket.FlowFromEndpoints(layers.NewIPEndpoint(client), layers.NewIPEndpoint(net.IP{5, 6, 7, 8}))
+		transportFlow, _ := gopacket.FlowFromEndpoints(layers.NewTCPPortEndpoint(layers.TCPPort(port)), layers.NewTCPPortEndpoint(443))
+		return netFlow, transportFlow
+	}
+
+	// Rate sampling writes right away, other detectors never do
+	netFlow, transportFlow := stream(net.IP{1, 2, 3, 4}, 40000)
+	sampled := s.Sample(netFlow, transportFlow, []detector.Detector{detectors["http_80_rstacks"], detectors["http_8080_rstacks"]},
+		cf.NewCollector(netFlow, transportFlow, nil), detector.OutcomeFIN)
+	if len(sampled) != 1 || sampled[0].Label() != "http_80_rstacks" {
+		t.Fatalf("Expected %v but got %v", "[http_80_rstacks]", sampled)
+	}
+
+	// Reservoirs keep at most two streams per client prefix
+	for i := 0; i < 10; i++ {
+		for _, client := range []net.IP{{1, 2, 3, byte(i)}, {9, 9, 9, byte(i)}} {
+			netFlow, transportFlow := stream(client, uint16(40000+i))
+			sampled := s.Sample(netFlow, transportFlow, []detector.Detector{detectors["https_443_rstacks"]},
+				cf.NewCollector(netFlow, transportFlow, nil), detector.OutcomeRST)
+			if len(sampled) != 0 {
+				t.Fatalf("Expected %v but got %v", 0, len(sampled))
+			}
+		}
+	}
+	var written int
+	s.Flush(func(d []detector.Detector, c collector.Collector, outcome detector.Outcome) {
+		if len(d) != 1 || d[0].Label() != "https_443_rstacks" {
+			t.Fatalf("Expected %v but got %v", "[https_443_rstacks]", d)
+		}
+		if outcome != detector.OutcomeRST {
+			t.Fatalf("Expected %v but got %v", detector.OutcomeRST, outcome)
+		}
+		written++
+	})
+	if written != 4 {
+		t.Fatalf("Expected %v but got %v", 4, written)
+	}
+	s.Flush(func(d []detector.Detector, c collector.Collector, outcome detector.Outcome) {
+		t.Fatalf("Expected reservoirs to be empty after flush")
+	})
+}
+
+func TestUnitSamplerConfig(t *testing.T) {
+	var tests = []struct {
+		sampling *config.SamplingConfig
+		valid    bool
+	}{
+		{sampling: nil, valid: true},
+		{sampling: &config.SamplingConfig{Rate: 0.1}, valid: true},
+		{sampling: &config.SamplingConfig{Reservoir: 10}, valid: true},
+		{sampling: &config.SamplingConfig{Rate: 1.5}, valid: false},
+		{sampling: &config.SamplingConfig{Reservoir: -1}, valid: false},
+		{sampling: &config.SamplingConfig{Rate: 0.1, Reservoir: 10}, valid: false},
+		{sampling: &config.SamplingConfig{Reservoir: 10, PerPrefix: true}, valid: true},
+		{sampling: &config.SamplingConfig{Rate: 0.1, PerPrefix: true}, valid: false},
+	}
+
+	for i, test := range tests {
+		_, err := NewSampler([]config.DetectorConfig{{Name: "http_80_rstacks", Sampling: test.sampling}})
+		if (err == nil) != test.valid {
+			t.Errorf("test %d: got %v, want valid %v", i, err, test.valid)
+		}
+	}
+}
+
+func TestUnitSamplerRate(t *testing.T) {
+	detectorConfig := config.DetectorConfig{Name: "http_80_rstacks", Signature: "RSTACKs", Protocol: "HTTP", Port: 80,
+		Sampling: &config.SamplingConfig{Rate: 0.25}}
+	s, err := NewSampler([]config.DetectorConfig{detectorConfig})
+	if err != nil {
+		t.Fatal(err)
+	}
+	df, err := detector.NewDetectorFactory(detectorConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	detectors := []detector.Detector{df.NewDetector(gopacket.Flow{}, gopacket.Flow{}, nil)}
+
+	// The parser spreads flows across workers by the same hash, so the streams
+	// of each worker must still be sampled at the rate
+	const workers = 4
+	var streams, sampled [workers]int
+	for i := 0; i < 20000; i++ {
+		netFlow, _ := gopacket.FlowFromEndpoints(layers.NewIPEndpoint(net.IP{10, 0, byte(i >> 8), byte(i)}),
+			layers.NewIPEndpoint(net.IP{5, 6, 7, 8}))
+		transportFlow, _ := gopacket.FlowFromEndpoints(layers.NewTCPPortEndpoint(layers.TCPPort(40000+i%1000)),
+			layers.NewTCPPortEndpoint(80))
+		worker := (netFlow.FastHash()*31 + transportFlow.FastHash()) % workers
+		streams[worker]++
+		if len(s.Sample(netFlow, transportFlow, detectors, nil, detector.OutcomeFIN)) > 0 {
+			sampled[worker]++
+		}
+	}
+	for worker := range streams {
+		if rate := float64(sampled[worker]) / float64(streams[worker]); rate < 0.2 || rate > 0.3 {
+			t.Fatalf("worker %d: Expected %v but got %v", worker, 0.25, rate)
+		}
+	}
+}
+
+func TestUnitSamplerReservoirs(t *testing.T) {
+	detectorConfig := config.DetectorConfig{Name: "https_443_rstacks", Signature: "RSTACKs", Protocol: "HTTPS", Port: 443,
+		Sampling: &config.SamplingConfig{Reservoir: 1, PerPrefix: true, PrefixLen4: 24, PrefixLen6: 48,
+			MaxPrefixes: 2, Interval: time.Hour}}
+	s, err := NewSampler([]config.DetectorConfig{detectorConfig})
+	if err != nil {
+		t.Fatal(err)
+	}
+	df, err := detector.NewDetectorFactory(detectorConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	detectors := []detector.Detector{df.NewDetector(gopacket.Flow{}, gopacket.Flow{}, nil)}
+	cf, err := collector.NewCollectorFactory(config.CollectorConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Past two prefixes, the reservoir of the least recently sampled is dropped
+	collectors := make(map[collector.Collector]string)
+	for _, client := range []net.IP{{1, 2, 3, 4}, {9, 9, 9, 9}, {1, 2, 3, 5}, {5, 5, 5, 5}} {
+		netFlow, _ := gopacket.FlowFromEndpoints(layers.NewIPEndpoint(client), layers.NewIPEndpoint(net.IP{5, 6, 7, 8}))
+		c := cf.NewCollector(netFlow, gopacket.Flow{}, nil)
+		collectors[c] = client.String()
+		s.Sample(netFlow, gopacket.Flow{}, detectors, c, detector.OutcomeFIN)
+	}
+	if len(s.reservoirs) != 2 || s.lrus["https_443_rstacks"].Len() != 2 {
+		t.Fatalf("Expected %v but got %v", 2, len(s.reservoirs))
+	}
+
+	// Reservoirs are written once the interval elapsed since they last were
+	var written []string
+	write := func(d []detector.Detector, c collector.Collector, outcome detector.Outcome) {
+		written = append(written, collectors[c])
+	}
+	start := time.Unix(0, 0)
+	for _, now := range []time.Time{start, start.Add(time.Minute)} {
+		if s.Expire(now, write); len(written) != 0 {
+			t.Fatalf("Expected %v but got %v", 0, written)
+		}
+	}
+	s.Expire(start.Add(time.Hour), write)
+	if len(written) != 2 || written[1] != "5.5.5.5" {
+		t.Fatalf("Expected %v but got %v", "[1.2.3.x 5.5.5.5]", written)
+	}
+	if len(s.reservoirs) != 0 || len(s.lrus) != 0 {
+		t.Fatalf("Expected %v but got %v", 0, len(s.reservoirs))
+	}
+}
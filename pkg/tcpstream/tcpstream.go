@@ -2,13 +2,19 @@ package tcpstream
 
 import (
 	"fmt"
+	"sort"
 	"strconv"
 	"sync"
+	"time"
 
 	"tripwire/pkg/collector"
 	"tripwire/pkg/config"
+	"tripwire/pkg/decode"
 	"tripwire/pkg/detector"
+	"tripwire/pkg/discovery"
+	"tripwire/pkg/features"
 	"tripwire/pkg/logger"
+	"tripwire/pkg/sampler"
 
 	"github.com/Kkevsterrr/gopacket"
 	"github.com/Kkevsterrr/gopacket/layers"
@@ -24,18 +30,93 @@ var (
 		},
 		[]string{"detector", "disrupted"},
 	)
+	StreamOutcomesCount = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "tripwire_stream_outcomes_count",
+			Help: "Number of streams observed by the reason they ended.",
+		},
+		[]string{"detector", "outcome"},
+	)
+	StreamEvictionsCount = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "tripwire_stream_evictions_count",
+			Help: "Number of streams evicted to stay within the maximum number of streams, by state.",
+		},
+		[]string{"state"},
+	)
+	StreamsActive = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "tripwire_streams_active",
+			Help: "Number of streams currently tracked.",
+		},
+	)
+	ReassemblyPacketsCount = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "tripwire_reassembly_packets_count",
+			Help: "Number of packets buffered because they arrived out of order, or overlapping data already reassembled.",
+		},
+		[]string{"kind"},
+	)
+	MissingBytesCount = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "tripwire_reassembly_missing_bytes_count",
+			Help: "Number of bytes reassembly gave up waiting for, which were lost or never captured, by direction.",
+		},
+		[]string{"direction"}, // client or server, whichever sent the missing bytes
+	)
 )
 
+// invalidSequence is the next sequence number of the halves of the connections
+// the assembler has not started reassembling yet (reassembly.invalidSequence)
+const invalidSequence = reassembly.Sequence(-1)
+
+// packetContext is implemented by the assembler context of the packets read by
+// the parser, which carries their decode context
+type packetContext interface {
+	Packet() *decode.Packet
+}
+
 // tcpStreamFactory implements reassembly.StreamFactory
 // https://godoc.org/github.com/Kkevsterrr/gopacket/reassembly#StreamFactory
 type tcpStreamFactory struct {
 	allowMissingInit  bool // Allow for creating flows without actual TCP handshake
 	maxPacketCount    int  // Maximum number of packets to accept from each of the client and server
+	timeouts          config.TimeoutConfig
+	maxStreams        int     // Streams tracked at once, beyond which streams are evicted
+	sampleRate        float64 // Number of flows each assembled flow stands for under flow sampling
 	detectorFactories []detector.DetectorFactory
 	collectorFactory  collector.CollectorFactory
-	streamWriter      func(detector []detector.Detector, collector collector.Collector)
+	streamWriter      StreamWriter
+	sampler           *sampler.Sampler      // nil unless baseline sampling is configured
+	discovery         *discovery.Aggregator // nil unless discovery mode is enabled
+	featureWriter     FeatureWriter         // nil unless feature export is enabled
+
+	// Streams whose verdicts have not been written yet, in order of creation
+	streams []*tcpStream
+	active  int // number of streams in streams not done yet
+
+	// Whether or not streams were evicted since the last call to Evicted, and
+	// the time after which none of them was seen
+	evicted bool
+	ended   time.Time
+
+	// Streams still tracked whose connections the assembler closed along with
+	// those of evicted streams, by flow, until their next packet
+	detached map[[2]gopacket.Flow]*tcpStream
+
+	// Whether or not the remaining streams are being closed because the parser stopped
+	shutdown bool
 }
 
+// StreamWriter writes the collected fields of a stream along with the detectors
+// that flagged it, or that sampled it as a baseline if it was not disrupted
+type StreamWriter func(detectors []detector.Detector, collector collector.Collector, disrupted bool, outcome detector.Outcome)
+
+// FeatureWriter writes the feature vector of every stream, along with the
+// detectors relevant to it whose verdicts serve as labels
+type FeatureWriter func(detectors []detector.Detector, collector collector.Collector, features *features.Features,
+	outcome detector.Outcome)
+
 // tcpStream implements reassembly.Stream
 // https://godoc.org/github.com/Kkevsterrr/gopacket/reassembly#Stream
 type tcpStream struct {
@@ -51,15 +132,36 @@ type tcpStream struct {
 	// Number of packets sent by the client and server
 	maxPacketCount, clientPacketCount, serverPacketCount int
 
+	// State of the connection, and how the stream ended
+	factory     *tcpStreamFactory
+	lastSeen    time.Time
+	established bool
+	fin         [2]bool // FIN sent by the client and server
+	rst         bool
+	truncated   bool
+	evicted     bool
+	detached    bool // whether or not the assembler closed the connection before the stream ended
+	resumed     bool // whether or not the stream was detached, then seen again
+	done        bool // whether or not the verdict has been written
+
 	detectors    []detector.Detector
 	collector    collector.Collector
-	streamWriter func(detector []detector.Detector, collector collector.Collector)
+	streamWriter StreamWriter
+	sampler      *sampler.Sampler
+
+	// Teardown sequence recording for discovery mode
+	discovery *discovery.Aggregator
+	recorder  *discovery.Recorder
+
+	// Feature export
+	featureWriter FeatureWriter
+	extractor     *features.Extractor
 
 	sync.Mutex
 }
 
 func NewTCPStreamFactory(cfg config.TCPConfig, cf collector.CollectorFactory, dfs []detector.DetectorFactory,
-	streamWriter func(detector []detector.Detector, collector collector.Collector)) *tcpStreamFactory {
+	streamWriter StreamWriter, smp *sampler.Sampler, da *discovery.Aggregator, featureWriter FeatureWriter) *tcpStreamFactory {
 	maxPacketCount := cfg.MaxPacketCount
 	if maxPacketCount == 0 {
 		maxPacketCount = 25
@@ -67,13 +169,23 @@ func NewTCPStreamFactory(cfg config.TCPConfig, cf collector.CollectorFactory, df
 	return &tcpStreamFactory{
 		allowMissingInit:  cfg.AllowMissingInit,
 		maxPacketCount:    maxPacketCount,
+		timeouts:          cfg.Timeouts,
+		maxStreams:        cfg.Limits.MaxStreams,
+		sampleRate:        float64(cfg.Sampling.Rate()),
 		collectorFactory:  cf,
 		detectorFactories: dfs,
 		streamWriter:      streamWriter,
+		sampler:           smp,
+		discovery:         da,
+		featureWriter:     featureWriter,
 	}
 }
 
 func (f *tcpStreamFactory) New(net, transport gopacket.Flow, tcp *layers.TCP, ac reassembly.AssemblerContext) reassembly.Stream {
+	if t := f.resume(net, transport); t != nil {
+		logger.Debug.Printf("%s %s: Resumed Connection", net, transport)
+		return t
+	}
 	logger.Debug.Printf("%s %s: New Connection", net, transport)
 
 	var detectors []detector.Detector
@@ -95,11 +207,32 @@ func (f *tcpStreamFactory) New(net, transport gopacket.Flow, tcp *layers.TCP, ac
 		}
 	}
 
-	return &tcpStream{
+	var recorder *discovery.Recorder
+	if f.discovery != nil && len(detectors) > 0 {
+		// Only streams relevant to a detector have a known client and server
+		recorder = f.discovery.NewRecorder()
+	}
+
+	var extractor *features.Extractor
+	if f.featureWriter != nil {
+		extractor = features.NewExtractor()
+	}
+
+	var lastSeen time.Time
+	if ac != nil {
+		lastSeen = ac.GetCaptureInfo().Timestamp
+	}
+	if f.maxStreams > 0 && f.active >= f.maxStreams {
+		f.evict()
+	}
+
+	t := &tcpStream{
 		net:            net,
 		transport:      transport,
 		reversed:       reversed,
 		maxPacketCount: f.maxPacketCount,
+		factory:        f,
+		lastSeen:       lastSeen,
 
 		allowMissingInit: f.allowMissingInit,
 		SYN:              false,
@@ -107,11 +240,155 @@ func (f *tcpStreamFactory) New(net, transport gopacket.Flow, tcp *layers.TCP, ac
 		detectors:    detectors,
 		collector:    f.collectorFactory.NewCollector(net, transport, tcp),
 		streamWriter: f.streamWriter,
+		sampler:      f.sampler,
+		discovery:    f.discovery,
+		recorder:     recorder,
+
+		featureWriter: f.featureWriter,
+		extractor:     extractor,
+	}
+	f.streams = append(f.streams, t)
+	f.active++
+	StreamsActive.Inc()
+	return t
+}
+
+// Expire writes the verdicts of the streams that have not seen a packet for
+// longer than the timeout of their state. Their connections are left to the
+// assembler, which rejects any further packets, until it closes them.
+func (f *tcpStreamFactory) Expire(now time.Time) (expired int) {
+	streams := f.streams[:0]
+	for _, t := range f.streams {
+		if !t.done && now.Sub(t.lastSeen) > t.timeout() {
+			logger.Debug.Printf("%s %s: Timed out", t.net, t.transport)
+			t.finalize()
+			expired++
+		}
+		if !t.done {
+			streams = append(streams, t)
+		}
+	}
+	f.compact(streams)
+	return expired
+}
+
+// evict writes the verdicts of the streams tracked for the longest without
+// completing their handshake, then of those idle for the longest, to make room
+// for new streams. A tenth of the streams are evicted at once so that a flood of
+// new connections does not evict on every one of them.
+func (f *tcpStreamFactory) evict() {
+	var streams []*tcpStream
+	for _, t := range f.streams {
+		if !t.done {
+			streams = append(streams, t)
+		}
+	}
+	sort.SliceStable(streams, func(i, j int) bool {
+		if streams[i].established != streams[j].established {
+			return !streams[i].established
+		}
+		return streams[i].lastSeen.Before(streams[j].lastSeen)
+	})
+	n := len(streams) - f.maxStreams*9/10
+	if n < 1 {
+		n = 1
+	}
+	for _, t := range streams[:n] {
+		state := "handshake"
+		if t.established {
+			state = "established"
+		}
+		logger.Debug.Printf("%s %s: Evicted", t.net, t.transport)
+		t.evicted = true
+		t.finalize()
+		StreamEvictionsCount.With(prometheus.Labels{"state": state}).Inc()
+	}
+
+	// The connections of the evicted streams are removed from the assembler
+	// along with those of the remaining streams seen before them, which are
+	// detached until their next packet
+	f.ended = time.Time{}
+	for _, t := range streams[:n] {
+		if t.lastSeen.After(f.ended) {
+			f.ended = t.lastSeen
+		}
+	}
+	f.ended = f.ended.Add(time.Nanosecond)
+	f.evicted = true
+
+	remaining := f.streams[:0]
+	for _, t := range f.streams {
+		if !t.done {
+			remaining = append(remaining, t)
+		}
+	}
+	f.compact(remaining)
+}
+
+// compact replaces the tracked streams with streams, filtered from them in place
+func (f *tcpStreamFactory) compact(streams []*tcpStream) {
+	for i := len(streams); i < len(f.streams); i++ {
+		f.streams[i] = nil
+	}
+	f.streams = streams
+}
+
+// Evicted returns whether streams were evicted since the last call, and the
+// time before which the connections of all of them were last seen
+func (f *tcpStreamFactory) Evicted() (ended time.Time, evicted bool) {
+	ended, evicted = f.ended, f.evicted
+	f.evicted = false
+	return ended, evicted
+}
+
+// detach keeps track of a stream whose connection the assembler closed before
+// the stream ended, so that it is resumed by the next packet of the connection
+func (f *tcpStreamFactory) detach(t *tcpStream) {
+	logger.Debug.Printf("%s %s: Detached", t.net, t.transport)
+	if f.detached == nil {
+		f.detached = make(map[[2]gopacket.Flow]*tcpStream)
+	}
+	t.detached = true
+	f.detached[[2]gopacket.Flow{t.net, t.transport}] = t
+}
+
+// resume returns the detached stream of the connection, if any
+func (f *tcpStreamFactory) resume(net, transport gopacket.Flow) *tcpStream {
+	t, ok := f.detached[[2]gopacket.Flow{net, transport}]
+	if !ok {
+		t, ok = f.detached[[2]gopacket.Flow{net.Reverse(), transport.Reverse()}]
+	}
+	if !ok {
+		return nil
+	}
+	delete(f.detached, [2]gopacket.Flow{t.net, t.transport})
+	t.detached = false
+	t.resumed = true
+	return t
+}
+
+// Shutdown marks the streams closed from now on as still open when the parser
+// stopped, and closes the detached streams, which the assembler no longer holds
+func (f *tcpStreamFactory) Shutdown() {
+	f.shutdown = true
+	for _, t := range f.detached {
+		t.finalize()
 	}
 }
 
 func (t *tcpStream) Accept(packet gopacket.Packet, tcp *layers.TCP, ci gopacket.CaptureInfo, dir reassembly.TCPFlowDirection,
 	nextSeq reassembly.Sequence, start *bool, ac reassembly.AssemblerContext) bool {
+	if t.done {
+		return false
+	}
+	if ci.Timestamp.After(t.lastSeen) {
+		t.lastSeen = ci.Timestamp
+	}
+	if t.resumed && nextSeq == invalidSequence {
+		// The new connection of a resumed stream has no handshake to start from
+		*start = true
+	}
+
 	if !t.allowMissingInit && !t.SYN {
 		if tcp.SYN {
 			t.SYN = true
@@ -124,33 +401,58 @@ func (t *tcpStream) Accept(packet gopacket.Packet, tcp *layers.TCP, ci gopacket.
 		dir = dir.Reverse()
 	}
 
-	// Determine the flow direction
-	var dirString string
 	if dir == reassembly.TCPDirClientToServer {
-		dirString = fmt.Sprintf("%v %v(%s)", t.net, t.transport, dir)
 		t.clientPacketCount++
+		t.established = t.established || (!tcp.SYN && t.serverPacketCount > 0)
+		t.fin[0] = t.fin[0] || tcp.FIN
 	} else {
-		dirString = fmt.Sprintf("%v %v(%s)", t.net.Reverse(), t.transport.Reverse(), dir)
 		t.serverPacketCount++
+		t.fin[1] = t.fin[1] || tcp.FIN
+	}
+	t.rst = t.rst || tcp.RST
+	if logger.DebugEnabled() {
+		logger.Debug.Printf("%s: Accept | S:%t, A:%t, P:%t, R:%t F:%t", t.dirString(dir), tcp.SYN, tcp.ACK, tcp.PSH, tcp.RST, tcp.FIN)
 	}
-	logger.Debug.Printf("%s: Accept | S:%t, A:%t, P:%t, R:%t F:%t", dirString, tcp.SYN, tcp.ACK, tcp.PSH, tcp.RST, tcp.FIN)
 
 	// stop processing the tcpStream when we reach the max packet count
 	if t.clientPacketCount > t.maxPacketCount || t.serverPacketCount > t.maxPacketCount {
+		t.truncated = true
 		return false
 	}
 
+	// The packet decoded by the parser, shared by all the stream consumers
+	var decoded *decode.Packet
+	if c, ok := ac.(packetContext); ok {
+		decoded = c.Packet()
+	}
 	for _, det := range t.detectors {
-		det.ProcessPacket(packet, tcp, ci, dir)
+		det.ProcessPacket(decoded, tcp, ci, dir)
 	}
 	if t.collector != nil {
-		t.collector.ProcessPacket(packet, tcp, ci, dir)
+		t.collector.ProcessPacket(decoded, tcp, ci, dir)
+	}
+	if t.recorder != nil {
+		t.recorder.ProcessPacket(decoded, tcp, dir)
+	}
+	if t.extractor != nil {
+		t.extractor.ProcessPacket(decoded, tcp, ci, dir)
 	}
 
 	return true
 }
 
+// dirString describes the flow in the given direction for debug logs
+func (t *tcpStream) dirString(dir reassembly.TCPFlowDirection) string {
+	if dir == reassembly.TCPDirClientToServer {
+		return fmt.Sprintf("%v %v(%s)", t.net, t.transport, dir)
+	}
+	return fmt.Sprintf("%v %v(%s)", t.net.Reverse(), t.transport.Reverse(), dir)
+}
+
 func (t *tcpStream) ReassembledSG(sg reassembly.ScatterGather, ac reassembly.AssemblerContext) {
+	if t.done {
+		return
+	}
 
 	dir, start, end, skip := sg.Info()
 	length, saved := sg.Lengths()
@@ -159,19 +461,30 @@ func (t *tcpStream) ReassembledSG(sg reassembly.ScatterGather, ac reassembly.Ass
 		dir = dir.Reverse()
 	}
 
-	// Determine the flow direction
-	var dirString string
-	if dir == reassembly.TCPDirClientToServer {
-		dirString = fmt.Sprintf("%v %v(%s)", t.net, t.transport, dir)
-	} else {
-		dirString = fmt.Sprintf("%v %v(%s)", t.net.Reverse(), t.transport.Reverse(), dir)
+	sgStats := sg.Stats()
+	if sgStats.QueuedPackets > 0 {
+		ReassemblyPacketsCount.WithLabelValues("out_of_order").Add(float64(sgStats.QueuedPackets))
+	}
+	if sgStats.OverlapPackets > 0 {
+		ReassemblyPacketsCount.WithLabelValues("overlap").Add(float64(sgStats.OverlapPackets))
+	}
+	if skip > 0 {
+		direction := "server"
+		if dir == reassembly.TCPDirClientToServer {
+			direction = "client"
+		}
+		MissingBytesCount.WithLabelValues(direction).Add(float64(skip))
 	}
 
-	sgStats := sg.Stats()
-	logger.Debug.Printf("%s: ReassembledSG | %d bytes (start:%v,end:%v,skip:%d,saved:%d,nb:%d,%d,overlap:%d,%d)",
-		dirString, length, start, end, skip, saved, sgStats.Packets,
-		sgStats.Chunks, sgStats.OverlapBytes, sgStats.OverlapPackets)
+	if logger.DebugEnabled() {
+		logger.Debug.Printf("%s: ReassembledSG | %d bytes (start:%v,end:%v,skip:%d,saved:%d,nb:%d,%d,overlap:%d,%d)",
+			t.dirString(dir), length, start, end, skip, saved, sgStats.Packets,
+			sgStats.Chunks, sgStats.OverlapBytes, sgStats.OverlapPackets)
+	}
 
+	for _, det := range t.detectors {
+		det.ProcessReassembled(&sg, &ac, dir)
+	}
 	t.collector.ProcessReassembled(sg, ac, dir)
 
 }
@@ -188,27 +501,112 @@ func (t *tcpStream) ReassemblyComplete(ac reassembly.AssemblerContext) bool {
 // 	packets at this point in the stream; we can now detect if disruption has occurred.
 // NOTE: this is not part of the standard gopacket, but is part of the fork we're using
 func (t *tcpStream) Destroy() {
+	if t.done {
+		return
+	}
+	if t.factory != nil && !t.factory.shutdown {
+		// The stream is still tracked by the factory, which is the one to end it
+		t.factory.detach(t)
+		return
+	}
+	t.finalize()
+}
+
+// finalize detects whether the stream was disrupted and writes it out. The
+// stream then holds on to nothing and rejects further packets.
+func (t *tcpStream) finalize() {
+	t.done = true
+	outcome := t.outcome()
+	if t.detached {
+		delete(t.factory.detached, [2]gopacket.Flow{t.net, t.transport})
+	}
+	// Stream counts are scaled up to estimate the streams of every flow
+	weight := 1.0
+	if t.factory != nil {
+		t.factory.active--
+		StreamsActive.Dec()
+		if t.factory.sampleRate > 1 {
+			weight = t.factory.sampleRate
+		}
+	}
 
 	// Detect stream disruption
-	var detectors []detector.Detector
+	var detectors, undisrupted []detector.Detector
 	for _, det := range t.detectors {
 		if !det.ProtocolDetected() {
 			continue
 		}
+		StreamOutcomesCount.With(prometheus.Labels{"detector": det.Label(), "outcome": outcome.String()}).Add(weight)
+		if !det.ValidOutcome(outcome) {
+			// The detector saw too little of the stream for its verdict to hold
+			logger.Debug.Printf("%s %s: Verdict of %s discarded (%s)", t.net, t.transport, det.Label(), outcome)
+			continue
+		}
+		det.Record()
 		disrupted := det.SignatureDetected()
 		if disrupted {
 			detectors = append(detectors, det)
+		} else {
+			undisrupted = append(undisrupted, det)
 		}
-		StreamsCount.With(prometheus.Labels{"detector": det.Label(), "disrupted": strconv.FormatBool(disrupted)}).Inc()
+		StreamsCount.With(prometheus.Labels{"detector": det.Label(), "disrupted": strconv.FormatBool(disrupted)}).Add(weight)
 	}
 
-	// Log collected fields for disrupted streams
+	// Log collected fields for disrupted streams, and for sampled baseline streams
 	disrupted := len(detectors) > 0
 	if disrupted {
-		t.streamWriter(detectors, t.collector)
+		t.streamWriter(detectors, t.collector, true, outcome)
 		logger.Debug.Printf("%s %s: Disruption Detected", t.net, t.transport)
+	} else if t.sampler != nil && len(undisrupted) > 0 {
+		if sampled := t.sampler.Sample(t.net, t.transport, undisrupted, t.collector, outcome); len(sampled) > 0 {
+			t.streamWriter(sampled, t.collector, false, outcome)
+		}
+	}
+
+	if t.recorder != nil {
+		t.discovery.Add(t.net, t.recorder)
+	}
+
+	// Export features of every stream, labelled by all relevant detectors
+	if t.extractor != nil {
+		t.featureWriter(t.detectors, t.collector, t.extractor.Features(), outcome)
 	}
 
 	// Update global stream counter
-	StreamsCount.With(prometheus.Labels{"detector": "global_streams", "disrupted": strconv.FormatBool(disrupted)}).Inc()
+	StreamsCount.With(prometheus.Labels{"detector": "global_streams", "disrupted": strconv.FormatBool(disrupted)}).Add(weight)
+	StreamOutcomesCount.With(prometheus.Labels{"detector": "global_streams", "outcome": outcome.String()}).Add(weight)
+
+	t.detectors, t.collector, t.recorder, t.extractor = nil, nil, nil, nil
+}
+
+// timeout returns how long the stream may go without packets given its state
+func (t *tcpStream) timeout() time.Duration {
+	timeouts := t.factory.timeouts
+	switch {
+	case t.rst || (t.fin[0] && t.fin[1]):
+		return timeouts.Closed
+	case t.fin[0] || t.fin[1]:
+		return timeouts.HalfClosed
+	case t.established:
+		return timeouts.Established
+	}
+	return timeouts.Handshake
+}
+
+// outcome returns the reason the stream ended. Truncation takes precedence as
+// any later RST or FIN was not seen by the detectors.
+func (t *tcpStream) outcome() detector.Outcome {
+	switch {
+	case t.truncated:
+		return detector.OutcomeMaxPackets
+	case t.rst:
+		return detector.OutcomeRST
+	case t.fin[0] || t.fin[1]:
+		return detector.OutcomeFIN
+	case t.evicted:
+		return detector.OutcomeEvicted
+	case t.factory != nil && t.factory.shutdown:
+		return detector.OutcomeShutdown
+	}
+	return detector.OutcomeIdle
 }
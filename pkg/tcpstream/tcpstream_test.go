@@ -1,6 +1,11 @@
 package tcpstream
 
 import (
+	"time"
+	"tripwire/pkg/collector"
+	"tripwire/pkg/config"
+	"tripwire/pkg/detector"
+
 	"github.com/Kkevsterrr/gopacket"
 	"github.com/Kkevsterrr/gopacket/layers"
 	"github.com/Kkevsterrr/gopacket/reassembly"
@@ -202,3 +207,238 @@ func TestUnitMaxPacketCount(t *testing.T) {
 		}
 	}
 }
+
+func TestUnitOutcome(t *testing.T) {
+	var tests = []struct {
+		shutdown bool
+		evicted  bool
+		packets  []layers.TCP
+		outcome  detector.Outcome
+	}{
+		{ // Closed by FIN
+			packets: []layers.TCP{{SYN: true}, {PSH: true}, {FIN: true, ACK: true}},
+			outcome: detector.OutcomeFIN,
+		},
+		{ // RST takes precedence over FIN
+			packets: []layers.TCP{{SYN: true}, {FIN: true, ACK: true}, {RST: true}},
+			outcome: detector.OutcomeRST,
+		},
+		{ // Truncated: the later RST is not seen by detectors
+			packets: []layers.TCP{{SYN: true}, {PSH: true}, {PSH: true}, {RST: true}},
+			outcome: detector.OutcomeMaxPackets,
+		},
+		{ // Flushed after inactivity
+			packets: []layers.TCP{{SYN: true}, {PSH: true}},
+			outcome: detector.OutcomeIdle,
+		},
+		{ // Still open when the parser stopped
+			shutdown: true,
+			packets:  []layers.TCP{{SYN: true}, {PSH: true}},
+			outcome:  detector.OutcomeShutdown,
+		},
+		{ // Evicted to make room for new streams
+			shutdown: true,
+			evicted:  true,
+			packets:  []layers.TCP{{SYN: true}, {PSH: true}},
+			outcome:  detector.OutcomeEvicted,
+		},
+		{ // FIN takes precedence over eviction
+			evicted: true,
+			packets: []layers.TCP{{SYN: true}, {PSH: true}, {FIN: true, ACK: true}},
+			outcome: detector.OutcomeFIN,
+		},
+	}
+
+	for i, test := range tests {
+		tcpStream := &tcpStream{
+			allowMissingInit: true,
+			maxPacketCount:   3,
+			evicted:          test.evicted,
+			factory:          &tcpStreamFactory{shutdown: test.shutdown},
+		}
+		for _, tcp := range test.packets {
+			tcpStream.Accept(nil, &tcp, gopacket.CaptureInfo{}, reassembly.TCPDirClientToServer, 1, nil, nil)
+		}
+		if outcome := tcpStream.outcome(); outcome != test.outcome {
+			t.Fatalf("test %d: got %v, want %v", i, outcome, test.outcome)
+		}
+	}
+}
+
+func TestUnitExpire(t *testing.T) {
+	var tests = []struct {
+		packets []struct {
+			dir reassembly.TCPFlowDirection
+			tcp layers.TCP
+		}
+		timeout time.Duration
+	}{
+		{ // Handshake only
+			packets: []struct {
+				dir reassembly.TCPFlowDirection
+				tcp layers.TCP
+			}{
+				{dir: reassembly.TCPDirClientToServer, tcp: layers.TCP{SYN: true}},
+				{dir: reassembly.TCPDirServerToClient, tcp: layers.TCP{SYN: true, ACK: true}},
+			},
+			timeout: 30 * time.Second,
+		},
+		{ // Established
+			packets: []struct {
+				dir reassembly.TCPFlowDirection
+				tcp layers.TCP
+			}{
+				{dir: reassembly.TCPDirClientToServer, tcp: layers.TCP{SYN: true}},
+				{dir: reassembly.TCPDirServerToClient, tcp: layers.TCP{SYN: true, ACK: true}},
+				{dir: reassembly.TCPDirClientToServer, tcp: layers.TCP{ACK: true}},
+			},
+			timeout: 2 * time.Minute,
+		},
+		{ // Half closed
+			packets: []struct {
+				dir reassembly.TCPFlowDirection
+				tcp layers.TCP
+			}{
+				{dir: reassembly.TCPDirClientToServer, tcp: layers.TCP{SYN: true}},
+				{dir: reassembly.TCPDirServerToClient, tcp: layers.TCP{SYN: true, ACK: true}},
+				{dir: reassembly.TCPDirClientToServer, tcp: layers.TCP{ACK: true}},
+				{dir: reassembly.TCPDirServerToClient, tcp: layers.TCP{FIN: true, ACK: true}},
+			},
+			timeout: time.Minute,
+		},
+		{ // Closed by RST
+			packets: []struct {
+				dir reassembly.TCPFlowDirection
+				tcp layers.TCP
+			}{
+				{dir: reassembly.TCPDirClientToServer, tcp: layers.TCP{SYN: true}},
+				{dir: reassembly.TCPDirServerToClient, tcp: layers.TCP{RST: true, ACK: true}},
+			},
+			timeout: 10 * time.Second,
+		},
+	}
+
+	start := time.Unix(1597964040, 0)
+	for i, test := range tests {
+		f := &tcpStreamFactory{timeouts: config.TimeoutConfig{
+			Handshake: 30 * time.Second, Established: 2 * time.Minute, HalfClosed: time.Minute, Closed: 10 * time.Second}}
+		tcpStream := &tcpStream{allowMissingInit: true, maxPacketCount: 25, factory: f}
+		f.streams = append(f.streams, tcpStream)
+		for _, packet := range test.packets {
+			tcpStream.Accept(nil, &packet.tcp, gopacket.CaptureInfo{Timestamp: start}, packet.dir, 1, nil, nil)
+		}
+
+		if expired := f.Expire(start.Add(test.timeout)); expired != 0 {
+			t.Fatalf("test %d: Expected %v but got %v", i, 0, expired)
+		}
+		if expired := f.Expire(start.Add(test.timeout + time.Second)); expired != 1 {
+			t.Fatalf("test %d: Expected %v but got %v", i, 1, expired)
+		}
+		if len(f.streams) != 0 {
+			t.Fatalf("test %d: Expected %v but got %v", i, 0, len(f.streams))
+		}
+		if tcpStream.Accept(nil, &layers.TCP{ACK: true}, gopacket.CaptureInfo{}, reassembly.TCPDirClientToServer, 1, nil, nil) {
+			t.Fatalf("test %d: Expected packets after expiry to be rejected", i)
+		}
+	}
+}
+
+func TestUnitEvict(t *testing.T) {
+	start := time.Unix(1597964040, 0)
+	f := &tcpStreamFactory{maxStreams: 5}
+	// Streams 0-4 completed their handshake, streams 5-9 did not
+	for i := 0; i < 10; i++ {
+		f.streams = append(f.streams, &tcpStream{
+			factory:     f,
+			lastSeen:    start.Add(time.Duration(i) * time.Second),
+			established: i < 5,
+		})
+		f.active++
+	}
+	streams := append([]*tcpStream(nil), f.streams...)
+
+	f.evict()
+
+	// Handshake-incomplete streams go first, then the oldest idle ones
+	for i, tcpStream := range streams {
+		evicted := i == 0 || i >= 5
+		if tcpStream.done != evicted {
+			t.Fatalf("stream %d: Expected %v but got %v", i, evicted, tcpStream.done)
+		}
+		if evicted && tcpStream.outcome() != detector.OutcomeEvicted {
+			t.Fatalf("stream %d: Expected %v but got %v", i, detector.OutcomeEvicted, tcpStream.outcome())
+		}
+	}
+	if len(f.streams) != 4 || f.streams[0] != streams[1] || f.active != 4 {
+		t.Fatalf("Expected %v but got %v (%d active)", streams[1:5], f.streams, f.active)
+	}
+	// The connections of every evicted stream, up to the most recently seen
+	last := start.Add(9*time.Second + time.Nanosecond)
+	if ended, evicted := f.Evicted(); !evicted || !ended.Equal(last) {
+		t.Fatalf("Expected %v but got %v (evicted: %v)", last, ended, evicted)
+	}
+	if _, evicted := f.Evicted(); evicted {
+		t.Fatalf("Expected %v but got %v", false, evicted)
+	}
+}
+
+// assemblerContext is the assembler context of the packets fed to the assembler in tests
+type assemblerContext gopacket.CaptureInfo
+
+func (c assemblerContext) GetCaptureInfo() gopacket.CaptureInfo {
+	return gopacket.CaptureInfo(c)
+}
+
+func TestUnitEvictAssembler(t *testing.T) {
+	start := time.Unix(1597964040, 0)
+	cf, _ := collector.NewCollectorFactory(config.CollectorConfig{})
+	df, err := detector.NewDetectorFactory(config.DetectorConfig{Name: "any_443_any", Signature: "ANY", Protocol: "ANY", Port: 443})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := NewTCPStreamFactory(config.TCPConfig{Limits: config.LimitConfig{MaxStreams: 10}}, cf,
+		[]detector.DetectorFactory{df}, func([]detector.Detector, collector.Collector, bool, detector.Outcome) {}, nil, nil, nil)
+	assembler := reassembly.NewAssembler(reassembly.NewStreamPool(f))
+	netFlow := gopacket.NewFlow(layers.EndpointIPv4, []byte{10, 0, 0, 1}, []byte{10, 0, 0, 2})
+	send := func(port int, tcp layers.TCP, timestamp time.Time) {
+		// Negative ports are those of the packets from the server
+		tcp.SrcPort, tcp.DstPort = layers.TCPPort(port), 443
+		flow := netFlow
+		if port < 0 {
+			tcp.SrcPort, tcp.DstPort = 443, layers.TCPPort(-port)
+			flow = netFlow.Reverse()
+		}
+		tcp.SetInternalPortsForTesting()
+		assembler.AssembleWithContext(flow, nil, &tcp, assemblerContext{Timestamp: timestamp})
+		if ended, evicted := f.Evicted(); evicted {
+			assembler.FlushCloseOlderThan(ended)
+		}
+	}
+
+	// A connection idle since it was established, then a flood of handshakes
+	send(1000, layers.TCP{SYN: true}, start)
+	send(-1000, layers.TCP{SYN: true, ACK: true}, start)
+	send(1000, layers.TCP{ACK: true}, start)
+	for i := 0; i < 100; i++ {
+		send(2000+i, layers.TCP{SYN: true}, start.Add(time.Duration(i+1)*time.Millisecond))
+	}
+	if len(f.streams) > 10 {
+		t.Fatalf("Expected at most %v but got %v", 10, len(f.streams))
+	}
+	idle := f.streams[0]
+	if idle.done || idle.transport.Src().String() != "1000" {
+		t.Fatalf("Expected the idle connection to be tracked but got %v", idle.transport)
+	}
+
+	// The connection of the idle stream was closed along with those of evicted
+	// streams, and is resumed by its next packet
+	send(1000, layers.TCP{ACK: true}, start.Add(time.Second))
+	if idle.done || idle.clientPacketCount != 3 {
+		t.Fatalf("Expected %v but got %v", 3, idle.clientPacketCount)
+	}
+
+	// The assembler only holds the connections of the tracked streams
+	if closed := assembler.FlushAll(); closed != len(f.streams) {
+		t.Fatalf("Expected %v but got %v", len(f.streams), closed)
+	}
+}